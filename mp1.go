@@ -3,12 +3,26 @@ package main
 //import necessary packages.
 import (
 	"bufio"
+	"compress/gzip"
+	"container/heap"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,215 +30,7318 @@ import (
 )
 
 // Process struct represents a single process in the system.
-// It has an ID, IP address, and a port.
+// It has an ID, IP address, and a port, plus the runtime state created by startProcess.
 type Process struct {
-	ID   int    // Unique identifier for the process
-	IP   string // IP address of the machine where the process is running
-	Port string // Port on which the process is listening for connections
+	ID       int    // Unique identifier for the process
+	IP       string // IP address of the machine where the process is running
+	Port     string // Port on which the process is listening for connections
+	BindAddr string // Local address the listener binds to, defaults to IP
+
+	// Output receives the lines the process logs, each prefixed with its ID. It defaults to the standard output;
+	// a test can set a buffer to check what the process printed. It is never sent to other processes.
+	Output io.Writer `json:"-"`
+	// DeliveryHandler is called with every plain message the process delivers, after it is printed, so a program
+	// embedding the process can react to deliveries. It runs while the holdback queues are locked and must not
+	// send messages itself; nil means deliveries are only printed. It is never sent to other processes.
+	DeliveryHandler func(UnicastMessage) `json:"-"`
+
+	// Middleware is applied in order to every message the process receives, before it is handled, so a program
+	// embedding the process can transform, count or drop messages. It sees every kind of message, including acks
+	// and heartbeats. Handling and printing the message is the last step of the chain.
+	Middleware MiddlewareChain `json:"-"`
+
+	// Time is the source of the current time and of the timers behind the message delays, heartbeats, retransmissions
+	// and timeouts of the process. It defaults to the system clock; a test can set a fake one to control time.
+	// It is never sent to other processes.
+	Time Clock `json:"-"`
+
+	// Events publishes what happens inside the process, such as peers connecting or failing and messages being
+	// delivered, to the handlers a program embedding the process subscribed to it before starting the process.
+	// startProcess creates an empty bus if it is nil. It is never sent to other processes.
+	Events *EventBus `json:"-"`
+
+	config      *Config             // Configuration the process was started with
+	connections *ConnectionManager  // Connections to the other processes, keyed by process ID
+	clock       *LamportClock       // Lamport clock of the process
+	fifo        *FIFODelivery       // Holdback queue putting the plain messages of each source in send order
+	causal      *CausalDelivery     // Vector clock and holdback queue for causal delivery
+	total       *TotalOrderDelivery // Holdback queue for totally ordered delivery
+	isis        *ISISState          // Proposals and holdback queue of the ISIS total order multicast
+	sequencer   *Sequencer          // Sequence number generator, only used by the sequencer process
+	acks        *AckTracker         // Sequence numbers and unacknowledged plain messages per destination
+	quorum      *QuorumTracker      // Acks of quorum broadcasts not committed yet
+	history     *SendHistory        // Recently sent plain messages per destination, resent on a NAK
+	snapshots   *SnapshotState      // Chandy-Lamport snapshots being recorded by the process
+	election    *ElectionState      // Current leader and the state of a running Bully election
+	pings       *PingTracker        // Pings waiting for their pong
+	mutex       *MutexState         // Ricart-Agrawala state of the distributed lock
+	ring        *TokenRing          // Token ring state of the distributed lock
+	kv          *KVStore            // Local replica of the key-value store, updated in total order
+	trace       *DeliveryTrace      // Plain messages in the order they were delivered, checked by the verify command
+	gate        *DeliveryGate       // Holds plain messages back from the application while delivery is paused
+	tracker     *MessageTracker     // Sequence numbers, nonces and gossip IDs already received, to drop copies and replays
+	arrivals    *ArrivalOrder       // Largest Lamport timestamp received from each source, to warn about reordering
+	detector    *FailureDetector    // Heartbeat-based view of which peers are alive
+	gossip      *GossipState        // Numbers the gossip messages the process starts
+	rng         *Random             // Random source for delays, drops and gossip targets
+	stats       *TrafficStats       // Messages and bytes exchanged with each peer
+	blocked     *Blocklist          // Peers whose messages are dropped to simulate a partition
+	limiter     *RateLimiter        // Spaces the delayed messages to each peer to stay under Config.RateLimit
+	delays      *DelayBounds        // Current minimum and maximum delay, starting from the configuration
+	pending     *PendingSends       // Delayed messages not sent yet, waited for on shutdown
+	scheduled   *DelayQueue         // Delayed messages waiting for dispatchLoop, only used in the queued delay mode
+	messageLog  *MessageLog         // Durable record of delivered messages, nil if the file could not be opened
+	logger      *Logger             // Output of the process, prefixed with its ID and filtered by Config.LogLevel
+	receiving   map[net.Conn]bool   // Connections with a running receive loop
+	receivers   *sync.WaitGroup     // Counts the running receive loops
+	receivePool *ReceivePool        // Bounds the running receive loops to Config.MaxConnections
+	outbox      *Outbox             // Messages sent to members that are not connected yet
+	breaker     *CircuitBreaker     // Stops sending to peers whose sends keep failing
+	deadLetters *DeadLetterQueue    // Plain messages the process gave up on
+	listener    net.Listener        // Listener accepting connections from the other processes
+	transport   Transport           // Opens the listener and the connections to the other processes
+	control     *http.Server        // HTTP control endpoint, nil unless Config.ControlPort is set
+	discovery   net.PacketConn      // UDP socket of the discovery announcements, nil unless Config.Discovery is set
+	members     map[int]Process     // Current membership, including processes that joined at runtime
+	leaveAcks   chan int            // Receives the IDs of peers acknowledging our leave, nil unless leaving
+	mu          *sync.Mutex         // Protects receiving, members, leaveAcks, listener and alive
+	done        chan struct{}       // Closed when the process shuts down
+	alive       chan struct{}       // Closed when the process crashes, replaced when it restarts
+}
+
+// Middleware type intercepts a received message. It returns the message to pass on, which may be changed,
+// and false to drop it.
+type Middleware func(UnicastMessage) (UnicastMessage, bool)
+
+// MiddlewareChain type is the list of middleware of a process, applied in order.
+type MiddlewareChain []Middleware
+
+// Apply function runs the message through every middleware in order and reports false as soon as one drops it.
+func (c MiddlewareChain) Apply(msg UnicastMessage) (UnicastMessage, bool) {
+	for _, middleware := range c {
+		var keep bool
+		if msg, keep = middleware(msg); !keep {
+			return msg, false
+		}
+	}
+	return msg, true
+}
+
+// GobEncode function leaves the chain out when members are sent to a joining process, functions cannot be encoded.
+func (c MiddlewareChain) GobEncode() ([]byte, error) {
+	return nil, nil
+}
+
+// GobDecode function decodes the empty chain of a member received from another process.
+func (c *MiddlewareChain) GobDecode([]byte) error {
+	return nil
+}
+
+// EventType type names something that happened inside a process.
+type EventType string
+
+// Events published on the EventBus of a process.
+const (
+	EventPeerConnected    EventType = "PeerConnected"    // A connection to PeerID was registered, dialed or accepted
+	EventPeerDisconnected EventType = "PeerDisconnected" // The connection to PeerID was closed
+	EventPeerSuspected    EventType = "PeerSuspected"    // The failure detector suspects PeerID
+	EventPeerFailed       EventType = "PeerFailed"       // The failure detector considers PeerID failed
+	EventPeerAlive        EventType = "PeerAlive"        // A heartbeat arrived from PeerID after it was suspected or failed
+	EventMessageDelivered EventType = "MessageDelivered" // Message, a plain message from PeerID, was delivered
+	EventLeaderElected    EventType = "LeaderElected"    // PeerID became the leader, possibly the process itself
+)
+
+// Event struct is one notification published on an EventBus.
+type Event struct {
+	Type      EventType      // What happened
+	ProcessID int            // Process the event happened in
+	PeerID    int            // Other process the event is about
+	Message   UnicastMessage // Delivered message, only set for EventMessageDelivered
+	Time      time.Time      // Wall time of the process when it happened
+}
+
+// EventBus struct hands the events of a process to the handlers subscribed to their type, so a program embedding
+// the process can observe it without parsing its output. Handlers run synchronously, in subscription order, on the
+// goroutine that published the event, so they must return quickly and must not send messages; events published
+// by different goroutines may reach a handler concurrently.
+type EventBus struct {
+	mu       sync.Mutex                  // Protects handlers
+	handlers map[EventType][]func(Event) // Handlers of each event type, in subscription order
+}
+
+// NewEventBus function creates a bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{handlers: make(map[EventType][]func(Event))}
+}
+
+// Subscribe function calls handler with every later event of the given type.
+func (b *EventBus) Subscribe(eventType EventType, handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+}
+
+// Publish function calls the handlers subscribed to the type of the event. The lock is not held while they run,
+// so a handler may subscribe more handlers.
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	handlers := b.handlers[event.Type]
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// GobEncode function leaves the bus out when members are sent to a joining process, handlers cannot be encoded.
+func (b *EventBus) GobEncode() ([]byte, error) {
+	return nil, nil
+}
+
+// GobDecode function decodes the empty bus of a member received from another process.
+func (b *EventBus) GobDecode([]byte) error {
+	return nil
+}
+
+// publish function publishes an event about a peer on the bus of the process.
+func (p *Process) publish(eventType EventType, peerID int, msg UnicastMessage) {
+	p.Events.Publish(Event{Type: eventType, ProcessID: p.ID, PeerID: peerID, Message: msg, Time: p.wallTime()})
+}
+
+// Clock interface tells the time and creates timers, so time-dependent behaviour can run on a fake clock.
+type Clock interface {
+	Now() time.Time                         // Current time
+	After(d time.Duration) <-chan time.Time // Receives the time once d has passed, right away if d is not positive
+}
+
+// systemClock struct is the Clock of the time package.
+type systemClock struct{}
+
+// Now function returns the current system time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After function waits d on the system clock.
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// wallTime function returns the system time as the process reports it: the time of its clock shifted by the
+// clock skew Config.ClockSkews gives the process, to simulate unsynchronized wall clocks. Timers are never skewed.
+func (p *Process) wallTime() time.Time {
+	return p.Time.Now().Add(p.config.ClockSkews[p.ID])
+}
+
+// Config struct represents the configuration of the system.
+// It includes the minimum and maximum delay for sending messages,
+// and a list of all processes in the system.
+type Config struct {
+	MinDelay          int                   // Minimum delay for sending messages
+	MaxDelay          int                   // Maximum delay for sending messages
+	Processes         []Process             // List of all processes in the system
+	Retransmit        RetransmitConfig      // When and how often unacknowledged messages are resent
+	HeartbeatInterval time.Duration         // Interval between heartbeats sent to every peer by the failure detector
+	HeartbeatJitter   float64               // Fraction (0.0 to 1.0) of HeartbeatInterval each interval is randomly shortened or lengthened by
+	Fanout            int                   // Number of random peers a gossiped message is forwarded to
+	GossipTTL         int                   // Hops a new gossip message may travel before it is no longer forwarded
+	ReconnectInterval time.Duration         // Interval between the health checks that redial broken connections, 0 disables them
+	DelayModel        string                // Distribution of the message delays between MinDelay and MaxDelay
+	DelayMode         string                // How delayed messages wait out their delay, DelayModeIndependent or DelayModeQueued
+	DropRate          float64               // Probability (0.0 to 1.0) that a delayed message is lost instead of sent
+	RandSeed          int64                 // Seed of the random sources, 0 means seeding from the current time
+	Retry             RetryPolicy           // How connecting to a peer is retried
+	Codec             string                // Wire format of the messages, CodecGob or CodecJSON
+	ControlPort       int                   // Base port of the HTTP control endpoints, process N listens on ControlPort+N; 0 disables them
+	Discovery         DiscoveryConfig       // UDP announcements finding processes missing from the configuration
+	Breaker           BreakerConfig         // When sends to a failing peer stop being attempted, and for how long
+	LogLevel          LogLevel              // Least severe output a process prints
+	Compression       bool                  // Whether to gzip connections, used only with peers that want it too
+	TLSCert           string                // Certificate file of the processes, TLS is off if empty
+	TLSKey            string                // Private key file of TLSCert
+	TLSCA             string                // File with the CA certificates that peers are verified against
+	KeepAlive         time.Duration         // Period of the TCP keepalive probes on idle connections, 0 disables them
+	WriteTimeout      time.Duration         // How long writing one message may block before the connection is dropped, 0 waits forever
+	InboundQueue      int                   // Number of decoded messages per connection waiting to be handled before decoding pauses
+	DeliverySemantics string                // Guarantee for plain messages, SemanticsAtLeastOnce or SemanticsAtMostOnce
+	WindowSize        int                   // Most unacknowledged plain messages per peer before sending blocks, 0 for no limit
+	MaxMessageBytes   int                   // Largest message sent or accepted, in bytes; a peer sending a larger one is disconnected
+	Groups            map[string][]int      // Named groups of process IDs, addressed by the sendgroup command
+	Mutex             string                // Mutual exclusion algorithm of the lock command, MutexRicartAgrawala or MutexTokenRing
+	RateLimit         float64               // Most delayed messages per second written to one peer, 0 for no limit
+	MessageTTL        time.Duration         // How long after it is sent a plain message may still be delivered, 0 for no limit
+	LinkDelays        map[string]DelayRange // Delay ranges overriding MinDelay and MaxDelay for single links, keyed by linkKey
+	DrainTimeout      time.Duration         // How long shutting down waits for delayed messages to be sent, 0 drops them
+	BatchSize         int                   // Most messages written to a connection as one BatchMessage, 0 or 1 disables batching
+	BatchWindow       time.Duration         // How long a connection waits for more messages to fill a batch
+	MaxConnections    int                   // Most open connections, and so receive loops, of a process; 0 for no limit
+	OptionLines       []string              // Option lines in the order they were read, written back by saveconfig
+	ClockSkews        map[int]time.Duration // Offset added to the system time a process reports, keyed by process ID
+	Trace             bool                  // Whether every send, receive, clock update, holdback, delivery and ack of a plain message is traced
+	DeadLetterFile    string                // File the dead letters of every process are appended to, none if empty
+}
+
+// DelayRange struct is the range of the delays of the messages on one link, in milliseconds.
+type DelayRange struct {
+	Min int // Minimum delay
+	Max int // Maximum delay
+}
+
+// DelayBounds struct holds the minimum and maximum delay of a process, in milliseconds. They start as the
+// delays of the configuration and can be changed at runtime by the setdelay command. It also holds the extra
+// latency the latency command adds to the sends to single peers.
+type DelayBounds struct {
+	mu       sync.Mutex            // Protects minDelay, maxDelay and latency
+	minDelay int                   // Minimum delay
+	maxDelay int                   // Maximum delay
+	latency  map[int]time.Duration // Fixed delay added to every send to a peer, on top of the random one
+}
+
+// NewDelayBounds function creates delay bounds with the given minimum and maximum and no extra latency.
+func NewDelayBounds(minDelay int, maxDelay int) *DelayBounds {
+	return &DelayBounds{minDelay: minDelay, maxDelay: maxDelay, latency: make(map[int]time.Duration)}
+}
+
+// Get function returns the current minimum and maximum delay.
+func (d *DelayBounds) Get() (minDelay int, maxDelay int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.minDelay, d.maxDelay
+}
+
+// Set function replaces the minimum and maximum delay, which must satisfy 0 <= min <= max.
+func (d *DelayBounds) Set(minDelay int, maxDelay int) error {
+	if minDelay < 0 || minDelay > maxDelay {
+		return fmt.Errorf("delays must satisfy 0 <= min <= max, got min %d and max %d", minDelay, maxDelay)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.minDelay, d.maxDelay = minDelay, maxDelay
+	return nil
+}
+
+// SetLatency function sets the extra latency of the sends to a peer, in milliseconds. 0 removes it.
+func (d *DelayBounds) SetLatency(peerID int, latency int) error {
+	if latency < 0 {
+		return fmt.Errorf("latency must not be negative, got %d", latency)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if latency == 0 {
+		delete(d.latency, peerID)
+	} else {
+		d.latency[peerID] = time.Duration(latency) * time.Millisecond
+	}
+	return nil
+}
+
+// Latency function returns the extra latency of the sends to a peer.
+func (d *DelayBounds) Latency(peerID int) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latency[peerID]
+}
+
+// linkKey function returns the key of the link from one process to another in Config.LinkDelays, "srcID-dstID".
+func linkKey(sourceID int, destinationID int) string {
+	return fmt.Sprintf("%d-%d", sourceID, destinationID)
+}
+
+// RetransmitConfig struct controls the retransmission of unacknowledged messages.
+type RetransmitConfig struct {
+	Timeout    time.Duration // How long to wait for an ack before resending a message
+	MaxRetries int           // Number of resends before a message is reported as permanently failed
+}
+
+// DiscoveryConfig struct controls the UDP announcements processes find each other with. Every process listens
+// for them on the UDP port with the number of its TCP port, so several processes on one host can take part,
+// and sends its own to every port from FirstPort to LastPort.
+type DiscoveryConfig struct {
+	FirstPort     int    // Lowest port announcements are sent to, 0 disables discovery
+	LastPort      int    // Highest port announcements are sent to
+	BroadcastAddr string // Address announcements are sent to, the broadcast address of the LAN or 127.0.0.1 on one host
+}
+
+// Settings of the discovery announcements.
+const (
+	DiscoveryInterval    = time.Second       // Time between two announcements of a process
+	MaxDiscoveryPorts    = 256               // Most ports one announcement is sent to
+	DefaultBroadcastAddr = "255.255.255.255" // Address announcements are sent to unless the discovery option names one
+)
+
+// BreakerConfig struct controls the circuit breaker of each peer.
+type BreakerConfig struct {
+	Failures int           // Consecutive failed sends that open the breaker, 0 disables it
+	Cooldown time.Duration // How long an open breaker fails sends before it lets a trial message through
+}
+
+// RetryPolicy struct controls how often and how fast a failed dial is retried.
+type RetryPolicy struct {
+	MaxAttempts int           // Number of dial attempts before giving up
+	BaseDelay   time.Duration // Pause after the first failed attempt
+	Backoff     string        // How the pause grows, BackoffLinear or BackoffExponential
+}
+
+// Backoff strategies accepted by the retry option.
+const (
+	BackoffLinear      = "linear"      // The n-th pause is n times BaseDelay
+	BackoffExponential = "exponential" // The pause doubles after every attempt, with random jitter
+)
+
+// Default values used when the configuration file does not set them.
+const (
+	DefaultRetransmitTimeout = time.Second
+	DefaultMaxRetries        = 3
+	DedupWindow              = 1024 // Number of recent sequence numbers remembered per source to drop duplicates
+	NonceWindow              = 4096 // Number of recent nonces remembered per source to drop replayed messages
+	SendHistorySize          = 256  // Number of recent plain messages kept per destination to answer NAKs
+	DeadLetterLimit          = 1000 // Number of recent dead letters kept in memory by the deadletters command
+	DefaultHeartbeatInterval = time.Second
+	DefaultHeartbeatJitter   = 0.1 // Fraction of the heartbeat interval each interval may be shorter or longer by
+	DefaultFanout            = 2
+	DefaultGossipTTL         = 5
+	DefaultReconnect         = 2 * time.Second
+	LeaveAckTimeout          = time.Second // How long a departing process waits for its leave to be acknowledged
+	UnknownPeer              = -1          // Peer ID of a connection whose other side has not introduced itself yet
+	DefaultDelayModel        = DelayUniform
+	DefaultDelayMode         = DelayModeIndependent
+	DefaultDialAttempts      = 5
+	DefaultDialDelay         = time.Second
+	DefaultBackoff           = BackoffExponential
+	MaxDialBackoff           = 10 * time.Second // Longest pause between two attempts to reach a peer that is down at startup
+	OutboxSize               = 64               // Most messages kept per peer that has no connection yet
+	DefaultCodec             = CodecGob
+	DefaultKeepAlive         = 15 * time.Second
+	DefaultWriteTimeout      = 5 * time.Second
+	DefaultInboundQueue      = 64
+	DefaultMaxMessageBytes   = 16 << 20
+	MinMessageLimit          = 64 << 10        // Smallest maxmessage accepted, the first gob message also carries the type definitions
+	NegotiationTimeout       = 5 * time.Second // How long a new connection waits for the peer's compression byte
+	DefaultLogLevel          = LogInfo
+	DefaultDeliverySemantics = SemanticsAtLeastOnce
+	DefaultMutex             = MutexRicartAgrawala
+	DefaultDrainTimeout      = 2 * time.Second
+	DefaultBreakerFailures   = 5
+	DefaultBreakerCooldown   = 10 * time.Second
+	MessageSeparator         = "|"                    // Separates the messages of a send command sending several at once
+	TokenHoldTime            = 100 * time.Millisecond // How long a process not wanting the lock keeps the token before passing it on
+)
+
+// Delivery semantics accepted by the delivery option.
+const (
+	SemanticsAtLeastOnce = "at-least-once" // Plain messages are acknowledged, resent until acked and deduplicated by the receiver
+	SemanticsAtMostOnce  = "at-most-once"  // Plain messages are sent once and delivered on arrival, a lost message stays lost
+)
+
+// Ordering classes of a plain message, chosen per message by the osend command.
+const (
+	OrderingNone   = "none"   // Delivered as soon as it arrives
+	OrderingFIFO   = "fifo"   // Delivered in the send order of its source
+	OrderingCausal = "causal" // Delivered in send order and after its causal predecessors, the class of msend and the other multicasts
+	OrderingTotal  = "total"  // Delivered in the same order everywhere, through the sequencer
+)
+
+// Mutual exclusion algorithms accepted by the mutex option.
+const (
+	MutexRicartAgrawala = "ricart-agrawala" // The lock is granted once every peer replied to a timestamped request
+	MutexTokenRing      = "token-ring"      // The lock is held while holding a token circulating along the ring of process IDs
+)
+
+// Timeouts of the Bully election.
+const (
+	ElectionTimeout    = time.Second     // How long a candidate waits for an OK before it declares itself leader
+	CoordinatorTimeout = 3 * time.Second // How long a candidate that got an OK waits for the coordinator before starting over
+)
+
+// Delay models accepted by the delay option.
+const (
+	DelayUniform     = "uniform"     // Every delay between MinDelay and MaxDelay is equally likely
+	DelayExponential = "exponential" // MinDelay plus an exponentially distributed extra delay, capped at MaxDelay
+	DelayNormal      = "normal"      // Normally distributed around the middle of MinDelay and MaxDelay
+)
+
+// Delay modes accepted by the delaymode option.
+const (
+	DelayModeIndependent = "independent" // Every delayed message sleeps in a goroutine of its own, equal fire times race
+	DelayModeQueued      = "queued"      // One goroutine sends the delayed messages in fire time order, then send order
+)
+
+// LogLevel type orders the output of a process by severity.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota // Acks, NAKs, retransmissions and dropped messages of blocked peers
+	LogInfo                  // Sent, received and delivered messages and membership changes
+	LogError                 // Failures only
+)
+
+// logLevels maps the names accepted by the loglevel option to their level.
+var logLevels = map[string]LogLevel{"debug": LogDebug, "info": LogInfo, "error": LogError}
+
+// MessageKind type tells the receiver how a UnicastMessage should be handled.
+type MessageKind int
+
+const (
+	KindData         MessageKind = iota // Plain message, delivered in causal order
+	KindOrderRequest                    // Request asking the sequencer to broadcast a message in total order
+	KindSequenced                       // Broadcast message carrying a sequence number assigned by the sequencer
+	KindAck                             // Acknowledgment of a plain message
+	KindHeartbeat                       // Periodic liveness announcement for the failure detector
+	KindGossip                          // Message disseminated by gossip
+	KindJoinRequest                     // A process announcing that it joins the cluster
+	KindJoinResponse                    // Current member list sent back to a joining process
+	KindLeave                           // A process announcing that it leaves the cluster
+	KindLeaveAck                        // Acknowledgment of a leave announcement
+	KindHandshake                       // First message in each direction of a new connection, telling the other side who it is
+	KindISISMessage                     // First ISIS phase: a message multicast in total order, asking for proposals
+	KindISISProposal                    // Second ISIS phase: a receiver's proposed sequence number, sent back to the origin
+	KindISISAgreed                      // Third ISIS phase: the agreed sequence number, multicast by the origin
+	KindNak                             // Negative acknowledgment asking the sender to resend missing plain messages
+	KindMarker                          // Chandy-Lamport marker of a global snapshot
+	KindElection                        // Bully election started by a process with a lower ID
+	KindOk                              // Answer of a higher process to an election, taking it over
+	KindCoordinator                     // Announcement of the winner of an election
+	KindPing                            // Latency probe, answered right away with a pong
+	KindPong                            // Answer to a ping, echoing its send time
+	KindLockRequest                     // Ricart-Agrawala request to enter the critical section
+	KindLockReply                       // Permission to enter the critical section, answering a lock request
+	KindToken                           // Token of the token ring, passed to the next process
+	KindBatch                           // Several messages written to a connection together, handled one by one
+)
+
+// UnicastMessage is the struct for passing messages between processes
+// it includes the source id and it's corresponding messages
+type UnicastMessage struct {
+	Kind      MessageKind         // Kind of the message, KindData for plain messages
+	SourceID  int                 //Source ID or Sender ID
+	Message   string              // Message from the sender
+	Timestamp int                 // Lamport timestamp of the send event
+	Vector    VectorClock         // Vector timestamp of the send event, used for causal delivery
+	Sequenced *SequencedMessage   // Ordered broadcast payload, only set for KindSequenced
+	Seq       int                 // Per-destination sequence number of a plain message, echoed back in its ack
+	Ack       *AckMessage         // Acknowledgment payload, only set for KindAck
+	Heartbeat *HeartbeatMessage   // Heartbeat payload, only set for KindHeartbeat
+	Gossip    *GossipMessage      // Gossip payload, only set for KindGossip
+	Join      *JoinRequest        // Join payload, only set for KindJoinRequest
+	Members   *JoinResponse       // Member list payload, only set for KindJoinResponse
+	Leave     *LeaveMessage       // Leave payload, only set for KindLeave
+	Handshake *HandshakeMessage   // Handshake payload, only set for KindHandshake
+	ISIS      *ISISMessage        // ISIS payload, only set for the three ISIS kinds
+	Nak       *NakMessage         // NAK payload, only set for KindNak
+	Marker    *MarkerMessage      // Snapshot marker payload, only set for KindMarker
+	Election  *ElectionMessage    // Election payload, only set for KindElection
+	Ok        *OkMessage          // Election answer payload, only set for KindOk
+	Leader    *CoordinatorMessage // Coordinator payload, only set for KindCoordinator
+	Put       *PutMessage         // Key-value update, only set for a KindOrderRequest asking to sequence a put
+	Ping      *PingMessage        // Latency probe payload, only set for KindPing
+	Pong      *PongMessage        // Latency probe answer, only set for KindPong
+	LockReq   *LockRequestMessage // Lock request payload, only set for KindLockRequest
+	LockReply *LockReplyMessage   // Lock reply payload, only set for KindLockReply
+	Token     *TokenMessage       // Token ring payload, only set for KindToken
+	Batch     []UnicastMessage    // Messages of a batch in the order they were queued, only set for KindBatch
+	Priority  int                 // Messages with a higher priority are written first when several wait for a connection
+	Nonce     uint64              // Random number set on every write, a receiver drops a message whose nonce it has seen
+	Ordering  string              // Ordering class of a plain message, OrderingCausal if empty
+	Deadline  time.Time           // Time of the sender's clock, without its skew, after which a plain message is dropped instead of delivered, none if zero
+}
+
+// Message priorities. Control messages jump ahead of the data messages waiting for the same connection.
+const (
+	PriorityData    = 0 // Default priority of every message
+	PriorityControl = 1 // Heartbeats, acks and NAKs, which must not wait behind bulk data
+)
+
+// SequencedMessage struct is a broadcast message ordered by the sequencer.
+type SequencedMessage struct {
+	Seq      int         // Global sequence number assigned by the sequencer
+	OriginID int         // Process that asked for the broadcast
+	Message  string      // Message being broadcast
+	Put      *PutMessage // Key-value update being broadcast instead of a message, nil for a plain broadcast
+}
+
+// PutMessage struct is an update of the replicated key-value store, applied by every process in total order.
+// Timestamp and ProcessID order concurrent puts to the same key: the last writer wins.
+type PutMessage struct {
+	Key       string // Key being written
+	Value     string // New value of the key
+	Timestamp int    // Lamport time at which the writing process issued the put
+	ProcessID int    // Process that issued the put, breaks ties between equal timestamps
+}
+
+// newer function reports whether put p was written after put other, by Lamport time and then process ID.
+func (p PutMessage) newer(other PutMessage) bool {
+	if p.Timestamp != other.Timestamp {
+		return p.Timestamp > other.Timestamp
+	}
+	return p.ProcessID > other.ProcessID
+}
+
+// AckMessage struct acknowledges that a plain message was received.
+type AckMessage struct {
+	SenderID int // Process that sent the acknowledged message
+	Seq      int // Sequence number of the acknowledged message
+}
+
+// HeartbeatMessage struct announces that the sender is alive.
+type HeartbeatMessage struct {
+	Count int // Number of heartbeats sent by the process so far
+}
+
+// GossipMessage struct is a message spread through the cluster by gossip.
+type GossipMessage struct {
+	ID       string // Unique ID of the message, "<origin>-<counter>", so each process forwards it only once
+	OriginID int    // Process that started the gossip
+	Message  string // Message being disseminated
+	TTL      int    // Hops the message may still travel, it is not forwarded once this reaches zero
+}
+
+// JoinRequest struct announces a process joining a running cluster.
+type JoinRequest struct {
+	ID    int    // ID of the joining process
+	IP    string // IP address of the joining process
+	Port  string // Port the joining process listens on
+	Reply bool   // Whether the receiver should answer with a JoinResponse
+}
+
+// JoinResponse struct tells a joining process who is in the cluster.
+type JoinResponse struct {
+	Members []Process   // Every known member, including the responding process
+	Vector  VectorClock // Vector time of the responding process, which the joining process starts from
+	Error   string      // Reason the join was refused, empty if it was accepted
+}
+
+// LeaveMessage struct announces that the sender is leaving the cluster on purpose,
+// so peers remove it instead of treating its silence as a crash.
+type LeaveMessage struct {
+	ID int // ID of the departing process
+}
+
+// HandshakeMessage struct is sent by both ends of a connection right after dial and accept,
+// so each side learns the process ID and the protocol version of the other.
+type HandshakeMessage struct {
+	ID      int // ID of the process sending the handshake
+	Version int // ProtocolVersion of the sender, 0 for a binary from before versions were exchanged
+}
+
+// Protocol versions. ProtocolVersion must be raised whenever a change to UnicastMessage or its payloads
+// would make older processes misread the messages; MinProtocolVersion is the oldest version still understood.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// errIncompatibleVersion is returned for a connection whose other side speaks a protocol version this process does not understand.
+var errIncompatibleVersion = errors.New("incompatible protocol version")
+
+// checkVersion function returns an error wrapping errIncompatibleVersion unless a peer's protocol version
+// is between MinProtocolVersion and ProtocolVersion.
+func checkVersion(version int) error {
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return fmt.Errorf("%w %d, this process speaks version %d and understands versions %d to %d", errIncompatibleVersion, version, ProtocolVersion, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// newHandshake function builds the handshake a process sends on a new connection.
+func newHandshake(processID int) UnicastMessage {
+	return UnicastMessage{Kind: KindHandshake, SourceID: processID, Handshake: &HandshakeMessage{ID: processID, Version: ProtocolVersion}}
+}
+
+// ElectionMessage struct starts a Bully election at a process with a higher ID than the candidate.
+type ElectionMessage struct {
+	CandidateID int // ID of the process holding the election
+}
+
+// OkMessage struct tells the candidate that a process with a higher ID is alive and takes the election over.
+type OkMessage struct {
+	ResponderID int // ID of the answering process
+}
+
+// CoordinatorMessage struct announces the winner of a Bully election to every process.
+type CoordinatorMessage struct {
+	LeaderID int // ID of the new leader
+}
+
+// PingMessage struct is a probe measuring the round-trip time to a peer.
+type PingMessage struct {
+	Nonce  int       // Number of the ping, matches the pong to it
+	SentAt time.Time // When the ping was sent, by the clock of the sender
+}
+
+// LockRequestMessage struct asks every peer for permission to enter the critical section.
+// Requests are totally ordered by (Timestamp, SourceID of the message).
+type LockRequestMessage struct {
+	Timestamp int // Lamport timestamp of the request
+}
+
+// LockReplyMessage struct grants a lock request. It echoes the timestamp of the request, so a late reply to an
+// earlier request is not counted for the current one.
+type LockReplyMessage struct {
+	RequestTimestamp int // Timestamp of the request being granted
+}
+
+// TokenMessage struct is the token of the token ring. Only the process holding it may enter the critical section.
+type TokenMessage struct {
+	Generation int // Number of times the token was regenerated, a token of an older generation is stale
+}
+
+// PongMessage struct answers a ping, echoing it so the sender can compute the round-trip time on its own clock.
+// It also carries the answering process's wall time, so the sender can estimate the offset between their clocks.
+type PongMessage struct {
+	Nonce      int       // Nonce of the ping being answered
+	SentAt     time.Time // SentAt of the ping being answered
+	ReceivedAt time.Time // When the ping arrived, by the clock of the answering process
+	RepliedAt  time.Time // When the pong was sent, by the clock of the answering process
+}
+
+// LamportClock struct is a logical clock following Lamport's rules.
+// The counter is guarded by a mutex since sends and receives run in different goroutines.
+type LamportClock struct {
+	mu   sync.Mutex // Protects time
+	time int        // Current logical time of the process
+}
+
+// Tick function increments the clock for a local event (e.g. a send) and returns the new time.
+func (c *LamportClock) Tick() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.time++
+	return c.time
+}
+
+// Time function returns the current logical time without advancing it.
+func (c *LamportClock) Time() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.time
+}
+
+// Update function merges a received timestamp into the clock, setting it to max(local, received)+1,
+// and returns the new time.
+func (c *LamportClock) Update(received int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if received > c.time {
+		c.time = received
+	}
+	c.time++
+	return c.time
+}
+
+// VectorClock type is a vector timestamp with one entry per process, keyed by process ID.
+type VectorClock map[int]int
+
+// NewVectorClock function creates a vector clock with a zero entry for every configured process.
+func NewVectorClock(processes []Process) VectorClock {
+	vector := make(VectorClock, len(processes))
+	for _, process := range processes {
+		vector[process.ID] = 0
+	}
+	return vector
+}
+
+// Copy function returns an independent copy of the vector clock,
+// so a stamped message does not share its map with the process clock.
+func (v VectorClock) Copy() VectorClock {
+	vector := make(VectorClock, len(v))
+	for id, count := range v {
+		vector[id] = count
+	}
+	return vector
+}
+
+// Merge function sets every entry to the maximum of the local and the received entry.
+func (v VectorClock) Merge(other VectorClock) {
+	for id, count := range other {
+		if count > v[id] {
+			v[id] = count
+		}
+	}
+}
+
+// Deliverable function reports whether a message stamped with vector from sourceID can be delivered.
+// It must be the next message from the sender, and every message the sender had seen before sending it
+// must already be delivered locally.
+func (v VectorClock) Deliverable(vector VectorClock, sourceID int) bool {
+	for id, count := range vector {
+		if id == sourceID {
+			if count != v[id]+1 {
+				return false
+			}
+		} else if count > v[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// String function formats the vector clock ordered by process ID, e.g. [1:2 2:0 3:1].
+func (v VectorClock) String() string {
+	ids := make([]int, 0, len(v))
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	entries := make([]string, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, fmt.Sprintf("%d:%d", id, v[id]))
+	}
+	return "[" + strings.Join(entries, " ") + "]"
+}
+
+// CausalDelivery struct holds the vector clock of a process and the holdback queue of
+// messages that arrived before their causal dependencies.
+type CausalDelivery struct {
+	mu       sync.Mutex       // Protects clock and holdback
+	clock    VectorClock      // Vector clock of the process
+	holdback []UnicastMessage // Messages waiting for their dependencies
+}
+
+// NewCausalDelivery function creates the causal delivery state for a process, sized from the configuration.
+func NewCausalDelivery(config *Config) *CausalDelivery {
+	return &CausalDelivery{clock: NewVectorClock(config.Processes)}
+}
+
+// Stamp function increments the sender's own entry and returns a copy of the vector to attach to a message.
+func (c *CausalDelivery) Stamp(processID int) VectorClock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock[processID]++
+	return c.clock.Copy()
+}
+
+// Vector function returns a copy of the current vector clock.
+func (c *CausalDelivery) Vector() VectorClock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clock.Copy()
+}
+
+// Merge function merges the vector of a message delivered outside the holdback queue into the local clock.
+func (c *CausalDelivery) Merge(vector VectorClock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock.Merge(vector)
+}
+
+// Receive function adds a message to the holdback queue and delivers, in causal order,
+// every message whose dependencies are now satisfied.
+// deliver is called with the lock held so deliveries from different connections never interleave.
+func (c *CausalDelivery) Receive(msg UnicastMessage, deliver func(UnicastMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.holdback = append(c.holdback, msg)
+	// Keep scanning the queue until a full pass delivers nothing
+	for delivered := true; delivered; {
+		delivered = false
+		for i, pending := range c.holdback {
+			if c.clock.Deliverable(pending.Vector, pending.SourceID) {
+				// Merge the message's vector into the local clock and release it
+				c.clock.Merge(pending.Vector)
+				c.holdback = append(c.holdback[:i], c.holdback[i+1:]...)
+				deliver(pending)
+				delivered = true
+				break
+			}
+		}
+	}
+}
+
+// FIFODelivery struct releases the plain messages of every source in the order they were sent,
+// using the per-destination sequence numbers the sender assigns before the random delay.
+type FIFODelivery struct {
+	mu       sync.Mutex                     // Protects next and holdback
+	next     map[int]int                    // Next sequence number expected from each source
+	holdback map[int]map[int]UnicastMessage // Messages that arrived early, per source and sequence number
+}
+
+// NewFIFODelivery function creates an empty FIFO holdback queue.
+func NewFIFODelivery() *FIFODelivery {
+	return &FIFODelivery{next: make(map[int]int), holdback: make(map[int]map[int]UnicastMessage)}
+}
+
+// Receive function holds a message back until every earlier message of its source was released, then
+// releases it together with the held-back messages that follow it. Sequence numbers start at 1; a message
+// with a number that was already released is ignored.
+// If the message has to wait, the first range of missing sequence numbers is returned with missing set,
+// so the caller can ask the source to resend them. Every early message asks again, in case a resend was lost too.
+// deliver is called with the lock held so the messages of a source are released one at a time.
+func (f *FIFODelivery) Receive(msg UnicastMessage, deliver func(UnicastMessage)) (from int, to int, missing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	next := f.next[msg.SourceID]
+	if next == 0 {
+		next = 1
+	}
+	if msg.Seq < next {
+		return 0, 0, false
+	}
+	if f.holdback[msg.SourceID] == nil {
+		f.holdback[msg.SourceID] = make(map[int]UnicastMessage)
+	}
+	f.holdback[msg.SourceID][msg.Seq] = msg
+	// Release messages as long as the next one in line is there
+	for {
+		pending, ok := f.holdback[msg.SourceID][next]
+		if !ok {
+			break
+		}
+		delete(f.holdback[msg.SourceID], next)
+		next++
+		deliver(pending)
+	}
+	f.next[msg.SourceID] = next
+	if msg.Seq < next {
+		return 0, 0, false
+	}
+	// The message is held back: the gap runs from the next expected message to the first held-back one
+	to = msg.Seq - 1
+	for seq := range f.holdback[msg.SourceID] {
+		if seq-1 < to {
+			to = seq - 1
+		}
+	}
+	return next, to, true
+}
+
+// TraceEntry struct is one delivered plain message in a DeliveryTrace.
+type TraceEntry struct {
+	SourceID int         // Process that sent the message
+	Message  string      // Message text
+	Vector   VectorClock // Vector timestamp the message was sent with
+}
+
+// DeliveryTrace struct records the plain messages of a process in the order they were delivered,
+// so the causal order can be verified afterwards.
+type DeliveryTrace struct {
+	mu      sync.Mutex   // Protects entries
+	entries []TraceEntry // Delivered messages, oldest first
+}
+
+// NewDeliveryTrace function creates an empty trace.
+func NewDeliveryTrace() *DeliveryTrace {
+	return &DeliveryTrace{}
+}
+
+// Record function appends a delivered message to the trace.
+func (t *DeliveryTrace) Record(msg UnicastMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, TraceEntry{SourceID: msg.SourceID, Message: msg.Message, Vector: msg.Vector.Copy()})
+}
+
+// Entries function returns a copy of the trace.
+func (t *DeliveryTrace) Entries() []TraceEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEntry(nil), t.entries...)
+}
+
+// CausalViolation struct is a message delivered before one of its causal predecessors.
+type CausalViolation struct {
+	Position    int        // Index of the message in the trace
+	Entry       TraceEntry // The message delivered too early
+	DependsOnID int        // Process whose message was missing
+	Needed      int        // Messages from DependsOnID that had to be delivered before it
+	Delivered   int        // Messages from DependsOnID that were delivered before it
+}
+
+// String function describes the violation.
+func (c CausalViolation) String() string {
+	return fmt.Sprintf("delivery %d: message %q from process %d with vector time %s needed %d messages from process %d first, but %d were delivered",
+		c.Position+1, c.Entry.Message, c.Entry.SourceID, c.Entry.Vector, c.Needed, c.DependsOnID, c.Delivered)
+}
+
+// CheckCausalOrder function checks that every message in the trace of a process was delivered after its causal
+// predecessors, following the same rule as causal delivery: a message from S with vector V must be the V[S]-th
+// message delivered from S, and at least V[j] messages from every other process j must have been delivered before it.
+// The entry of the process itself is not checked, its own sends are not in the trace. It returns every violation.
+func CheckCausalOrder(processID int, trace []TraceEntry) []CausalViolation {
+	var violations []CausalViolation
+	delivered := make(map[int]int)
+	for position, entry := range trace {
+		ids := make([]int, 0, len(entry.Vector))
+		for id := range entry.Vector {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			if id == processID {
+				continue
+			}
+			needed := entry.Vector[id]
+			ok := delivered[id] >= needed
+			if id == entry.SourceID {
+				needed--
+				ok = delivered[id] == needed
+			}
+			if !ok {
+				violations = append(violations, CausalViolation{Position: position, Entry: entry, DependsOnID: id, Needed: needed, Delivered: delivered[id]})
+			}
+		}
+		delivered[entry.SourceID]++
+	}
+	return violations
+}
+
+// Sequencer struct hands out monotonically increasing global sequence numbers.
+type Sequencer struct {
+	mu  sync.Mutex // Protects seq
+	seq int        // Last sequence number assigned
+}
+
+// Next function returns the next global sequence number.
+func (s *Sequencer) Next() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return s.seq
+}
+
+// KVStore struct is the local replica of the key-value store shared by all processes.
+// It keeps the put that wrote each key, so a put older than the stored one is ignored (last writer wins).
+type KVStore struct {
+	mu   sync.Mutex            // Protects data
+	data map[string]PutMessage // Put that wrote the current value of every key
+}
+
+// NewKVStore function creates an empty replica.
+func NewKVStore() *KVStore {
+	return &KVStore{data: make(map[string]PutMessage)}
+}
+
+// Put function applies a put if the key is not set or the put is newer than the one that wrote it,
+// and reports whether it was applied.
+func (s *KVStore) Put(put PutMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.data[put.Key]; ok && !put.newer(current) {
+		return false
+	}
+	s.data[put.Key] = put
+	return true
+}
+
+// Get function returns the value of a key and whether it is set.
+func (s *KVStore) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	put, ok := s.data[key]
+	return put.Value, ok
+}
+
+// TotalOrderDelivery struct buffers sequenced messages and delivers them strictly in sequence order.
+type TotalOrderDelivery struct {
+	mu       sync.Mutex               // Protects next and holdback
+	next     int                      // Sequence number of the next message to deliver
+	holdback map[int]SequencedMessage // Messages that arrived ahead of their turn, keyed by sequence number
+}
+
+// NewTotalOrderDelivery function creates an empty holdback buffer expecting sequence number 1 first.
+func NewTotalOrderDelivery() *TotalOrderDelivery {
+	return &TotalOrderDelivery{next: 1, holdback: make(map[int]SequencedMessage)}
+}
+
+// Receive function buffers a sequenced message and delivers every message that is now next in line.
+// deliver is called with the lock held so deliveries happen one at a time and in order.
+func (t *TotalOrderDelivery) Receive(msg SequencedMessage, deliver func(SequencedMessage)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Ignore messages that were already delivered
+	if msg.Seq < t.next {
+		return
+	}
+	t.holdback[msg.Seq] = msg
+	for {
+		pending, ok := t.holdback[t.next]
+		if !ok {
+			return
+		}
+		delete(t.holdback, t.next)
+		t.next++
+		deliver(pending)
+	}
+}
+
+// ISISMessage struct is the payload of the three phases of the ISIS total order multicast.
+type ISISMessage struct {
+	ID         string // Unique ID of the multicast, "<originID>-<counter>"
+	OriginID   int    // Process that multicast the message
+	Message    string // Message text, only set in the first phase
+	Seq        int    // Proposed sequence number, or the agreed one in the last phase
+	ProposerID int    // Process that proposed Seq, breaks ties between equal sequence numbers
+}
+
+// before function reports whether the sequence number (seq, proposerID) comes before the one of other.
+func (m ISISMessage) before(other ISISMessage) bool {
+	return m.Seq < other.Seq || (m.Seq == other.Seq && m.ProposerID < other.ProposerID)
+}
+
+// isisEntry struct is a message in the ISIS holdback queue with its current sequence number.
+type isisEntry struct {
+	msg   ISISMessage // Message, with the proposed or agreed sequence number in Seq and ProposerID
+	final bool        // Whether the sequence number is the agreed one
+}
+
+// isisProposals struct collects the proposals for one of our own multicasts.
+type isisProposals struct {
+	destinations []int        // Processes the message was sent to
+	waiting      map[int]bool // Processes that have not proposed yet, including ourselves
+	best         ISISMessage  // Highest proposal so far
+}
+
+// ISISState struct implements the ISIS (Skeen) agreement for decentralized total order multicast. Every receiver
+// proposes a sequence number higher than any it has seen, the origin picks the highest proposal as the agreed one,
+// and messages are delivered in agreed order once the message at the front of the holdback queue is final.
+type ISISState struct {
+	mu        sync.Mutex                // Protects all fields
+	counter   int                       // Number of multicasts started by this process
+	proposed  int                       // Highest sequence number proposed by this process
+	agreed    int                       // Highest agreed sequence number seen
+	holdback  []*isisEntry              // Undelivered messages, ordered by sequence number
+	proposals map[string]*isisProposals // Proposals collected for our own multicasts, by message ID
+}
+
+// NewISISState function creates an empty ISIS state.
+func NewISISState() *ISISState {
+	return &ISISState{proposals: make(map[string]*isisProposals)}
+}
+
+// Start function creates a new multicast of a process and waits for proposals from the destinations and itself.
+func (s *ISISState) Start(processID int, message string, destinations []int) ISISMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counter++
+	msg := ISISMessage{ID: fmt.Sprintf("%d-%d", processID, s.counter), OriginID: processID, Message: message}
+	waiting := map[int]bool{processID: true}
+	for _, id := range destinations {
+		waiting[id] = true
+	}
+	s.proposals[msg.ID] = &isisProposals{destinations: destinations, waiting: waiting}
+	return msg
+}
+
+// Propose function puts a received message in the holdback queue with a new proposed sequence number
+// and returns the proposal to send back to its origin.
+func (s *ISISState) Propose(processID int, msg ISISMessage) ISISMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.agreed > s.proposed {
+		s.proposed = s.agreed
+	}
+	s.proposed++
+	msg.Seq = s.proposed
+	msg.ProposerID = processID
+	s.holdback = append(s.holdback, &isisEntry{msg: msg})
+	s.sort()
+	return ISISMessage{ID: msg.ID, OriginID: msg.OriginID, Seq: msg.Seq, ProposerID: processID}
+}
+
+// AddProposal function records a proposal for one of our own multicasts. Once every destination has proposed
+// it returns the agreed sequence number, the highest proposal, and the processes to multicast it to.
+func (s *ISISState) AddProposal(proposal ISISMessage) (agreed ISISMessage, destinations []int, done bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	collected, ok := s.proposals[proposal.ID]
+	if !ok || !collected.waiting[proposal.ProposerID] {
+		return ISISMessage{}, nil, false
+	}
+	delete(collected.waiting, proposal.ProposerID)
+	if collected.best.before(proposal) {
+		collected.best = proposal
+	}
+	if len(collected.waiting) > 0 {
+		return ISISMessage{}, nil, false
+	}
+	delete(s.proposals, proposal.ID)
+	return collected.best, collected.destinations, true
+}
+
+// Agree function applies the agreed sequence number of a message and delivers, in agreed order,
+// every message at the front of the holdback queue whose sequence number is final.
+// deliver is called with the lock held so deliveries happen one at a time and in order.
+func (s *ISISState) Agree(agreed ISISMessage, deliver func(ISISMessage)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if agreed.Seq > s.agreed {
+		s.agreed = agreed.Seq
+	}
+	for _, entry := range s.holdback {
+		if entry.msg.ID == agreed.ID {
+			entry.msg.Seq = agreed.Seq
+			entry.msg.ProposerID = agreed.ProposerID
+			entry.final = true
+		}
+	}
+	s.sort()
+	for len(s.holdback) > 0 && s.holdback[0].final {
+		entry := s.holdback[0]
+		s.holdback = s.holdback[1:]
+		deliver(entry.msg)
+	}
+}
+
+// sort function orders the holdback queue by sequence number. The caller holds the lock.
+func (s *ISISState) sort() {
+	sort.SliceStable(s.holdback, func(i, j int) bool { return s.holdback[i].msg.before(s.holdback[j].msg) })
+}
+
+// NakMessage struct asks a sender to resend the plain messages with sequence numbers From to To,
+// which the receiver detected as missing.
+type NakMessage struct {
+	SenderID int // Process that sent the missing messages
+	From     int // First missing sequence number
+	To       int // Last missing sequence number
+}
+
+// SendHistory struct keeps the most recent plain messages sent to each destination, keyed by sequence number,
+// so they can be resent when the destination reports a gap. It is bounded to SendHistorySize messages per destination.
+type SendHistory struct {
+	mu       sync.Mutex                     // Protects messages
+	size     int                            // Number of messages kept per destination
+	messages map[int]map[int]UnicastMessage // Sent messages, keyed by destination and sequence number
+}
+
+// NewSendHistory function creates an empty send history keeping size messages per destination.
+func NewSendHistory(size int) *SendHistory {
+	return &SendHistory{size: size, messages: make(map[int]map[int]UnicastMessage)}
+}
+
+// Add function records a numbered message sent to a destination and forgets the one that fell out of the bound.
+func (h *SendHistory) Add(destinationID int, msg UnicastMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.messages[destinationID] == nil {
+		h.messages[destinationID] = make(map[int]UnicastMessage)
+	}
+	h.messages[destinationID][msg.Seq] = msg
+	delete(h.messages[destinationID], msg.Seq-h.size)
+}
+
+// Get function returns the messages with sequence numbers from to to that are still in the history, in order.
+func (h *SendHistory) Get(destinationID int, from int, to int) []UnicastMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []UnicastMessage
+	for seq := from; seq <= to; seq++ {
+		if msg, ok := h.messages[destinationID][seq]; ok {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
+
+// Forget function drops the history of a destination.
+func (h *SendHistory) Forget(destinationID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.messages, destinationID)
+}
+
+// AckTracker struct assigns per-destination sequence numbers to plain messages and
+// keeps the messages that have not been acknowledged yet. With a window, it also limits how many
+// of them each destination may have outstanding.
+type AckTracker struct {
+	mu          sync.Mutex                      // Protects next, outstanding and freed
+	timeout     time.Duration                   // How long to wait for an ack before a message is due for resending
+	window      int                             // Most unacknowledged messages per destination, 0 for no limit
+	next        map[int]int                     // Last sequence number used for each destination
+	outstanding map[int]map[int]*pendingMessage // Unacknowledged messages, keyed by destination and sequence number
+	freed       chan struct{}                   // Closed and replaced whenever outstanding messages are removed
+	clock       Clock                           // Source of the ack deadlines
+}
+
+// pendingMessage struct is an unacknowledged message with its ack deadline.
+type pendingMessage struct {
+	msg      UnicastMessage // Message as it was sent, including its sequence number
+	deadline time.Time      // Time after which the message is resent
+	retries  int            // Number of times the message was resent
+}
+
+// NewAckTracker function creates an empty tracker using the given ack timeout, send window and clock.
+func NewAckTracker(timeout time.Duration, window int, clock Clock) *AckTracker {
+	return &AckTracker{timeout: timeout, window: window, next: make(map[int]int), outstanding: make(map[int]map[int]*pendingMessage), freed: make(chan struct{}), clock: clock}
+}
+
+// Track function stamps a message with the next sequence number for its destination,
+// records it as outstanding and returns the stamped copy. While the window to the destination is full,
+// it blocks until an ack, or a message given up on, makes room, or until done is closed.
+func (a *AckTracker) Track(destinationID int, msg UnicastMessage, done <-chan struct{}) UnicastMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+wait:
+	for a.window > 0 && len(a.outstanding[destinationID]) >= a.window {
+		freed := a.freed
+		a.mu.Unlock()
+		select {
+		case <-freed:
+			a.mu.Lock()
+		case <-done:
+			// The process is shutting down, the message will not be sent anyway
+			a.mu.Lock()
+			break wait
+		}
+	}
+	a.next[destinationID]++
+	msg.Seq = a.next[destinationID]
+	if a.outstanding[destinationID] == nil {
+		a.outstanding[destinationID] = make(map[int]*pendingMessage)
+	}
+	a.outstanding[destinationID][msg.Seq] = &pendingMessage{msg: msg, deadline: a.clock.Now().Add(a.timeout)}
+	return msg
+}
+
+// Number function stamps a message with the next sequence number for its destination without tracking it,
+// for messages that are never resent.
+func (a *AckTracker) Number(destinationID int, msg UnicastMessage) UnicastMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next[destinationID]++
+	msg.Seq = a.next[destinationID]
+	return msg
+}
+
+// Full function reports whether the window to a destination is full, so Track would block.
+func (a *AckTracker) Full(destinationID int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.window > 0 && len(a.outstanding[destinationID]) >= a.window
+}
+
+// LastSeq function returns the sequence number of the last message tracked for a destination, 0 if none.
+func (a *AckTracker) LastSeq(destinationID int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.next[destinationID]
+}
+
+// Ack function marks a message as acknowledged and reports whether it was still outstanding.
+func (a *AckTracker) Ack(destinationID int, seq int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.outstanding[destinationID][seq]; !ok {
+		return false
+	}
+	delete(a.outstanding[destinationID], seq)
+	a.release()
+	return true
+}
+
+// Forget function drops every outstanding message to a destination that left the cluster and returns them,
+// ordered by sequence number.
+func (a *AckTracker) Forget(destinationID int) []UnicastMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var dropped []UnicastMessage
+	for _, pending := range a.outstanding[destinationID] {
+		dropped = append(dropped, pending.msg)
+	}
+	sort.Slice(dropped, func(i, j int) bool { return dropped[i].Seq < dropped[j].Seq })
+	delete(a.outstanding, destinationID)
+	a.release()
+	return dropped
+}
+
+// release function wakes the senders waiting in Track for room in a window. The caller must hold a.mu.
+func (a *AckTracker) release() {
+	close(a.freed)
+	a.freed = make(chan struct{})
+}
+
+// Expired function returns the messages to a destination whose ack deadline has passed.
+// Messages that still have retries left are returned in resend with a new deadline; the others are
+// removed and returned in failed. Both slices are ordered by sequence number.
+func (a *AckTracker) Expired(destinationID int, now time.Time, maxRetries int) (resend []UnicastMessage, failed []UnicastMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seqs := make([]int, 0, len(a.outstanding[destinationID]))
+	for seq := range a.outstanding[destinationID] {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		pending := a.outstanding[destinationID][seq]
+		if now.Before(pending.deadline) {
+			continue
+		}
+		if pending.retries >= maxRetries {
+			delete(a.outstanding[destinationID], seq)
+			failed = append(failed, pending.msg)
+			continue
+		}
+		pending.retries++
+		pending.deadline = now.Add(a.timeout)
+		resend = append(resend, pending.msg)
+	}
+	if len(failed) > 0 {
+		a.release()
+	}
+	return resend, failed
+}
+
+// QuorumTracker struct counts the acks of quorum broadcasts. Every copy of a broadcast is a plain message with
+// its own sequence number per destination, so the tracker maps each (destination, sequence number) pair back to
+// its broadcast. A broadcast is committed once a majority of the cluster, the sender included, has it.
+type QuorumTracker struct {
+	mu         sync.Mutex               // Protects next, broadcasts and copies
+	next       int                      // Last broadcast ID used
+	broadcasts map[int]*quorumBroadcast // Broadcasts not committed yet, keyed by broadcast ID
+	copies     map[int]map[int]int      // Broadcast ID of each unacknowledged copy, keyed by destination and sequence number
+}
+
+// quorumBroadcast struct is a quorum broadcast waiting for acks.
+type quorumBroadcast struct {
+	message   string        // Text of the broadcast
+	acked     int           // Processes that have the message, including the sender
+	needed    int           // Acks needed for a majority
+	total     int           // Processes in the cluster when the broadcast was sent
+	committed chan struct{} // Closed when the broadcast is committed
+}
+
+// NewQuorumTracker function creates an empty quorum tracker.
+func NewQuorumTracker() *QuorumTracker {
+	return &QuorumTracker{broadcasts: make(map[int]*quorumBroadcast), copies: make(map[int]map[int]int)}
+}
+
+// Start function registers a new broadcast in a cluster of total processes and returns its ID and a channel
+// closed when it is committed. The sender counts as the first ack, so a single process commits at once.
+func (q *QuorumTracker) Start(message string, total int) (int, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next++
+	b := &quorumBroadcast{message: message, acked: 1, needed: total/2 + 1, total: total, committed: make(chan struct{})}
+	if b.acked >= b.needed {
+		close(b.committed)
+	} else {
+		q.broadcasts[q.next] = b
+	}
+	return q.next, b.committed
+}
+
+// AddCopy function records the sequence number of the copy of a broadcast sent to a destination.
+func (q *QuorumTracker) AddCopy(broadcastID int, destinationID int, seq int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.broadcasts[broadcastID]; !ok {
+		return
+	}
+	if q.copies[destinationID] == nil {
+		q.copies[destinationID] = make(map[int]int)
+	}
+	q.copies[destinationID][seq] = broadcastID
+}
+
+// Ack function counts the ack of a copy and reports whether it committed its broadcast, returning the
+// message and how many of the processes had acked it. Acks of other messages and repeated acks are ignored.
+func (q *QuorumTracker) Ack(destinationID int, seq int) (message string, acked int, total int, committed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	broadcastID, ok := q.copies[destinationID][seq]
+	if !ok {
+		return "", 0, 0, false
+	}
+	delete(q.copies[destinationID], seq)
+	b, ok := q.broadcasts[broadcastID]
+	if !ok {
+		// The broadcast was committed already, this is a late ack
+		return "", 0, 0, false
+	}
+	b.acked++
+	if b.acked < b.needed {
+		return "", 0, 0, false
+	}
+	delete(q.broadcasts, broadcastID)
+	close(b.committed)
+	return b.message, b.acked, b.total, true
+}
+
+// Forget function drops the copies sent to a destination that left the cluster or whose copy was given up on.
+func (q *QuorumTracker) Forget(destinationID int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.copies, destinationID)
+}
+
+// ArrivalOrder struct remembers the largest Lamport timestamp that arrived from each source, to notice
+// messages arriving out of their Lamport order. It only observes, the ordering protocols restore the order.
+type ArrivalOrder struct {
+	mu   sync.Mutex  // Protects last
+	last map[int]int // Largest timestamp received from each source
+}
+
+// NewArrivalOrder function creates an empty arrival order.
+func NewArrivalOrder() *ArrivalOrder {
+	return &ArrivalOrder{last: make(map[int]int)}
+}
+
+// Observe function records a timestamp from a source and reports whether it is smaller than one that arrived
+// before it, along with that largest earlier timestamp.
+func (a *ArrivalOrder) Observe(sourceID int, timestamp int) (outOfOrder bool, last int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last = a.last[sourceID]
+	if timestamp < last {
+		return true, last
+	}
+	a.last[sourceID] = timestamp
+	return false, last
+}
+
+// MessageTracker struct holds everything a process remembers about the messages it already received, so copies
+// are dropped: the sequence numbers of plain messages, the nonces of every write and the IDs of gossip messages.
+// Each connection has its own receive goroutine, so all of it is guarded by one mutex.
+//
+// Sequence numbers are kept in a sliding window of the most recent seqWindow per source, anything older than
+// the window is treated as already seen. Nonces are kept for the last nonceWindow messages per source, a replay
+// of an older message is not recognized. Gossip IDs are kept for good.
+type MessageTracker struct {
+	mu          sync.Mutex              // Protects every field below
+	seqWindow   int                     // Number of sequence numbers remembered per source
+	highest     map[int]int             // Highest sequence number seen from each source
+	seqs        map[int]map[int]bool    // Sequence numbers seen inside the window, keyed by source
+	nonceWindow int                     // Number of nonces remembered per source
+	nonces      map[int]map[uint64]bool // Nonces remembered for each source
+	nonceOrder  map[int][]uint64        // Nonces of each source in arrival order, the oldest is forgotten first
+	gossip      map[string]bool         // IDs of gossip messages already delivered and forwarded
+}
+
+// NewMessageTracker function creates a tracker remembering the last seqWindow sequence numbers and the last
+// nonceWindow nonces per source.
+func NewMessageTracker(seqWindow int, nonceWindow int) *MessageTracker {
+	return &MessageTracker{
+		seqWindow:   seqWindow,
+		highest:     make(map[int]int),
+		seqs:        make(map[int]map[int]bool),
+		nonceWindow: nonceWindow,
+		nonces:      make(map[int]map[uint64]bool),
+		nonceOrder:  make(map[int][]uint64),
+		gossip:      make(map[string]bool),
+	}
+}
+
+// MarkSeen function records the sequence number of a plain message from a source and reports whether it is new.
+func (t *MessageTracker) MarkSeen(sourceID int, seq int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Sequence numbers that fell out of the window were delivered long ago
+	if seq <= t.highest[sourceID]-t.seqWindow {
+		return false
+	}
+	if t.seqs[sourceID] == nil {
+		t.seqs[sourceID] = make(map[int]bool)
+	}
+	if t.seqs[sourceID][seq] {
+		return false
+	}
+	t.seqs[sourceID][seq] = true
+	// Slide the window forward and forget what fell out of it
+	if seq > t.highest[sourceID] {
+		t.highest[sourceID] = seq
+		for old := range t.seqs[sourceID] {
+			if old <= seq-t.seqWindow {
+				delete(t.seqs[sourceID], old)
+			}
+		}
+	}
+	return true
+}
+
+// MarkNonce function records the nonce of a message from a source and reports whether it is new.
+func (t *MessageTracker) MarkNonce(sourceID int, nonce uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nonces[sourceID] == nil {
+		t.nonces[sourceID] = make(map[uint64]bool)
+	}
+	if t.nonces[sourceID][nonce] {
+		return false
+	}
+	t.nonces[sourceID][nonce] = true
+	t.nonceOrder[sourceID] = append(t.nonceOrder[sourceID], nonce)
+	if len(t.nonceOrder[sourceID]) > t.nonceWindow {
+		delete(t.nonces[sourceID], t.nonceOrder[sourceID][0])
+		t.nonceOrder[sourceID] = t.nonceOrder[sourceID][1:]
+	}
+	return true
+}
+
+// MarkGossip function records a gossip message ID and reports whether it is new.
+func (t *MessageTracker) MarkGossip(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gossip[id] {
+		return false
+	}
+	t.gossip[id] = true
+	return true
+}
+
+// newNonce function returns a random, non-zero nonce for a message about to be written.
+func newNonce() uint64 {
+	var b [8]byte
+	for {
+		cryptorand.Read(b[:])
+		if nonce := binary.LittleEndian.Uint64(b[:]); nonce != 0 {
+			return nonce
+		}
+	}
+}
+
+// PeerStatus type is the failure detector's view of a peer.
+type PeerStatus string
+
+const (
+	StatusAlive     PeerStatus = "ALIVE"     // Heartbeats arrive on time
+	StatusSuspected PeerStatus = "SUSPECTED" // SuspectAfterMissed heartbeat intervals passed without a heartbeat
+	StatusFailed    PeerStatus = "FAILED"    // FailAfterMissed heartbeat intervals passed without a heartbeat
+)
+
+// Number of missed heartbeat intervals after which a peer is suspected, then considered failed.
+const (
+	SuspectAfterMissed = 3
+	FailAfterMissed    = 6
+)
+
+// FailureDetector struct tracks the last heartbeat received from every peer and derives its status.
+type FailureDetector struct {
+	mu       sync.Mutex         // Protects lastSeen and status
+	interval time.Duration      // Expected interval between heartbeats
+	lastSeen map[int]time.Time  // Time of the last heartbeat from each peer
+	status   map[int]PeerStatus // Current status of each peer
+}
+
+// NewFailureDetector function creates a detector for the given peers, all considered alive as of now.
+func NewFailureDetector(peerIDs []int, interval time.Duration, now time.Time) *FailureDetector {
+	detector := &FailureDetector{interval: interval, lastSeen: make(map[int]time.Time), status: make(map[int]PeerStatus)}
+	for _, id := range peerIDs {
+		detector.lastSeen[id] = now
+		detector.status[id] = StatusAlive
+	}
+	return detector
+}
+
+// Add function starts watching a peer that joined at runtime, considering it alive as of now.
+func (f *FailureDetector) Add(peerID int, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.lastSeen[peerID]; ok {
+		return
+	}
+	f.lastSeen[peerID] = now
+	f.status[peerID] = StatusAlive
+}
+
+// Remove function stops watching a peer that left the cluster.
+func (f *FailureDetector) Remove(peerID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.lastSeen, peerID)
+	delete(f.status, peerID)
+}
+
+// Reset function considers every peer alive as of now. It is called when heartbeating starts,
+// so the time spent connecting at startup does not count as missed heartbeats.
+func (f *FailureDetector) Reset(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id := range f.lastSeen {
+		f.lastSeen[id] = now
+		f.status[id] = StatusAlive
+	}
+}
+
+// Heartbeat function records a heartbeat from a peer, which makes it alive again.
+// It returns the previous status so callers can report recoveries.
+// Heartbeats from peers that are not watched, such as one that just left, are ignored.
+func (f *FailureDetector) Heartbeat(peerID int, now time.Time) PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, ok := f.status[peerID]
+	if !ok {
+		return StatusAlive
+	}
+	f.lastSeen[peerID] = now
+	f.status[peerID] = StatusAlive
+	return previous
+}
+
+// Check function updates the status of every peer from the time since its last heartbeat
+// and returns the peers whose status changed, with their new status.
+func (f *FailureDetector) Check(now time.Time) map[int]PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed := make(map[int]PeerStatus)
+	for id, last := range f.lastSeen {
+		status := StatusAlive
+		if silence := now.Sub(last); silence >= FailAfterMissed*f.interval {
+			status = StatusFailed
+		} else if silence >= SuspectAfterMissed*f.interval {
+			status = StatusSuspected
+		}
+		if status != f.status[id] {
+			f.status[id] = status
+			changed[id] = status
+		}
+	}
+	return changed
+}
+
+// Members function returns a copy of the current status of every peer.
+func (f *FailureDetector) Members() map[int]PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	members := make(map[int]PeerStatus, len(f.status))
+	for id, status := range f.status {
+		members[id] = status
+	}
+	return members
+}
+
+// GossipState struct numbers the gossip messages a process starts. The ones it has already seen are
+// remembered by its MessageTracker.
+type GossipState struct {
+	mu      sync.Mutex // Protects counter
+	counter int        // Number of gossip messages started by this process
+}
+
+// NewGossipState function creates an empty gossip state.
+func NewGossipState() *GossipState {
+	return &GossipState{}
+}
+
+// NextID function returns a new unique gossip message ID for a process.
+func (g *GossipState) NextID(processID int) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.counter++
+	return fmt.Sprintf("%d-%d", processID, g.counter)
+}
+
+// MarkerMessage struct is the marker of the Chandy-Lamport snapshot algorithm, closing the channel it arrives on.
+// Markers are sent right away while plain messages wait for their random delay, so a marker can overtake
+// messages sent before it. LastSeq tells the receiver how many plain messages to wait for before the channel is closed.
+type MarkerMessage struct {
+	SnapshotID string // Unique ID of the snapshot, "<initiator>-<counter>"
+	LastSeq    int    // Sequence number of the last plain message sent on the channel before the marker
+}
+
+// Snapshot struct is the part of a global snapshot recorded by one process: its local state and the
+// plain messages that were in flight on each of its incoming channels.
+type Snapshot struct {
+	ID          string           `json:"id"`           // ID of the snapshot
+	ProcessID   int              `json:"process_id"`   // Process that recorded this part
+	LogicalTime int              `json:"logical_time"` // Lamport time when the local state was recorded
+	VectorTime  VectorClock      `json:"vector_time"`  // Vector time when the local state was recorded
+	Sent        map[int]int      `json:"sent"`         // Plain messages sent to each peer before the local state was recorded
+	Received    map[int]int      `json:"received"`     // Plain messages received in order from each peer before the local state was recorded
+	Channels    map[int][]string `json:"channels"`     // Messages in flight on the channel from each peer
+
+	open map[int]int // Channels still being recorded, with the LastSeq of their marker or -1 until it arrives
+}
+
+// SnapshotState struct holds the snapshots a process is recording and counts the plain messages
+// received from each peer, so the local state and the channel recordings agree on every message.
+type SnapshotState struct {
+	mu       sync.Mutex           // Protects every field
+	counter  int                  // Number of snapshots started by this process
+	received map[int]int          // Plain messages received in order from each peer so far
+	active   map[string]*Snapshot // Snapshots whose channels are still being recorded
+	done     map[string]bool      // IDs of the snapshots already completed
+}
+
+// NewSnapshotState function creates an empty snapshot state.
+func NewSnapshotState() *SnapshotState {
+	return &SnapshotState{received: make(map[int]int), active: make(map[string]*Snapshot), done: make(map[string]bool)}
+}
+
+// NextID function returns a new unique snapshot ID for a process.
+func (s *SnapshotState) NextID(processID int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counter++
+	return fmt.Sprintf("%d-%d", processID, s.counter)
+}
+
+// Record function records the local state of a process for a snapshot and starts recording the channels
+// from peers. It reports false if the snapshot was already recorded. A snapshot that is complete right away,
+// because there are no peers, is returned as completed.
+func (s *SnapshotState) Record(snapshot *Snapshot, peers []int) (recorded bool, completed *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done[snapshot.ID] || s.active[snapshot.ID] != nil {
+		return false, nil
+	}
+	snapshot.Received = make(map[int]int)
+	snapshot.Channels = make(map[int][]string)
+	snapshot.open = make(map[int]int)
+	for _, peerID := range peers {
+		snapshot.Received[peerID] = s.received[peerID]
+		snapshot.Channels[peerID] = []string{}
+		snapshot.open[peerID] = -1
+	}
+	s.active[snapshot.ID] = snapshot
+	return true, s.complete(snapshot)
+}
+
+// Receive function counts a plain message released in send order and records it on every open channel
+// it belongs to. It returns the snapshots completed by the message.
+func (s *SnapshotState) Receive(msg UnicastMessage) []*Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[msg.SourceID] = msg.Seq
+	var completed []*Snapshot
+	for _, snapshot := range s.active {
+		lastSeq, open := snapshot.open[msg.SourceID]
+		if !open || msg.Seq <= snapshot.Received[msg.SourceID] {
+			continue
+		}
+		if lastSeq == -1 || msg.Seq <= lastSeq {
+			snapshot.Channels[msg.SourceID] = append(snapshot.Channels[msg.SourceID], msg.Message)
+		}
+		if done := s.complete(snapshot); done != nil {
+			completed = append(completed, done)
+		}
+	}
+	return completed
+}
+
+// Marker function handles the marker of a recorded snapshot arriving from a peer. The channel is closed
+// once every plain message the peer sent before the marker was received. It returns the snapshot if this completed it.
+func (s *SnapshotState) Marker(peerID int, marker MarkerMessage) *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := s.active[marker.SnapshotID]
+	if snapshot == nil {
+		return nil
+	}
+	if _, open := snapshot.open[peerID]; open {
+		snapshot.open[peerID] = marker.LastSeq
+	}
+	return s.complete(snapshot)
+}
+
+// complete function closes the channels of a snapshot that received their marker and every message before it.
+// When no channel is left open the snapshot is finished and returned. The caller holds the lock.
+func (s *SnapshotState) complete(snapshot *Snapshot) *Snapshot {
+	for peerID, lastSeq := range snapshot.open {
+		if lastSeq != -1 && s.received[peerID] >= lastSeq {
+			delete(snapshot.open, peerID)
+		}
+	}
+	if len(snapshot.open) > 0 {
+		return nil
+	}
+	delete(s.active, snapshot.ID)
+	s.done[snapshot.ID] = true
+	return snapshot
+}
+
+// PingTracker struct numbers the pings of a process and remembers the ones still waiting for their pong.
+type PingTracker struct {
+	mu          sync.Mutex        // Protects next and outstanding
+	next        int               // Last nonce used
+	outstanding map[int]pingProbe // Each unanswered ping, keyed by nonce
+}
+
+// pingProbe struct is an unanswered ping.
+type pingProbe struct {
+	peerID int  // Peer the ping was sent to
+	drift  bool // Whether the ping estimates the clock offset rather than only the round-trip time
+}
+
+// NewPingTracker function creates a tracker without pings.
+func NewPingTracker() *PingTracker {
+	return &PingTracker{outstanding: make(map[int]pingProbe)}
+}
+
+// Start function records a ping to a peer and returns its nonce. drift marks a ping sent by the drift command.
+func (t *PingTracker) Start(peerID int, drift bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	t.outstanding[t.next] = pingProbe{peerID: peerID, drift: drift}
+	return t.next
+}
+
+// Finish function matches a pong from a peer to its ping and forgets the ping, reporting whether it was a drift
+// ping. It reports false for a pong that answers no outstanding ping of that peer, such as a duplicate.
+func (t *PingTracker) Finish(peerID int, nonce int) (bool, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	probe, ok := t.outstanding[nonce]
+	if !ok || probe.peerID != peerID {
+		return false, false
+	}
+	delete(t.outstanding, nonce)
+	return probe.drift, true
+}
+
+// Cancel function forgets a ping that could not be sent.
+func (t *PingTracker) Cancel(nonce int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.outstanding, nonce)
+}
+
+// ElectionState struct holds the leader known to a process and the state of the election it is holding.
+type ElectionState struct {
+	mu       sync.Mutex // Protects every field
+	leader   int        // ID of the current leader, UnknownPeer until one is elected
+	running  bool       // Whether the process is holding an election
+	answered bool       // Whether a higher process answered the running election
+	round    int        // Number of coordinator announcements seen, to notice one during an election
+}
+
+// NewElectionState function creates an election state without a leader.
+func NewElectionState() *ElectionState {
+	return &ElectionState{leader: UnknownPeer}
+}
+
+// Start function starts an election and returns the current round. It reports false if an election is already running.
+func (e *ElectionState) Start() (round int, started bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running {
+		return 0, false
+	}
+	e.running = true
+	e.answered = false
+	return e.round, true
+}
+
+// Finish function ends the running election.
+func (e *ElectionState) Finish() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.running = false
+}
+
+// Answer function records an OK from a higher process.
+func (e *ElectionState) Answer() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.answered = true
+}
+
+// Answered function reports whether a higher process answered the running election.
+func (e *ElectionState) Answered() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.answered
+}
+
+// SetLeader function records the winner of an election.
+func (e *ElectionState) SetLeader(leaderID int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader = leaderID
+	e.round++
+}
+
+// Leader function returns the current leader and the number of announcements seen so far.
+func (e *ElectionState) Leader() (leaderID int, round int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader, e.round
+}
+
+// Lock states of a process in the Ricart-Agrawala algorithm.
+const (
+	LockReleased = "RELEASED" // Neither holding nor wanting the lock
+	LockWanted   = "WANTED"   // Waiting for the replies to its request
+	LockHeld     = "HELD"     // In the critical section
+)
+
+// MutexState struct holds the Ricart-Agrawala state of a process: its own request, the replies it still waits
+// for and the requests it deferred until it releases the lock.
+type MutexState struct {
+	mu        sync.Mutex   // Protects every field
+	state     string       // LockReleased, LockWanted or LockHeld
+	timestamp int          // Lamport timestamp of the current request
+	waiting   map[int]bool // Peers whose reply to the current request has not arrived yet
+	deferred  map[int]int  // Timestamps of the requests answered on release, keyed by peer
+}
+
+// NewMutexState function creates a released lock.
+func NewMutexState() *MutexState {
+	return &MutexState{state: LockReleased, waiting: make(map[int]bool), deferred: make(map[int]int)}
+}
+
+// Request function records a new request with the given timestamp, sent to peerIDs. It reports whether the
+// lock is held right away, which happens when there are no peers to ask.
+func (m *MutexState) Request(timestamp int, peerIDs []int) (held bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != LockReleased {
+		return false, fmt.Errorf("the lock is already %s", m.state)
+	}
+	m.timestamp = timestamp
+	m.waiting = make(map[int]bool)
+	for _, peerID := range peerIDs {
+		m.waiting[peerID] = true
+	}
+	m.state = LockWanted
+	if len(m.waiting) == 0 {
+		m.state = LockHeld
+	}
+	return m.state == LockHeld, nil
+}
+
+// Cancel function withdraws the current request from a peer it could not be sent to.
+// It reports whether the lock is now held.
+func (m *MutexState) Cancel(peerID int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.granted(peerID)
+}
+
+// Reply function records a peer's reply to the request with the given timestamp. It reports whether this was
+// the last missing reply, so the process now holds the lock.
+func (m *MutexState) Reply(peerID int, requestTimestamp int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if requestTimestamp != m.timestamp {
+		return false
+	}
+	return m.granted(peerID)
+}
+
+// granted function stops waiting for a peer and enters the critical section once no peer is left.
+// The caller holds m.mu.
+func (m *MutexState) granted(peerID int) bool {
+	if m.state != LockWanted || !m.waiting[peerID] {
+		return false
+	}
+	delete(m.waiting, peerID)
+	if len(m.waiting) > 0 {
+		return false
+	}
+	m.state = LockHeld
+	return true
+}
+
+// Receive function decides on a peer's request. The reply is deferred while the process holds the lock, or
+// while it wants it and its own request comes first by (timestamp, process ID); otherwise it is sent right away.
+// It reports whether to reply now.
+func (m *MutexState) Receive(selfID int, peerID int, timestamp int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	outranks := m.timestamp < timestamp || (m.timestamp == timestamp && selfID < peerID)
+	if m.state == LockHeld || (m.state == LockWanted && outranks) {
+		m.deferred[peerID] = timestamp
+		return false
+	}
+	return true
+}
+
+// Release function leaves the critical section and returns the deferred requests that must be answered now,
+// as their timestamps keyed by peer.
+func (m *MutexState) Release() (map[int]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != LockHeld {
+		return nil, fmt.Errorf("the lock is not held, it is %s", m.state)
+	}
+	m.state = LockReleased
+	deferred := m.deferred
+	m.deferred = make(map[int]int)
+	return deferred, nil
+}
+
+// TokenRing struct holds the token ring state of a process: whether it has the token, whether it wants or
+// holds the lock, and where it sent the token last, so it can regenerate the token if that process fails.
+type TokenRing struct {
+	mu         sync.Mutex // Protects every field
+	state      string     // LockReleased, LockWanted or LockHeld
+	hasToken   bool       // Whether the process holds the token
+	generation int        // Newest token generation seen
+	passedTo   int        // Process the token was last passed to, UnknownPeer if the token has not left since
+}
+
+// NewTokenRing function creates a ring state without the token.
+func NewTokenRing() *TokenRing {
+	return &TokenRing{state: LockReleased, passedTo: UnknownPeer}
+}
+
+// Request function asks for the lock. It reports whether the lock is held right away, because the process
+// has the token; otherwise the lock is taken when the token arrives.
+func (r *TokenRing) Request() (held bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != LockReleased {
+		return false, fmt.Errorf("the lock is already %s", r.state)
+	}
+	r.state = LockWanted
+	if r.hasToken {
+		r.state = LockHeld
+	}
+	return r.state == LockHeld, nil
+}
+
+// Release function gives the lock up. The caller passes the token on.
+func (r *TokenRing) Release() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != LockHeld {
+		return fmt.Errorf("the lock is not held, it is %s", r.state)
+	}
+	r.state = LockReleased
+	return nil
+}
+
+// Receive function takes the token. It reports whether the token was accepted, false for a stale one,
+// and whether the process now holds the lock because it was waiting for it.
+func (r *TokenRing) Receive(token TokenMessage) (accepted bool, entered bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token.Generation < r.generation {
+		return false, false
+	}
+	if r.hasToken {
+		// Two tokens met, keep the one already held as the newer generation
+		r.generation = token.Generation
+		return false, false
+	}
+	r.generation = token.Generation
+	r.hasToken = true
+	r.passedTo = UnknownPeer
+	if r.state == LockWanted {
+		r.state = LockHeld
+		return true, true
+	}
+	return true, false
+}
+
+// Pass function hands the token to the next process. It reports false if the process does not have the
+// token or holds the lock, since the token stays until the lock is released.
+func (r *TokenRing) Pass(nextID int) (TokenMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.hasToken || r.state == LockHeld {
+		return TokenMessage{}, false
+	}
+	r.hasToken = false
+	r.passedTo = nextID
+	return TokenMessage{Generation: r.generation}, true
+}
+
+// Regenerate function creates a new token of the next generation if the token was last passed to the failed
+// process and has not come back since. A token still circulating then becomes stale.
+func (r *TokenRing) Regenerate(failedID int) (TokenMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hasToken || r.passedTo != failedID {
+		return TokenMessage{}, false
+	}
+	r.passedTo = UnknownPeer
+	return TokenMessage{Generation: r.generation + 1}, true
+}
+
+// Drop function loses the token and any lock request, as a crash does.
+func (r *TokenRing) Drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hasToken = false
+	r.state = LockReleased
+	r.passedTo = UnknownPeer
+}
+
+// Stats struct counts the traffic exchanged with one peer.
+type Stats struct {
+	Sent          int       // Messages sent to the peer
+	Received      int       // Messages received from the peer
+	BytesSent     int       // Approximate size of the messages sent
+	BytesReceived int       // Approximate size of the messages received
+	Dropped       int       // Messages to or from the peer that were lost on purpose, by the drop rate or a block
+	Expired       int       // Messages from the peer that arrived after their deadline and were not delivered
+	LastActivity  time.Time // Time of the last message sent or received
+}
+
+// TrafficStats struct holds the Stats of every peer a process exchanged messages with,
+// and a histogram of the random delays of the messages it sent.
+type TrafficStats struct {
+	mu     sync.Mutex     // Protects peers and delays
+	peers  map[int]*Stats // Stats per peer ID
+	delays DelayHistogram // Delays of the sent messages
+	clock  Clock          // Source of the LastActivity times
+}
+
+// DelayBuckets are the upper bounds, in seconds, of the buckets of the send delay histogram.
+var DelayBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// DelayHistogram struct counts send delays by DelayBuckets, like a Prometheus histogram.
+type DelayHistogram struct {
+	Counts []int   // Number of delays up to each bucket bound, cumulative
+	Sum    float64 // Sum of all delays in seconds
+	Count  int     // Number of delays
+}
+
+// NewTrafficStats function creates empty traffic statistics, timing the activity with the given clock.
+func NewTrafficStats(clock Clock) *TrafficStats {
+	return &TrafficStats{peers: make(map[int]*Stats), delays: DelayHistogram{Counts: make([]int, len(DelayBuckets))}, clock: clock}
+}
+
+// peer function returns the Stats of a peer, creating them on first use. The caller holds the lock.
+func (t *TrafficStats) peer(peerID int) *Stats {
+	stats, ok := t.peers[peerID]
+	if !ok {
+		stats = &Stats{}
+		t.peers[peerID] = stats
+	}
+	return stats
+}
+
+// RecordSent function counts a message sent to a peer.
+func (t *TrafficStats) RecordSent(peerID int, msg UnicastMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.peer(peerID)
+	stats.Sent++
+	stats.BytesSent += messageSize(msg)
+	stats.LastActivity = t.clock.Now()
+}
+
+// RecordReceived function counts a message received from a peer.
+func (t *TrafficStats) RecordReceived(peerID int, msg UnicastMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.peer(peerID)
+	stats.Received++
+	stats.BytesReceived += messageSize(msg)
+	stats.LastActivity = t.clock.Now()
+}
+
+// RecordDropped function counts a message to or from a peer that was dropped.
+func (t *TrafficStats) RecordDropped(peerID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peer(peerID).Dropped++
+}
+
+// RecordExpired function counts a message from a peer that was dropped because its deadline had passed.
+func (t *TrafficStats) RecordExpired(peerID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peer(peerID).Expired++
+}
+
+// RecordDelay function adds the delay of a sent message to the histogram.
+func (t *TrafficStats) RecordDelay(delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seconds := delay.Seconds()
+	for i, bound := range DelayBuckets {
+		if seconds <= bound {
+			t.delays.Counts[i]++
+		}
+	}
+	t.delays.Sum += seconds
+	t.delays.Count++
+}
+
+// Delays function returns a copy of the send delay histogram.
+func (t *TrafficStats) Delays() DelayHistogram {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delays := t.delays
+	delays.Counts = append([]int(nil), t.delays.Counts...)
+	return delays
+}
+
+// Snapshot function returns a copy of the Stats of every peer.
+func (t *TrafficStats) Snapshot() map[int]Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[int]Stats, len(t.peers))
+	for id, stats := range t.peers {
+		snapshot[id] = *stats
+	}
+	return snapshot
+}
+
+// messageSize function estimates the encoded size of a message in bytes: a fixed overhead for the header
+// fields plus the text it carries and its vector clock. The real size depends on the codec.
+func messageSize(msg UnicastMessage) int {
+	size := 32 + len(msg.Message) + 16*len(msg.Vector)
+	if msg.Sequenced != nil {
+		size += len(msg.Sequenced.Message)
+	}
+	if msg.Gossip != nil {
+		size += len(msg.Gossip.ID) + len(msg.Gossip.Message)
+	}
+	if msg.Members != nil {
+		size += 32 * len(msg.Members.Members)
+	}
+	return size
+}
+
+// RateLimiter struct is a token bucket per peer holding a single token, which refills at the configured rate.
+// Messages to a peer are therefore spaced at least 1/rate apart, and a message finding the bucket empty waits
+// for its turn.
+type RateLimiter struct {
+	mu       sync.Mutex        // Protects next
+	interval time.Duration     // Time for the bucket to refill, 0 means no limit
+	next     map[int]time.Time // When the bucket of each peer holds a token again
+}
+
+// NewRateLimiter function creates a limiter allowing rate messages per second to each peer, 0 for no limit.
+func NewRateLimiter(rate float64) *RateLimiter {
+	limiter := &RateLimiter{next: make(map[int]time.Time)}
+	if rate > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return limiter
+}
+
+// Reserve function takes the next token for a peer for a message that may leave at earliest, and returns when
+// it may be sent. Tokens are handed out in call order, so the messages to a peer also leave in call order.
+func (l *RateLimiter) Reserve(peerID int, earliest time.Time) time.Time {
+	if l.interval == 0 {
+		return earliest
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	at := l.next[peerID]
+	if at.Before(earliest) {
+		at = earliest
+	}
+	l.next[peerID] = at.Add(l.interval)
+	return at
+}
+
+// scheduledSend struct is a delayed message waiting in a DelayQueue.
+type scheduledSend struct {
+	at    time.Time // When the message is due
+	order int       // Position in which the message was scheduled
+	send  func()    // Sends the message
+}
+
+// scheduledQueue type is a heap of scheduled sends: earliest fire time first, and in scheduling order among
+// sends due at the same time. It implements heap.Interface.
+type scheduledQueue []scheduledSend
+
+// Len function returns the number of scheduled sends.
+func (q scheduledQueue) Len() int { return len(q) }
+
+// Less function reports whether send i is due before send j.
+func (q scheduledQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].order < q[j].order
+}
+
+// Swap function swaps two sends, for the heap package.
+func (q scheduledQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+// Push function appends a send, for the heap package.
+func (q *scheduledQueue) Push(x interface{}) { *q = append(*q, x.(scheduledSend)) }
+
+// Pop function removes the last send, for the heap package.
+func (q *scheduledQueue) Pop() interface{} {
+	old := *q
+	out := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return out
+}
+
+// DelayQueue struct holds the delayed messages of the queued delay mode until dispatchLoop sends them, one at a
+// time in fire time order, so the order in which delayed messages leave depends only on their delays.
+type DelayQueue struct {
+	mu        sync.Mutex     // Protects sends and scheduled
+	sends     scheduledQueue // Messages waiting for their fire time
+	scheduled int            // Number of sends scheduled so far
+	wake      chan struct{}  // Signals dispatchLoop that a send was scheduled
+}
+
+// NewDelayQueue function creates an empty queue.
+func NewDelayQueue() *DelayQueue {
+	return &DelayQueue{wake: make(chan struct{}, 1)}
+}
+
+// Schedule function adds a send that is due at the given time.
+func (q *DelayQueue) Schedule(at time.Time, send func()) {
+	q.mu.Lock()
+	q.scheduled++
+	heap.Push(&q.sends, scheduledSend{at: at, order: q.scheduled, send: send})
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// dispatchLoop will look at the queue anyway
+	}
+}
+
+// Next function removes and returns the earliest send if it is due at now. Otherwise it returns nil and how long
+// until the earliest send is due, or a negative wait if the queue is empty.
+func (q *DelayQueue) Next(now time.Time) (func(), time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.sends) == 0 {
+		return nil, -1
+	}
+	if wait := q.sends[0].at.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	return heap.Pop(&q.sends).(scheduledSend).send, 0
+}
+
+// dispatchLoop function sends the messages of the DelayQueue as they fall due, until the process shuts down.
+// A send waits for its write, so a slow peer holds up the messages due after it.
+func dispatchLoop(process *Process) {
+	for {
+		send, wait := process.scheduled.Next(process.Time.Now())
+		if send != nil {
+			send()
+			continue
+		}
+		// Without a scheduled send, only a new one or the shutdown wakes the loop up
+		var due <-chan time.Time
+		if wait > 0 {
+			due = process.Time.After(wait)
+		}
+		select {
+		case <-process.done:
+			return
+		case <-process.scheduled.wake:
+		case <-due:
+		}
+	}
+}
+
+// PendingSends struct counts the delayed messages that are waiting out their delay or being written, so
+// shutting down can let them go out first.
+type PendingSends struct {
+	mu       sync.Mutex    // Protects every field
+	count    int           // Delayed messages not sent yet
+	draining bool          // Whether new delayed messages are refused
+	empty    chan struct{} // Closed when count drops to zero while draining, nil until Drain waits
+	clock    Clock         // Times the grace period of Drain
+}
+
+// NewPendingSends function creates a tracker without pending messages, timing the grace period with the given clock.
+func NewPendingSends(clock Clock) *PendingSends {
+	return &PendingSends{clock: clock}
+}
+
+// Start function records a new delayed message. It reports false while draining, the message must then not be sent.
+func (s *PendingSends) Start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.count++
+	return true
+}
+
+// Draining function reports whether new delayed messages are refused.
+func (s *PendingSends) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Done function records that a delayed message was sent, dropped or failed.
+func (s *PendingSends) Done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count--
+	if s.count == 0 && s.empty != nil {
+		close(s.empty)
+		s.empty = nil
+	}
+}
+
+// Drain function refuses new delayed messages and waits up to grace for the pending ones.
+// It returns how many were still pending when the grace period ended.
+func (s *PendingSends) Drain(grace time.Duration) int {
+	s.mu.Lock()
+	s.draining = true
+	if s.count == 0 || grace == 0 {
+		count := s.count
+		s.mu.Unlock()
+		return count
+	}
+	if s.empty == nil {
+		s.empty = make(chan struct{})
+	}
+	empty := s.empty
+	s.mu.Unlock()
+	select {
+	case <-empty:
+		return 0
+	case <-s.clock.After(grace):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.count
+	}
+}
+
+// Blocklist struct is the set of peers a process is cut off from. Messages to and from a blocked peer
+// are dropped while the connection stays open, so a partition can be created and healed at runtime.
+type Blocklist struct {
+	mu  sync.Mutex   // Protects ids
+	ids map[int]bool // Blocked peer IDs
+}
+
+// NewBlocklist function creates an empty blocklist.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{ids: make(map[int]bool)}
+}
+
+// Block function starts dropping the messages exchanged with a peer. It reports whether the peer was not blocked yet.
+func (b *Blocklist) Block(peerID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ids[peerID] {
+		return false
+	}
+	b.ids[peerID] = true
+	return true
+}
+
+// Unblock function stops dropping the messages exchanged with a peer. It reports whether the peer was blocked.
+func (b *Blocklist) Unblock(peerID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ids[peerID] {
+		return false
+	}
+	delete(b.ids, peerID)
+	return true
+}
+
+// Blocked function reports whether a peer is blocked.
+func (b *Blocklist) Blocked(peerID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ids[peerID]
+}
+
+// logBlocked function logs a message dropped because its peer is blocked. Heartbeats are dropped silently,
+// they would flood the output every interval.
+func logBlocked(process *Process, direction string, peerID int, msg UnicastMessage) {
+	if msg.Kind != KindHeartbeat {
+		process.logger.Debugf("dropped message %s blocked process %d", direction, peerID)
+	}
+}
+
+// Random struct is a random number generator owned by one process. Unlike the global source of math/rand
+// it can be seeded for reproducible runs, and it is guarded by a mutex since many goroutines send concurrently.
+type Random struct {
+	mu  sync.Mutex // Protects rng, which is not safe for concurrent use
+	rng *rand.Rand // Underlying generator
+}
+
+// NewRandom function creates a random number generator with the given seed.
+func NewRandom(seed int64) *Random {
+	return &Random{rng: rand.New(rand.NewSource(seed))}
+}
+
+// processSeed function returns the seed of a process's random source. A configured seed is offset by the
+// process ID so the processes do not all draw the same sequence, but every run with that seed is identical.
+func processSeed(config *Config, processID int) int64 {
+	seed := config.RandSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return seed + int64(processID)
+}
+
+// Intn function returns a random int in [0, n).
+func (r *Random) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Intn(n)
+}
+
+// Float64 function returns a random float64 in [0.0, 1.0).
+func (r *Random) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
+
+// ExpFloat64 function returns an exponentially distributed float64 with mean 1.
+func (r *Random) ExpFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.ExpFloat64()
+}
+
+// NormFloat64 function returns a normally distributed float64 with mean 0 and standard deviation 1.
+func (r *Random) NormFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.NormFloat64()
+}
+
+// Shuffle function randomizes the order of n elements using swap.
+func (r *Random) Shuffle(n int, swap func(i, j int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rng.Shuffle(n, swap)
+}
+
+// LogEntry struct is one delivered message as written to the message log.
+type LogEntry struct {
+	SourceID    int       `json:"source"`       // Process that sent the message
+	Message     string    `json:"message"`      // Content of the message
+	LogicalTime int       `json:"logical_time"` // Lamport time of the delivery
+	SystemTime  time.Time `json:"system_time"`  // Wall clock time of the delivery
+}
+
+// MessageLog struct appends every delivered message to a per-process file, one JSON object per line.
+type MessageLog struct {
+	mu      sync.Mutex    // Serializes writes from the receiving goroutines
+	file    *os.File      // Open log file
+	encoder *json.Encoder // Writes one JSON object per line to the file
+}
+
+// messageLogFile function returns the name of the message log of a process.
+func messageLogFile(processID int) string {
+	return fmt.Sprintf("log_%d.jsonl", processID)
+}
+
+// NewMessageLog function opens (or creates) the message log of a process for appending.
+func NewMessageLog(processID int) (*MessageLog, error) {
+	file, err := os.OpenFile(messageLogFile(processID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Append function writes one delivered message to the log.
+func (l *MessageLog) Append(entry LogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.encoder.Encode(entry)
+}
+
+// Close function closes the log file.
+func (l *MessageLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// LoadLog function reads a message log back into a slice, in the order the messages were delivered.
+func LoadLog(filename string) ([]LogEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []LogEntry
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var entry LogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// DeadLetter struct is a plain message that was given up on without being delivered.
+type DeadLetter struct {
+	DestinationID int       `json:"destination"` // Process the message was sent to
+	SourceID      int       `json:"source"`      // Process that gave up on the message
+	Message       string    `json:"message"`     // Content of the message
+	Reason        string    `json:"reason"`      // Why the message was given up on
+	SystemTime    time.Time `json:"system_time"` // Wall clock time it was given up on
+}
+
+// DeadLetterQueue struct keeps the messages a process gave up on, so what was lost during a partition or a
+// crash can be examined afterwards. The last DeadLetterLimit of them are kept in memory, and all of them are
+// appended to a file, one JSON object per line, if one was opened.
+type DeadLetterQueue struct {
+	mu      sync.Mutex    // Protects letters and serializes writes to the file
+	letters []DeadLetter  // Recent dead letters, oldest first
+	file    *os.File      // File the dead letters are appended to, nil for none
+	encoder *json.Encoder // Writes to file
+}
+
+// NewDeadLetterQueue function creates an empty queue, appending to filename unless it is empty.
+func NewDeadLetterQueue(filename string) (*DeadLetterQueue, error) {
+	if filename == "" {
+		return &DeadLetterQueue{}, nil
+	}
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return &DeadLetterQueue{}, err
+	}
+	return &DeadLetterQueue{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Add function records a dead letter. It returns the error of writing it to the file, if there is one.
+func (q *DeadLetterQueue) Add(letter DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.letters = append(q.letters, letter)
+	if len(q.letters) > DeadLetterLimit {
+		q.letters = q.letters[len(q.letters)-DeadLetterLimit:]
+	}
+	if q.encoder == nil {
+		return nil
+	}
+	return q.encoder.Encode(letter)
+}
+
+// Letters function returns a copy of the dead letters kept in memory, oldest first.
+func (q *DeadLetterQueue) Letters() []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]DeadLetter(nil), q.letters...)
+}
+
+// Close function closes the file of the queue, if there is one.
+func (q *DeadLetterQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
+
+// deadLetter function records a plain message to a destination that the process gave up on.
+func (p *Process) deadLetter(destinationID int, msg UnicastMessage, reason string) {
+	letter := DeadLetter{DestinationID: destinationID, SourceID: p.ID, Message: msg.Message, Reason: reason, SystemTime: p.wallTime()}
+	if err := p.deadLetters.Add(letter); err != nil {
+		p.logger.Errorf("could not write dead letter: %v", err)
+	}
+}
+
+// printDeadLetters function prints the dead letters of the process, oldest first.
+func printDeadLetters(process *Process) {
+	letters := process.deadLetters.Letters()
+	for _, letter := range letters {
+		fmt.Printf("%s: %q to process %d, %s\n", letter.SystemTime.Format(time.RFC3339), letter.Message, letter.DestinationID, letter.Reason)
+	}
+	fmt.Printf("%d dead letters\n", len(letters))
+}
+
+// Logger struct writes the output of one process, each line prefixed with "[P<ID>] ".
+// Messages less severe than its level are discarded.
+type Logger struct {
+	out   *log.Logger // Destination of the output, safe for concurrent use
+	level LogLevel    // Least severe level that is printed
+}
+
+// NewLogger function creates the logger of a process, writing to out.
+func NewLogger(processID int, level LogLevel, out io.Writer) *Logger {
+	return &Logger{out: log.New(out, fmt.Sprintf("[P%d] ", processID), 0), level: level}
+}
+
+// logf function prints a message if its level is enabled.
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if level >= l.level {
+		l.out.Printf(format, args...)
+	}
+}
+
+// Debugf function prints a debug message.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogDebug, format, args...)
+}
+
+// Infof function prints an informational message.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogInfo, format, args...)
+}
+
+// Errorf function prints an error message.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogError, format, args...)
+}
+
+// Tracef function prints a trace event whatever the level, since tracing is switched on separately.
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.out.Printf(format, args...)
+}
+
+// Trace events of a plain message, logged with the trace option.
+const (
+	TraceSend    = "send"    // The message was numbered and scheduled for a destination
+	TraceReceive = "receive" // The message arrived, before any ordering
+	TraceAck     = "ack"     // The receiver acknowledged the message
+	TraceAcked   = "acked"   // The sender received the ack
+	TraceBuffer  = "buffer"  // The message is held back until the messages it depends on are delivered
+	TraceClock   = "clock"   // The Lamport clock was updated on delivery
+	TraceDeliver = "deliver" // The message was delivered
+)
+
+// traceEvent function logs one event of a plain message if Config.Trace is on, as a line of key=value fields:
+// the event, the message ID (source and Lamport timestamp, which is the same at every destination), its
+// sequence number, the peer it was sent to or received from and the Lamport time of the process. No wall
+// time is printed, so traces of runs with the same seed can be compared with diff.
+func traceEvent(process *Process, event string, msg UnicastMessage, peerID int) {
+	if !process.config.Trace {
+		return
+	}
+	// An ack only names the sequence number of the message
+	id := "-"
+	if msg.Timestamp > 0 {
+		id = fmt.Sprintf("%d.%d", msg.SourceID, msg.Timestamp)
+	}
+	process.logger.Tracef("TRACE event=%s msg=%s seq=%d peer=%d clock=%d", event, id, msg.Seq, peerID, process.clock.Time())
+}
+
+// sequencerID function returns the ID of the process acting as sequencer, which is the lowest configured ID.
+func sequencerID(config *Config) int {
+	id := config.Processes[0].ID
+	for _, process := range config.Processes {
+		if process.ID < id {
+			id = process.ID
+		}
+	}
+	return id
+}
+
+// atLeastOnce function reports whether plain messages are acknowledged, retransmitted and deduplicated.
+func (c *Config) atLeastOnce() bool {
+	return c.DeliverySemantics == SemanticsAtLeastOnce
+}
+
+// newConfig function creates a configuration with the given delays and the default value of every option.
+func newConfig(minDelay int, maxDelay int) *Config {
+	return &Config{
+		MinDelay:          minDelay,
+		MaxDelay:          maxDelay,
+		Retransmit:        RetransmitConfig{Timeout: DefaultRetransmitTimeout, MaxRetries: DefaultMaxRetries},
+		Breaker:           BreakerConfig{Failures: DefaultBreakerFailures, Cooldown: DefaultBreakerCooldown},
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		HeartbeatJitter:   DefaultHeartbeatJitter,
+		Fanout:            DefaultFanout,
+		GossipTTL:         DefaultGossipTTL,
+		ReconnectInterval: DefaultReconnect,
+		MaxMessageBytes:   DefaultMaxMessageBytes,
+		Groups:            make(map[string][]int),
+		LinkDelays:        make(map[string]DelayRange),
+		ClockSkews:        make(map[int]time.Duration),
+		DelayModel:        DefaultDelayModel,
+		DelayMode:         DefaultDelayMode,
+		Retry:             RetryPolicy{MaxAttempts: DefaultDialAttempts, BaseDelay: DefaultDialDelay, Backoff: DefaultBackoff},
+		Codec:             DefaultCodec,
+		KeepAlive:         DefaultKeepAlive,
+		WriteTimeout:      DefaultWriteTimeout,
+		DrainTimeout:      DefaultDrainTimeout,
+		InboundQueue:      DefaultInboundQueue,
+		LogLevel:          DefaultLogLevel,
+		DeliverySemantics: DefaultDeliverySemantics,
+		Mutex:             DefaultMutex,
+	}
+}
+
+// ParseConfig function reads a configuration file and returns a Config struct.
+// The configuration file should have the following format:
+// - The first line contains two integers, representing the minimum and maximum delay.
+// - Each subsequent line represents a process, with the format: ID IP Port [BindAddr],
+// or sets an option, with the format: name value... (see parseOptionLine).
+func ParseConfig(filename string) (*Config, error) {
+	// Open the configuration file.
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err // Return an error if the file cannot be opened.
+	}
+	defer file.Close() // Ensure the file is closed when the function returns. As defer delays the activity until the function returns some value
+
+	// Create a scanner to read the file line by line.
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() { // Read the first line of the file.
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("config line 1: missing minimum and maximum delay")
+	}
+	minMaxDelays := strings.Fields(scanner.Text()) // Split the first line into two parts.
+	if len(minMaxDelays) != 2 {
+		return nil, fmt.Errorf("config line 1: expected 2 fields (min max delay), got %d", len(minMaxDelays))
+	}
+	minDelay, err := strconv.Atoi(minMaxDelays[0]) // Convert the first part to an integer.
+	if err != nil {
+		return nil, fmt.Errorf("config line 1: invalid minimum delay: %w", err)
+	}
+	maxDelay, err := strconv.Atoi(minMaxDelays[1]) // Convert the second part to an integer.
+	if err != nil {
+		return nil, fmt.Errorf("config line 1: invalid maximum delay: %w", err)
+	}
+	if minDelay < 0 || minDelay > maxDelay {
+		return nil, fmt.Errorf("config line 1: delays must satisfy 0 <= min <= max, got min %d and max %d", minDelay, maxDelay)
+	}
+
+	// Create a new Config struct and set the minimum and maximum delay.
+	config := newConfig(minDelay, maxDelay)
+	// Remember the IDs already used to reject duplicates.
+	seenIDs := make(map[int]bool)
+	// Read the rest of the file line by line.
+	for lineNumber := 2; scanner.Scan(); lineNumber++ {
+		processInfo := strings.Fields(scanner.Text()) // Split each line after every space, into three parts.
+		// Skip blank lines.
+		if len(processInfo) == 0 {
+			continue
+		}
+		// Lines that do not start with a process ID set an option.
+		if _, err := strconv.Atoi(processInfo[0]); err != nil {
+			if err := parseOptionLine(config, processInfo); err != nil {
+				return nil, fmt.Errorf("config line %d: %w", lineNumber, err)
+			}
+			config.OptionLines = append(config.OptionLines, strings.Join(processInfo, " "))
+			continue
+		}
+		process, err := parseProcessLine(processInfo)
+		if err != nil {
+			return nil, fmt.Errorf("config line %d: %w", lineNumber, err)
+		}
+		if seenIDs[process.ID] {
+			return nil, fmt.Errorf("config line %d: duplicate process ID %d", lineNumber, process.ID)
+		}
+		seenIDs[process.ID] = true
+		config.Processes = append(config.Processes, process)
+	}
+	// Check for errors that occurred while reading the file.
+	if err := scanner.Err(); err != nil {
+		return nil, err // Return an error if there was a problem reading the file.
+	}
+	if len(config.Processes) == 0 {
+		return nil, fmt.Errorf("config lists no processes")
+	}
+	if err := validateProcessIDs(config); err != nil {
+		return nil, err
+	}
+	// Return the Config struct.
+	return config, nil
+}
+
+// jsonConfig struct is the layout of a JSON configuration file.
+type jsonConfig struct {
+	MinDelay  int           `json:"minDelay"`
+	MaxDelay  int           `json:"maxDelay"`
+	Processes []jsonProcess `json:"processes"`
+	Options   []string      `json:"options"` // Option lines, written as in the plain text format
+}
+
+// jsonProcess struct is one process in a JSON configuration file.
+type jsonProcess struct {
+	ID       int    `json:"id"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	BindAddr string `json:"bindAddr"`
+}
+
+// ParseConfigJSON function reads a configuration file in JSON format, for example
+// {"minDelay": 100, "maxDelay": 200, "processes": [{"id": 1, "ip": "127.0.0.1", "port": 8001}]}.
+// Options are given as an "options" array of lines such as "retransmit 500 3", and every value
+// is validated like in the plain text format.
+func ParseConfigJSON(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var document jsonConfig
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if document.MinDelay < 0 || document.MinDelay > document.MaxDelay {
+		return nil, fmt.Errorf("config: delays must satisfy 0 <= min <= max, got min %d and max %d", document.MinDelay, document.MaxDelay)
+	}
+	config := newConfig(document.MinDelay, document.MaxDelay)
+	for i, option := range document.Options {
+		if len(strings.Fields(option)) == 0 {
+			continue
+		}
+		if err := parseOptionLine(config, strings.Fields(option)); err != nil {
+			return nil, fmt.Errorf("config option %d: %w", i+1, err)
+		}
+		config.OptionLines = append(config.OptionLines, strings.Join(strings.Fields(option), " "))
+	}
+	seenIDs := make(map[int]bool)
+	for i, entry := range document.Processes {
+		// Reuse the validation of the plain text format
+		fields := []string{strconv.Itoa(entry.ID), entry.IP, strconv.Itoa(entry.Port)}
+		if entry.BindAddr != "" {
+			fields = append(fields, entry.BindAddr)
+		}
+		process, err := parseProcessLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("config process %d: %w", i+1, err)
+		}
+		if seenIDs[process.ID] {
+			return nil, fmt.Errorf("config process %d: duplicate process ID %d", i+1, process.ID)
+		}
+		seenIDs[process.ID] = true
+		config.Processes = append(config.Processes, process)
+	}
+	if len(config.Processes) == 0 {
+		return nil, fmt.Errorf("config lists no processes")
+	}
+	if err := validateProcessIDs(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validateProcessIDs function checks that every group and link only names configured processes. Options may
+// come before the processes they name, so this runs once the whole configuration is read.
+func validateProcessIDs(config *Config) error {
+	known := make(map[int]bool)
+	for _, process := range config.Processes {
+		known[process.ID] = true
+	}
+	for name, members := range config.Groups {
+		for _, id := range members {
+			if !known[id] {
+				return fmt.Errorf("config: group %q lists unknown process %d", name, id)
+			}
+		}
+	}
+	for key := range config.LinkDelays {
+		var sourceID, destinationID int
+		fmt.Sscanf(key, "%d-%d", &sourceID, &destinationID)
+		if !known[sourceID] || !known[destinationID] {
+			return fmt.Errorf("config: link %s names an unknown process", key)
+		}
+	}
+	for id := range config.ClockSkews {
+		if !known[id] {
+			return fmt.Errorf("config: clock skew given for unknown process %d", id)
+		}
+	}
+	return nil
+}
+
+// ParseConfigFile function reads a configuration file with the parser matching its extension:
+// ParseConfigJSON for .json files and ParseConfig for everything else.
+func ParseConfigFile(filename string) (*Config, error) {
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		return ParseConfigJSON(filename)
+	}
+	return ParseConfig(filename)
+}
+
+// parseOptionLine function applies a config line of the form: name value... to the configuration.
+// Supported options:
+// - retransmit TimeoutMs MaxRetries
+// - breaker Failures CooldownMs
+// - heartbeat IntervalMs [Jitter]
+// - fanout Peers
+// - group Name ID...
+// - maxmessage Bytes
+// - reconnect IntervalMs
+// - ttl Hops
+// - delay uniform|exponential|normal
+// - delaymode independent|queued
+// - link SourceID DestinationID MinDelayMs MaxDelayMs
+// - skew ID OffsetMs
+// - drop Rate
+// - ratelimit MessagesPerSecond
+// - expiry TTLMs
+// - seed Number
+// - retry Attempts BaseDelayMs linear|exponential
+// - codec gob|json
+// - deadletters FileName
+// - http BasePort
+// - discovery FirstPort LastPort [BroadcastAddr]
+// - loglevel debug|info|error
+// - trace on|off
+// - compression on|off
+// - tls CertFile KeyFile CAFile
+// - keepalive PeriodMs
+// - writetimeout TimeoutMs
+// - batch Size WindowMs
+// - drain GraceMs
+// - inbound QueueSize
+// - maxconns Limit
+// - window Size
+// - delivery at-least-once|at-most-once
+// - mutex ricart-agrawala|token-ring
+func parseOptionLine(config *Config, option []string) error {
+	switch option[0] {
+	case "retransmit":
+		if len(option) != 3 {
+			return fmt.Errorf("expected: retransmit TimeoutMs MaxRetries")
+		}
+		timeout, err := strconv.Atoi(option[1])
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid retransmit timeout %q", option[1])
+		}
+		maxRetries, err := strconv.Atoi(option[2])
+		if err != nil || maxRetries < 0 {
+			return fmt.Errorf("invalid retransmit max retries %q", option[2])
+		}
+		config.Retransmit = RetransmitConfig{Timeout: time.Duration(timeout) * time.Millisecond, MaxRetries: maxRetries}
+	case "breaker":
+		if len(option) != 3 {
+			return fmt.Errorf("expected: breaker Failures CooldownMs")
+		}
+		failures, err := strconv.Atoi(option[1])
+		if err != nil || failures < 0 {
+			return fmt.Errorf("invalid breaker failures %q", option[1])
+		}
+		cooldown, err := strconv.Atoi(option[2])
+		if err != nil || cooldown <= 0 {
+			return fmt.Errorf("invalid breaker cooldown %q", option[2])
+		}
+		config.Breaker = BreakerConfig{Failures: failures, Cooldown: time.Duration(cooldown) * time.Millisecond}
+	case "heartbeat":
+		if len(option) != 2 && len(option) != 3 {
+			return fmt.Errorf("expected: heartbeat IntervalMs [Jitter]")
+		}
+		interval, err := strconv.Atoi(option[1])
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid heartbeat interval %q", option[1])
+		}
+		config.HeartbeatInterval = time.Duration(interval) * time.Millisecond
+		if len(option) == 3 {
+			jitter, err := strconv.ParseFloat(option[2], 64)
+			if err != nil || jitter < 0 || jitter > 1 {
+				return fmt.Errorf("invalid heartbeat jitter %q, must be between 0.0 and 1.0", option[2])
+			}
+			config.HeartbeatJitter = jitter
+		}
+	case "fanout":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: fanout Peers")
+		}
+		fanout, err := strconv.Atoi(option[1])
+		if err != nil || fanout <= 0 {
+			return fmt.Errorf("invalid fanout %q", option[1])
+		}
+		config.Fanout = fanout
+	case "group":
+		if len(option) < 3 {
+			return fmt.Errorf("expected: group Name ID...")
+		}
+		if _, ok := config.Groups[option[1]]; ok {
+			return fmt.Errorf("group %q is defined twice", option[1])
+		}
+		var members []int
+		for _, field := range option[2:] {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("invalid process ID %q in group %q", field, option[1])
+			}
+			members = append(members, id)
+		}
+		config.Groups[option[1]] = members
+	case "maxmessage":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: maxmessage Bytes")
+		}
+		size, err := strconv.Atoi(option[1])
+		if err != nil {
+			return fmt.Errorf("invalid maximum message size %q", option[1])
+		}
+		if size < MinMessageLimit {
+			return fmt.Errorf("maximum message size %d is below the minimum of %d bytes", size, MinMessageLimit)
+		}
+		config.MaxMessageBytes = size
+	case "reconnect":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: reconnect IntervalMs")
+		}
+		interval, err := strconv.Atoi(option[1])
+		if err != nil || interval < 0 {
+			return fmt.Errorf("invalid reconnect interval %q", option[1])
+		}
+		config.ReconnectInterval = time.Duration(interval) * time.Millisecond
+	case "ttl":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: ttl Hops")
+		}
+		ttl, err := strconv.Atoi(option[1])
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid gossip TTL %q", option[1])
+		}
+		config.GossipTTL = ttl
+	case "delay":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: delay uniform|exponential|normal")
+		}
+		switch option[1] {
+		case DelayUniform, DelayExponential, DelayNormal:
+			config.DelayModel = option[1]
+		default:
+			return fmt.Errorf("invalid delay model %q", option[1])
+		}
+	case "delaymode":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: delaymode independent|queued")
+		}
+		switch option[1] {
+		case DelayModeIndependent, DelayModeQueued:
+			config.DelayMode = option[1]
+		default:
+			return fmt.Errorf("invalid delay mode %q", option[1])
+		}
+	case "link":
+		if len(option) != 5 {
+			return fmt.Errorf("expected: link SourceID DestinationID MinDelayMs MaxDelayMs")
+		}
+		var ids [2]int
+		for i, field := range option[1:3] {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("invalid process ID %q", field)
+			}
+			ids[i] = id
+		}
+		minDelay, err1 := strconv.Atoi(option[3])
+		maxDelay, err2 := strconv.Atoi(option[4])
+		if err1 != nil || err2 != nil || minDelay < 0 || minDelay > maxDelay {
+			return fmt.Errorf("invalid link delays %q and %q, must satisfy 0 <= min <= max", option[3], option[4])
+		}
+		key := linkKey(ids[0], ids[1])
+		if _, ok := config.LinkDelays[key]; ok {
+			return fmt.Errorf("link %s is defined twice", key)
+		}
+		config.LinkDelays[key] = DelayRange{Min: minDelay, Max: maxDelay}
+	case "skew":
+		if len(option) != 3 {
+			return fmt.Errorf("expected: skew ID OffsetMs")
+		}
+		id, err := strconv.Atoi(option[1])
+		if err != nil {
+			return fmt.Errorf("invalid process ID %q", option[1])
+		}
+		offset, err := strconv.Atoi(option[2])
+		if err != nil {
+			return fmt.Errorf("invalid clock skew %q", option[2])
+		}
+		if _, ok := config.ClockSkews[id]; ok {
+			return fmt.Errorf("clock skew of process %d is defined twice", id)
+		}
+		config.ClockSkews[id] = time.Duration(offset) * time.Millisecond
+	case "drop":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: drop Rate")
+		}
+		rate, err := strconv.ParseFloat(option[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid drop rate %q, must be between 0.0 and 1.0", option[1])
+		}
+		config.DropRate = rate
+	case "ratelimit":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: ratelimit MessagesPerSecond")
+		}
+		rate, err := strconv.ParseFloat(option[1], 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("invalid rate limit %q", option[1])
+		}
+		config.RateLimit = rate
+	case "expiry":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: expiry TTLMs")
+		}
+		ttl, err := strconv.Atoi(option[1])
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid expiry TTL %q", option[1])
+		}
+		config.MessageTTL = time.Duration(ttl) * time.Millisecond
+	case "seed":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: seed Number")
+		}
+		seed, err := strconv.ParseInt(option[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid seed %q", option[1])
+		}
+		config.RandSeed = seed
+	case "retry":
+		if len(option) != 4 {
+			return fmt.Errorf("expected: retry Attempts BaseDelayMs linear|exponential")
+		}
+		attempts, err := strconv.Atoi(option[1])
+		if err != nil || attempts <= 0 {
+			return fmt.Errorf("invalid retry attempts %q", option[1])
+		}
+		baseDelay, err := strconv.Atoi(option[2])
+		if err != nil || baseDelay < 0 {
+			return fmt.Errorf("invalid retry base delay %q", option[2])
+		}
+		if option[3] != BackoffLinear && option[3] != BackoffExponential {
+			return fmt.Errorf("invalid retry backoff %q", option[3])
+		}
+		config.Retry = RetryPolicy{MaxAttempts: attempts, BaseDelay: time.Duration(baseDelay) * time.Millisecond, Backoff: option[3]}
+	case "codec":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: codec gob|json")
+		}
+		if option[1] != CodecGob && option[1] != CodecJSON {
+			return fmt.Errorf("invalid codec %q", option[1])
+		}
+		config.Codec = option[1]
+	case "deadletters":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: deadletters FileName")
+		}
+		config.DeadLetterFile = option[1]
+	case "http":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: http BasePort")
+		}
+		port, err := strconv.Atoi(option[1])
+		if err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("invalid HTTP base port %q", option[1])
+		}
+		config.ControlPort = port
+	case "discovery":
+		if len(option) != 3 && len(option) != 4 {
+			return fmt.Errorf("expected: discovery FirstPort LastPort [BroadcastAddr]")
+		}
+		first, err := strconv.Atoi(option[1])
+		if err != nil || first <= 0 || first > 65535 {
+			return fmt.Errorf("invalid discovery port %q", option[1])
+		}
+		last, err := strconv.Atoi(option[2])
+		if err != nil || last < first || last > 65535 {
+			return fmt.Errorf("invalid discovery port %q", option[2])
+		}
+		if last-first >= MaxDiscoveryPorts {
+			return fmt.Errorf("discovery ports %d to %d are more than %d ports", first, last, MaxDiscoveryPorts)
+		}
+		discovery := DiscoveryConfig{FirstPort: first, LastPort: last, BroadcastAddr: DefaultBroadcastAddr}
+		if len(option) == 4 {
+			if ip := net.ParseIP(option[3]); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid discovery broadcast address %q", option[3])
+			}
+			discovery.BroadcastAddr = option[3]
+		}
+		config.Discovery = discovery
+	case "loglevel":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: loglevel debug|info|error")
+		}
+		level, ok := logLevels[option[1]]
+		if !ok {
+			return fmt.Errorf("invalid log level %q", option[1])
+		}
+		config.LogLevel = level
+	case "trace":
+		if len(option) != 2 || (option[1] != "on" && option[1] != "off") {
+			return fmt.Errorf("expected: trace on|off")
+		}
+		config.Trace = option[1] == "on"
+	case "compression":
+		if len(option) != 2 || (option[1] != "on" && option[1] != "off") {
+			return fmt.Errorf("expected: compression on|off")
+		}
+		config.Compression = option[1] == "on"
+	case "tls":
+		if len(option) != 4 {
+			return fmt.Errorf("expected: tls CertFile KeyFile CAFile")
+		}
+		config.TLSCert, config.TLSKey, config.TLSCA = option[1], option[2], option[3]
+	case "keepalive":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: keepalive PeriodMs")
+		}
+		period, err := strconv.Atoi(option[1])
+		if err != nil || period < 0 {
+			return fmt.Errorf("invalid keepalive period %q", option[1])
+		}
+		config.KeepAlive = time.Duration(period) * time.Millisecond
+	case "writetimeout":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: writetimeout TimeoutMs")
+		}
+		timeout, err := strconv.Atoi(option[1])
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("invalid write timeout %q", option[1])
+		}
+		config.WriteTimeout = time.Duration(timeout) * time.Millisecond
+	case "batch":
+		if len(option) != 3 {
+			return fmt.Errorf("expected: batch Size WindowMs")
+		}
+		size, err1 := strconv.Atoi(option[1])
+		window, err2 := strconv.Atoi(option[2])
+		if err1 != nil || err2 != nil || size < 0 || window < 0 {
+			return fmt.Errorf("invalid batch size %q or window %q", option[1], option[2])
+		}
+		config.BatchSize = size
+		config.BatchWindow = time.Duration(window) * time.Millisecond
+	case "drain":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: drain GraceMs")
+		}
+		grace, err := strconv.Atoi(option[1])
+		if err != nil || grace < 0 {
+			return fmt.Errorf("invalid drain grace period %q", option[1])
+		}
+		config.DrainTimeout = time.Duration(grace) * time.Millisecond
+	case "inbound":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: inbound QueueSize")
+		}
+		size, err := strconv.Atoi(option[1])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid inbound queue size %q", option[1])
+		}
+		config.InboundQueue = size
+	case "maxconns":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: maxconns Limit")
+		}
+		limit, err := strconv.Atoi(option[1])
+		if err != nil || limit < 0 {
+			return fmt.Errorf("invalid connection limit %q", option[1])
+		}
+		config.MaxConnections = limit
+	case "window":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: window Size")
+		}
+		size, err := strconv.Atoi(option[1])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid window size %q", option[1])
+		}
+		config.WindowSize = size
+	case "delivery":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: delivery at-least-once|at-most-once")
+		}
+		switch option[1] {
+		case SemanticsAtLeastOnce, SemanticsAtMostOnce:
+			config.DeliverySemantics = option[1]
+		default:
+			return fmt.Errorf("invalid delivery semantics %q", option[1])
+		}
+	case "mutex":
+		if len(option) != 2 {
+			return fmt.Errorf("expected: mutex ricart-agrawala|token-ring")
+		}
+		switch option[1] {
+		case MutexRicartAgrawala, MutexTokenRing:
+			config.Mutex = option[1]
+		default:
+			return fmt.Errorf("invalid mutex algorithm %q", option[1])
+		}
+	default:
+		return fmt.Errorf("unknown option %q", option[0])
+	}
+	return nil
+}
+
+// parseProcessLine function builds a Process from the fields of a config line: ID IP Port [BindAddr].
+func parseProcessLine(processInfo []string) (Process, error) {
+	if len(processInfo) != 3 && len(processInfo) != 4 {
+		return Process{}, fmt.Errorf("expected 3 fields (ID IP Port) and an optional bind address, got %d", len(processInfo))
+	}
+	processID, err := strconv.Atoi(processInfo[0]) // Convert the first part to an integer.
+	if err != nil {
+		return Process{}, fmt.Errorf("invalid process ID: %w", err)
+	}
+	// The port must be a number in the valid TCP range.
+	port, err := strconv.Atoi(processInfo[2])
+	if err != nil {
+		return Process{}, fmt.Errorf("invalid port for process %d: %w", processID, err)
+	}
+	if port < 1 || port > 65535 {
+		return Process{}, fmt.Errorf("invalid port for process %d: %d is out of range", processID, port)
+	}
+	// The host may be an IP address or a hostname, which is resolved when the process is dialed
+	if processInfo[1] == "" {
+		return Process{}, fmt.Errorf("empty host for process %d", processID)
+	}
+	// Create a new Process struct.
+	process := Process{
+		ID:       processID,
+		IP:       processInfo[1],
+		Port:     processInfo[2],
+		BindAddr: processInfo[1],
+	}
+	// An optional fourth part overrides the address the listener binds to.
+	if len(processInfo) > 3 {
+		if processInfo[3] == "" {
+			return Process{}, fmt.Errorf("empty bind address for process %d", processID)
+		}
+		process.BindAddr = processInfo[3]
+	}
+	return process, nil
+}
+
+// newMessage function creates a message from a process, stamped with its Lamport and vector clocks.
+// Sending is a local event, so both clocks are ticked once per message, even when it goes to several processes.
+func newMessage(sourceID int, message string, clock *LamportClock, causal *CausalDelivery) UnicastMessage {
+	return UnicastMessage{SourceID: sourceID, Message: message, Timestamp: clock.Tick(), Vector: causal.Stamp(sourceID)}
+}
+
+// randomDelay function returns a random duration between the minimum and maximum delay (in milliseconds).
+func randomDelay(rng *Random, minDelay int, maxDelay int) time.Duration {
+	// Intn panics on an empty range, so equal bounds give a fixed delay
+	if maxDelay <= minDelay {
+		return time.Duration(minDelay) * time.Millisecond
+	}
+	return time.Duration(minDelay+rng.Intn(maxDelay-minDelay)) * time.Millisecond
+}
+
+// sampleDelay function returns a delay between the minimum and maximum delay (in milliseconds), drawn from
+// the given delay model. The exponential model adds to the minimum an extra delay with a mean of half the range,
+// the normal model is centered in the middle of the range with a standard deviation of a sixth of it.
+// Samples falling outside the range are clamped to it.
+func sampleDelay(rng *Random, model string, minDelay int, maxDelay int) time.Duration {
+	if maxDelay <= minDelay {
+		return time.Duration(minDelay) * time.Millisecond
+	}
+	spread := float64(maxDelay - minDelay)
+	var delay float64
+	switch model {
+	case DelayExponential:
+		delay = float64(minDelay) + rng.ExpFloat64()*spread/2
+	case DelayNormal:
+		delay = float64(minDelay) + spread/2 + rng.NormFloat64()*spread/6
+	default:
+		return randomDelay(rng, minDelay, maxDelay)
+	}
+	delay = math.Max(float64(minDelay), math.Min(float64(maxDelay), delay))
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+// messageDelay function samples the delay of one message to a destination from the process's random source,
+// using the delay model of the configuration and the delay range of the link, or the current delay bounds of
+// the process if the link has none. The extra latency set for the destination is added on top.
+func messageDelay(process *Process, destinationID int) time.Duration {
+	config := process.config
+	minDelay, maxDelay := process.delays.Get()
+	if link, ok := config.LinkDelays[linkKey(process.ID, destinationID)]; ok {
+		minDelay, maxDelay = link.Min, link.Max
+	}
+	return sampleDelay(process.rng, config.DelayModel, minDelay, maxDelay) + process.delays.Latency(destinationID)
+}
+
+// unicast_send function sends a stamped message to a process through a network connection.
+// New plain messages get the next sequence number for the destination and are tracked until acknowledged;
+// retransmissions keep the sequence number they were first sent with.
+// Encoding errors are returned to the caller instead of stopping the program, and so is the error of a message
+// larger than Config.MaxMessageBytes, which is refused before anything is written.
+func unicast_send(process *Process, destinationID int, msg UnicastMessage) error {
+	peer, ok := process.connections.Get(destinationID)
+	if !ok {
+		return fmt.Errorf("no connection to process %d", destinationID)
+	}
+	if err := checkSize(process, msg); err != nil {
+		process.logger.Errorf("refusing to send to process %d: %v", destinationID, err)
+		return err
+	}
+	if msg.Kind == KindData && msg.Seq == 0 {
+		msg = numberMessage(process, destinationID, msg)
+	}
+	// A blocked peer is unreachable but not failed, so the connection is kept
+	if process.blocked.Blocked(destinationID) {
+		process.stats.RecordDropped(destinationID)
+		logBlocked(process, "to", destinationID, msg)
+		return nil
+	}
+	//Encoding the msg object
+	if err := peer.send(msg); err != nil {
+		return err
+	}
+	process.stats.RecordSent(destinationID, msg)
+	return nil
+}
+
+// checkSize function returns an error wrapping errMessageTooLarge if a message is larger than Config.MaxMessageBytes.
+// The size is the estimate of messageSize; the receiver enforces the limit on the encoded message.
+func checkSize(process *Process, msg UnicastMessage) error {
+	if size := messageSize(msg); size > process.config.MaxMessageBytes {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", errMessageTooLarge, size, process.config.MaxMessageBytes)
+	}
+	return nil
+}
+
+// tooLarge function reports whether a message is larger than Config.MaxMessageBytes, logging that it is refused if so.
+func tooLarge(process *Process, destinationID int, msg UnicastMessage) bool {
+	if err := checkSize(process, msg); err != nil {
+		process.logger.Errorf("refusing to send to process %d: %v", destinationID, err)
+		return true
+	}
+	return false
+}
+
+// numberMessage function stamps a new plain message with the next sequence number for its destination.
+// With at-least-once delivery the message is also tracked until it is acknowledged and kept to answer a NAK.
+func numberMessage(process *Process, destinationID int, msg UnicastMessage) UnicastMessage {
+	// A message without a deadline of its own gets the default one, counted from now
+	if msg.Deadline.IsZero() && process.config.MessageTTL > 0 {
+		msg.Deadline = process.Time.Now().Add(process.config.MessageTTL)
+	}
+	if !process.config.atLeastOnce() {
+		return process.acks.Number(destinationID, msg)
+	}
+	if process.acks.Full(destinationID) {
+		process.logger.Infof("Send window to process %d is full, waiting for acks", destinationID)
+	}
+	msg = process.acks.Track(destinationID, msg, process.done)
+	process.history.Add(destinationID, msg)
+	return msg
+}
+
+// unicast_send_with_delay function sends a message to a process with a delay.
+// The delay is a random duration between the minimum and maximum delay specified in the configuration.
+// If Config.RateLimit is set, the rate limiter may hold the message back beyond its delay, so a burst leaves
+// at the limited rate and in the order it was sent.
+// With probability Config.DropRate the message is lost on the way to simulate packet loss. A lost plain message
+// is still tracked like a sent one, so it is retransmitted when its ack does not arrive.
+// If the send fails, only the connection to that destination is dropped.
+func unicast_send_with_delay(process *Process, destinationID int, msg UnicastMessage, delay time.Duration) {
+	// Refuse an oversized message before it is numbered, so it is never retransmitted
+	if tooLarge(process, destinationID, msg) {
+		return
+	}
+	// A process that is shutting down only sends what it had already scheduled
+	if !process.pending.Start() {
+		process.logger.Debugf("not sending to process %d, the process is shutting down", destinationID)
+		return
+	}
+	// Number a new plain message now, so the receiver can restore the send order the delays mix up
+	if msg.Kind == KindData && msg.Seq == 0 {
+		msg = numberMessage(process, destinationID, msg)
+	}
+	if msg.Kind == KindData {
+		traceEvent(process, TraceSend, msg, destinationID)
+	}
+	now := process.Time.Now()
+	at := process.limiter.Reserve(destinationID, now.Add(delay))
+	if wait := at.Sub(now); wait > delay {
+		process.logger.Debugf("Rate limit to process %d reached, sending in %s", destinationID, wait)
+	}
+	if process.config.DelayMode == DelayModeQueued {
+		// The dispatcher goroutine sends it once its time has come, after every message due earlier
+		process.scheduled.Schedule(at, func() {
+			defer process.pending.Done()
+			sendDelayed(process, destinationID, msg, delay)
+		})
+		return
+	}
+	// Start a new goroutine to send the message after the delay.
+	go func() {
+		defer process.pending.Done()
+		<-process.Time.After(at.Sub(process.Time.Now()))
+		sendDelayed(process, destinationID, msg, delay)
+	}()
+}
+
+// sendDelayed function sends a message whose delay is over, unless the drop rate loses it on the way.
+func sendDelayed(process *Process, destinationID int, msg UnicastMessage, delay time.Duration) {
+	if process.rng.Float64() < process.config.DropRate {
+		process.stats.RecordDropped(destinationID)
+		process.logger.Infof("dropped message to process %d", destinationID)
+		return
+	}
+	process.stats.RecordDelay(delay)
+	err := unicast_send(process, destinationID, msg)
+	if err != nil {
+		process.dropPeer(destinationID, err)
+		// With at-least-once delivery the message is still retransmitted, it is only lost without it
+		if msg.Kind == KindData && !process.config.atLeastOnce() {
+			process.deadLetter(destinationID, msg, err.Error())
+		}
+	}
+	// A plain message counts for the circuit breaker; with at-least-once delivery its ack decides success
+	if msg.Kind == KindData && err != nil {
+		process.sendFailed(destinationID)
+	} else if msg.Kind == KindData && !process.config.atLeastOnce() {
+		process.sendSucceeded(destinationID)
+	}
+}
+
+// Send function sends a message to another process after a random delay, as the send command does.
+// It returns an error if the destination is the process itself, there is no connection to the destination process
+// or the message is larger than Config.MaxMessageBytes. The error wraps errIsolated if the process has no peers at all.
+// The message is delivered in the send order of the process but carries no vector timestamp, like an osend fifo message.
+func (p *Process) Send(destinationID int, message string) error {
+	return p.SendWithTTL(destinationID, message, 0)
+}
+
+// SendWithTTL function sends a message like Send, but the receiver drops it instead of delivering it if it
+// arrives more than ttl after now. A ttl of 0 keeps the default, Config.MessageTTL.
+func (p *Process) SendWithTTL(destinationID int, message string, ttl time.Duration) error {
+	if destinationID == p.ID {
+		return fmt.Errorf("process %d cannot send to itself", p.ID)
+	}
+	// Check if there is a connection to the destination process
+	_, connected := p.connections.Get(destinationID)
+	if !connected && !p.isMember(destinationID) {
+		if p.isolated() {
+			return fmt.Errorf("no connection to process %d: %w", destinationID, errIsolated)
+		}
+		return fmt.Errorf("no connection to process %d: %w", destinationID, errUnknownDestination)
+	}
+	if p.pending.Draining() {
+		return fmt.Errorf("process %d is %w", p.ID, errShuttingDown)
+	}
+	// A message to a single process is delivered in FIFO order only. The causal delivery rule assumes every
+	// message goes to every process, so a vector stamped here would hold back the sender's later messages at
+	// every other process, which never gets this one.
+	msg := UnicastMessage{SourceID: p.ID, Message: message, Ordering: OrderingFIFO}
+	if err := checkSize(p, msg); err != nil {
+		return err
+	}
+	// Fail right away while the peer's circuit breaker is open, before the message is stamped
+	if !p.breaker.Allow(destinationID, p.Time.Now()) {
+		err := fmt.Errorf("cannot send to process %d: %w", destinationID, errCircuitOpen)
+		p.deadLetter(destinationID, msg, err.Error())
+		return err
+	}
+	msg.Timestamp = p.clock.Tick()
+	if ttl > 0 {
+		msg.Deadline = p.Time.Now().Add(ttl)
+	}
+	// A member without a connection, for example one that has not started yet, gets the message once it is connected
+	if !connected {
+		if err := p.outbox.Add(destinationID, msg); err != nil {
+			p.sendFailed(destinationID)
+			return err
+		}
+		p.logger.Infof("Queued message: %s for process %d until it is connected, system time is: %s", message, destinationID, p.wallTime().Format(time.RFC3339))
+		return nil
+	}
+	// Send the message to the destination process after the delay
+	unicast_send_with_delay(p, destinationID, msg, messageDelay(p, destinationID))
+	p.logger.Infof("Sent message: %s to process %d, system time is: %s", message, destinationID, p.wallTime().Format(time.RFC3339))
+	return nil
+}
+
+// SendFile function sends every non-empty line of a file as a separate message to another process, in the
+// order of the lines, as the sendfile command does. It returns the number of lines sent, and stops at the first
+// line that cannot be sent or when the file cannot be read.
+func (p *Process) SendFile(destinationID int, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	sent := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Each Send takes the next sequence number, so the receiver delivers the lines in file order
+		if err := p.Send(destinationID, line); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	if err := scanner.Err(); err != nil {
+		return sent, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	return sent, nil
+}
+
+// multicast_send function sends a message to every other process in the connection map.
+// The message is stamped once, and each destination gets its own independently sampled random delay.
+// It returns the number of processes the message was sent to.
+func multicast_send(process *Process, message string) int {
+	return multicastExcept(process, message, process.ID)
+}
+
+// multicast_send_except function sends a message to every other process in the connection map except one,
+// for example to simulate a partition. It returns the number of processes the message was sent to,
+// or an error if the excluded process is not a member of the cluster.
+func multicast_send_except(process *Process, excludedID int, message string) (int, error) {
+	known := false
+	for _, member := range process.memberList() {
+		if member.ID == excludedID && excludedID != process.ID {
+			known = true
+		}
+	}
+	if !known {
+		return 0, fmt.Errorf("process %d is not a member of the cluster", excludedID)
+	}
+	return multicastExcept(process, message, excludedID), nil
+}
+
+// multicastExcept function stamps a message once and sends it, each with its own random delay, to every
+// connected process other than the sender and excludedID. It returns the number of destinations.
+func multicastExcept(process *Process, message string, excludedID int) int {
+	var destinations []int
+	for _, destinationID := range process.connections.IDs() {
+		if destinationID != excludedID {
+			destinations = append(destinations, destinationID)
+		}
+	}
+	return multicastTo(process, message, destinations)
+}
+
+// group_send function multicasts a message to every member of a group from Config.Groups, stamped once like
+// a multicast. Members without a connection are skipped and the sender never sends to itself. It returns the
+// number of processes the message was sent to, or an error if there is no such group.
+func group_send(process *Process, name string, message string) (int, error) {
+	members, ok := process.config.Groups[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown group %q", name)
+	}
+	var destinations []int
+	for _, memberID := range members {
+		if memberID == process.ID {
+			continue
+		}
+		if _, ok := process.connections.Get(memberID); !ok {
+			process.logger.Errorf("not sending to process %d of group %s: no connection", memberID, name)
+			continue
+		}
+		destinations = append(destinations, memberID)
+	}
+	return multicastTo(process, message, destinations), nil
+}
+
+// multicastTo function stamps a message once and sends it to every destination other than the sender,
+// each with its own random delay. It returns the number of destinations.
+func multicastTo(process *Process, message string, destinations []int) int {
+	if err := checkSize(process, UnicastMessage{SourceID: process.ID, Message: message, Vector: process.causal.Vector()}); err != nil {
+		process.logger.Errorf("refusing to multicast: %v", err)
+		return 0
+	}
+	return sendStamped(process, newMessage(process.ID, message, process.clock, process.causal), destinations)
+}
+
+// sendStamped function sends a message that is already stamped to every destination other than the sender,
+// each with its own random delay. It returns the number of destinations.
+func sendStamped(process *Process, msg UnicastMessage, destinations []int) int {
+	sent := 0
+	for _, destinationID := range destinations {
+		// Never send the message back to ourselves
+		if destinationID == process.ID {
+			continue
+		}
+		unicast_send_with_delay(process, destinationID, msg, messageDelay(process, destinationID))
+		process.logger.Infof("Sent message: %s to process %d, system time is: %s", msg.Message, destinationID, process.wallTime().Format(time.RFC3339))
+		sent++
+	}
+	return sent
+}
+
+// multicast_ordered function multicasts a message to every connected process with the ordering class it needs,
+// so traffic with different guarantees shares the same connections. A total message is broadcast through the
+// sequencer like the border command; only causal messages carry a vector timestamp, so the others never hold
+// back causal ones. It returns the number of processes the message was sent to, 0 for a total message.
+func multicast_ordered(process *Process, class string, message string) (int, error) {
+	switch class {
+	case OrderingTotal:
+		ordered_broadcast(process, message)
+		return 0, nil
+	case OrderingCausal:
+		return multicast_send(process, message), nil
+	case OrderingNone, OrderingFIFO:
+		msg := UnicastMessage{SourceID: process.ID, Message: message, Ordering: class}
+		if err := checkSize(process, msg); err != nil {
+			return 0, err
+		}
+		msg.Timestamp = process.clock.Tick()
+		return sendStamped(process, msg, process.connections.IDs()), nil
+	default:
+		return 0, fmt.Errorf("invalid ordering class %q", class)
+	}
+}
+
+// quorum_broadcast function multicasts a message like multicast_send and tracks the acks of its copies. The
+// broadcast is committed, and the returned channel closed, once a majority of the members, the sender included,
+// has acknowledged it; "Message committed" is logged at that point. It needs at-least-once delivery, since
+// only then are plain messages acknowledged. A broadcast that cannot reach a majority is never committed.
+func quorum_broadcast(process *Process, message string) (<-chan struct{}, error) {
+	if !process.config.atLeastOnce() {
+		return nil, fmt.Errorf("quorum broadcast needs %s delivery", SemanticsAtLeastOnce)
+	}
+	if process.pending.Draining() {
+		return nil, fmt.Errorf("process %d is %w", process.ID, errShuttingDown)
+	}
+	if err := checkSize(process, UnicastMessage{SourceID: process.ID, Message: message, Vector: process.causal.Vector()}); err != nil {
+		return nil, err
+	}
+	broadcastID, committed := process.quorum.Start(message, len(process.memberList()))
+	msg := newMessage(process.ID, message, process.clock, process.causal)
+	for _, destinationID := range process.connections.IDs() {
+		// Number each copy here so its ack can be matched to the broadcast
+		numbered := numberMessage(process, destinationID, msg)
+		process.quorum.AddCopy(broadcastID, destinationID, numbered.Seq)
+		unicast_send_with_delay(process, destinationID, numbered, messageDelay(process, destinationID))
+		process.logger.Infof("Sent message: %s to process %d, system time is: %s", message, destinationID, process.wallTime().Format(time.RFC3339))
+	}
+	select {
+	case <-committed:
+		// Alone in the cluster, the sender is a majority by itself
+		process.logger.Infof("Message committed: %s, acknowledged by 1 of 1 processes, system time is: %s", message, process.wallTime().Format(time.RFC3339))
+	default:
+	}
+	return committed, nil
+}
+
+// gossip_send function forwards a gossip message to Config.Fanout randomly chosen peers,
+// each with its own random delay, instead of sending it to everyone.
+func gossip_send(process *Process, gossip GossipMessage) {
+	peers := process.connections.IDs()
+	// Shuffle the peers and keep the first Fanout of them
+	process.rng.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > process.config.Fanout {
+		peers = peers[:process.config.Fanout]
+	}
+	msg := UnicastMessage{Kind: KindGossip, SourceID: process.ID, Gossip: &gossip}
+	for _, destinationID := range peers {
+		unicast_send_with_delay(process, destinationID, msg, messageDelay(process, destinationID))
+	}
+}
+
+// start_gossip function starts disseminating a new message by gossip.
+func start_gossip(process *Process, message string) {
+	gossip := GossipMessage{ID: process.gossip.NextID(process.ID), OriginID: process.ID, Message: message, TTL: process.config.GossipTTL}
+	// Mark our own message as seen so it is not forwarded again when it comes back
+	process.tracker.MarkGossip(gossip.ID)
+	gossip_send(process, gossip)
+	process.logger.Infof("Started gossip %s: %s, system time is: %s", gossip.ID, message, process.wallTime().Format(time.RFC3339))
+}
+
+// ordered_broadcast function broadcasts a message in total order.
+// The message is handed to the sequencer, which numbers it and multicasts it to everyone.
+func ordered_broadcast(process *Process, message string) {
+	if seqID, sent := requestOrder(process, message, nil); sent {
+		process.logger.Infof("Sent ordered broadcast request: %s to sequencer %d, system time is: %s", message, seqID, process.wallTime().Format(time.RFC3339))
+	}
+}
+
+// ordered_put function writes a key of the replicated key-value store. The update is broadcast in total order
+// like border messages, so every process applies the puts in the same order and the replicas stay identical.
+func ordered_put(process *Process, key string, value string) {
+	put := PutMessage{Key: key, Value: value, Timestamp: process.clock.Tick(), ProcessID: process.ID}
+	if seqID, sent := requestOrder(process, "", &put); sent {
+		process.logger.Infof("Sent put %s=%s to sequencer %d, system time is: %s", key, value, seqID, process.wallTime().Format(time.RFC3339))
+	}
+}
+
+// requestOrder function hands a message or a key-value update to the sequencer. It reports whether a request
+// was sent over the network, which is not the case on the sequencer itself or without a connection to it.
+func requestOrder(process *Process, message string, put *PutMessage) (seqID int, sent bool) {
+	seqID = sequencerID(process.config)
+	// The sequencer does not need to send the request over the network
+	if seqID == process.ID {
+		sequenceBroadcast(process, process.ID, message, put)
+		return seqID, false
+	}
+	if _, ok := process.connections.Get(seqID); !ok {
+		process.logger.Errorf("No connection to sequencer process %d", seqID)
+		return seqID, false
+	}
+	msg := UnicastMessage{Kind: KindOrderRequest, SourceID: process.ID, Message: message, Put: put, Timestamp: process.clock.Tick()}
+	unicast_send_with_delay(process, seqID, msg, messageDelay(process, seqID))
+	return seqID, true
+}
+
+// sequenceBroadcast function is run by the sequencer: it assigns the next global sequence number to a message
+// or key-value update, multicasts it to every other process with independent random delays and delivers it locally.
+func sequenceBroadcast(process *Process, originID int, message string, put *PutMessage) {
+	sequenced := SequencedMessage{Seq: process.sequencer.Next(), OriginID: originID, Message: message, Put: put}
+	msg := UnicastMessage{Kind: KindSequenced, SourceID: process.ID, Timestamp: process.clock.Tick(), Sequenced: &sequenced}
+	for _, destinationID := range process.connections.IDs() {
+		if destinationID == process.ID {
+			continue
+		}
+		unicast_send_with_delay(process, destinationID, msg, messageDelay(process, destinationID))
+	}
+	process.total.Receive(sequenced, func(msg SequencedMessage) { deliverSequenced(process, msg) })
+}
+
+// deliverSequenced function prints a message delivered in total order, or applies a key-value update to the local replica.
+func deliverSequenced(process *Process, msg SequencedMessage) {
+	if msg.Put != nil {
+		// Later local puts must be newer than every put seen so far
+		process.clock.Update(msg.Put.Timestamp)
+		if !process.kv.Put(*msg.Put) {
+			process.logger.Infof("Ignored put %s=%s from process %d, a newer value is stored, timestamp is: %d, system time is: %s", msg.Put.Key, msg.Put.Value, msg.OriginID, msg.Put.Timestamp, process.wallTime().Format(time.RFC3339))
+			return
+		}
+		process.logger.Infof("Applied put %s=%s from process %d, sequence number is: %d, timestamp is: %d, system time is: %s", msg.Put.Key, msg.Put.Value, msg.OriginID, msg.Seq, msg.Put.Timestamp, process.wallTime().Format(time.RFC3339))
+		return
+	}
+	process.logger.Infof("Delivered ordered message: %s from process %d, sequence number is: %d, system time is: %s", msg.Message, msg.OriginID, msg.Seq, process.wallTime().Format(time.RFC3339))
+}
+
+// isis_multicast function multicasts a message in total order without a sequencer, using the ISIS agreement.
+// The message goes to every connected process; the sender takes part as a receiver too.
+func isis_multicast(process *Process, message string) {
+	destinations := process.connections.IDs()
+	msg := process.isis.Start(process.ID, message, destinations)
+	wire := UnicastMessage{Kind: KindISISMessage, SourceID: process.ID, Timestamp: process.clock.Tick(), ISIS: &msg}
+	for _, destinationID := range destinations {
+		unicast_send_with_delay(process, destinationID, wire, messageDelay(process, destinationID))
+	}
+	process.logger.Infof("Sent ISIS message %s: %s to %d processes, system time is: %s", msg.ID, message, len(destinations), process.wallTime().Format(time.RFC3339))
+	handleISISMessage(process, msg)
+}
+
+// handleISISMessage function proposes a sequence number for a message and sends the proposal to its origin.
+func handleISISMessage(process *Process, msg ISISMessage) {
+	proposal := process.isis.Propose(process.ID, msg)
+	if msg.OriginID == process.ID {
+		handleISISProposal(process, proposal)
+		return
+	}
+	reply := UnicastMessage{Kind: KindISISProposal, SourceID: process.ID, Timestamp: process.clock.Tick(), ISIS: &proposal}
+	unicast_send_with_delay(process, msg.OriginID, reply, messageDelay(process, msg.OriginID))
+}
+
+// handleISISProposal function is run by the origin of a message for every proposal. When all proposals
+// are in, it multicasts the highest one as the agreed sequence number and applies it locally.
+func handleISISProposal(process *Process, proposal ISISMessage) {
+	agreed, destinations, done := process.isis.AddProposal(proposal)
+	if !done {
+		return
+	}
+	msg := UnicastMessage{Kind: KindISISAgreed, SourceID: process.ID, Timestamp: process.clock.Tick(), ISIS: &agreed}
+	for _, destinationID := range destinations {
+		unicast_send_with_delay(process, destinationID, msg, messageDelay(process, destinationID))
+	}
+	process.isis.Agree(agreed, func(msg ISISMessage) { deliverISIS(process, msg) })
+}
+
+// deliverISIS function prints a message delivered in ISIS total order.
+func deliverISIS(process *Process, msg ISISMessage) {
+	process.logger.Infof("Delivered ISIS message: %s from process %d, agreed sequence number is: %d.%d, system time is: %s", msg.Message, msg.OriginID, msg.Seq, msg.ProposerID, process.wallTime().Format(time.RFC3339))
+}
+
+// unicast_receive function listens for incoming messages on a connection and handles each of them.
+// It returns the decoding error that ended the connection.
+func unicast_receive(process *Process, codec Codec) error {
+	// Hand the decoded messages to a separate goroutine, so slow handling does not hold up decoding.
+	// When the queue is full, decoding waits: messages are never dropped, and at most
+	// Config.InboundQueue of them are kept in memory.
+	inbox := make(chan UnicastMessage, process.config.InboundQueue)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for msg := range inbox {
+			handleMessage(process, msg)
+		}
+	}()
+	// Let the queued messages be handled before returning
+	defer func() {
+		close(inbox)
+		<-handled
+	}()
+	for {
+		// Create a new UnicastMessage struct to store the incoming message
+		msg := UnicastMessage{}
+		//  decoding the incoming message
+		err := codec.Decode(&msg)
+
+		if err != nil {
+			return err
+		}
+		// A batch is handled like the messages it contains, one after the other
+		batch := []UnicastMessage{msg}
+		if msg.Kind == KindBatch {
+			batch = msg.Batch
+		}
+		for _, msg := range batch {
+			if process.blocked.Blocked(msg.SourceID) {
+				process.stats.RecordDropped(msg.SourceID)
+				logBlocked(process, "from", msg.SourceID, msg)
+				continue
+			}
+			// A message from an older peer carries no nonce
+			if msg.Nonce != 0 && !process.tracker.MarkNonce(msg.SourceID, msg.Nonce) {
+				process.stats.RecordDropped(msg.SourceID)
+				process.logger.Errorf("dropped replayed message from process %d, nonce %x was seen before", msg.SourceID, msg.Nonce)
+				continue
+			}
+			process.stats.RecordReceived(msg.SourceID, msg)
+			// Only stamped messages carry a Lamport timestamp, control messages leave it at zero
+			if msg.Timestamp > 0 {
+				if outOfOrder, last := process.arrivals.Observe(msg.SourceID, msg.Timestamp); outOfOrder {
+					process.logger.Infof("WARNING: out-of-order message from P%d, logical time %d arrived after %d", msg.SourceID, msg.Timestamp, last)
+				}
+			}
+			msg, keep := process.Middleware.Apply(msg)
+			if !keep {
+				process.logger.Debugf("Middleware dropped a message from process %d", msg.SourceID)
+				continue
+			}
+			inbox <- msg
+		}
+	}
+}
+
+// handleMessage function handles one received message according to its kind.
+// Plain messages are held back until they are causally deliverable, and the local clock is advanced
+// past the timestamp carried by every delivered message. Ordered broadcast traffic is handed to the
+// sequencer or to the total order holdback buffer.
+func handleMessage(process *Process, msg UnicastMessage) {
+	switch msg.Kind {
+	case KindOrderRequest:
+		// Only the sequencer receives order requests
+		process.clock.Update(msg.Timestamp)
+		sequenceBroadcast(process, msg.SourceID, msg.Message, msg.Put)
+	case KindSequenced:
+		process.clock.Update(msg.Timestamp)
+		process.total.Receive(*msg.Sequenced, func(msg SequencedMessage) { deliverSequenced(process, msg) })
+	case KindHeartbeat:
+		if previous := process.detector.Heartbeat(msg.SourceID, process.Time.Now()); previous != StatusAlive {
+			process.logger.Infof("process %d is ALIVE again", msg.SourceID)
+			process.publish(EventPeerAlive, msg.SourceID, UnicastMessage{})
+		}
+	case KindGossip:
+		// Deliver and forward each gossip message only the first time it is seen
+		if process.tracker.MarkGossip(msg.Gossip.ID) {
+			process.logger.Infof("Received gossip %s: %s from process %d, system time is: %s", msg.Gossip.ID, msg.Gossip.Message, msg.Gossip.OriginID, process.wallTime().Format(time.RFC3339))
+			// Every hop uses up one unit of the TTL, a message that has none left stops here
+			forward := *msg.Gossip
+			forward.TTL--
+			if forward.TTL > 0 {
+				gossip_send(process, forward)
+			} else {
+				process.logger.Debugf("Not forwarding gossip %s, its TTL expired", forward.ID)
+			}
+		}
+	case KindHandshake:
+		// Only meaningful as the first message of a connection, handled by serveConn
+	case KindISISMessage:
+		process.clock.Update(msg.Timestamp)
+		handleISISMessage(process, *msg.ISIS)
+	case KindISISProposal:
+		process.clock.Update(msg.Timestamp)
+		handleISISProposal(process, *msg.ISIS)
+	case KindISISAgreed:
+		process.clock.Update(msg.Timestamp)
+		process.isis.Agree(*msg.ISIS, func(msg ISISMessage) { deliverISIS(process, msg) })
+	case KindJoinRequest:
+		// Answering may block on a slow newcomer, so do not block this connection
+		go handleJoinRequest(process, msg.SourceID, *msg.Join)
+	case KindJoinResponse:
+		go handleJoinResponse(process, msg.SourceID, *msg.Members)
+	case KindLeave:
+		handleLeave(process, msg.SourceID)
+	case KindLeaveAck:
+		process.mu.Lock()
+		acks := process.leaveAcks
+		process.mu.Unlock()
+		// An extra ack, e.g. a resent one, must not block the receive loop once the channel is full
+		select {
+		case acks <- msg.SourceID:
+		default:
+		}
+	case KindNak:
+		handleNak(process, msg.SourceID, *msg.Nak)
+	case KindMarker:
+		handleMarker(process, msg.SourceID, *msg.Marker)
+	case KindElection:
+		// A lower process is holding an election: stop it and hold our own
+		ok := UnicastMessage{Kind: KindOk, SourceID: process.ID, Ok: &OkMessage{ResponderID: process.ID}}
+		if err := unicast_send(process, msg.Election.CandidateID, ok); err != nil {
+			process.dropPeer(msg.Election.CandidateID, err)
+		}
+		start_election(process)
+	case KindOk:
+		process.election.Answer()
+	case KindPing:
+		// Answer right away and without the simulated delay, so the round trip measures the connection
+		receivedAt := process.wallTime()
+		pong := UnicastMessage{Kind: KindPong, SourceID: process.ID, Pong: &PongMessage{Nonce: msg.Ping.Nonce, SentAt: msg.Ping.SentAt, ReceivedAt: receivedAt}}
+		pong.Pong.RepliedAt = process.wallTime()
+		if err := unicast_send(process, msg.SourceID, pong); err != nil {
+			process.dropPeer(msg.SourceID, err)
+		}
+	case KindPong:
+		now := process.wallTime()
+		drift, ok := process.pings.Finish(msg.SourceID, msg.Pong.Nonce)
+		if !ok {
+			break
+		}
+		if !drift {
+			process.logger.Infof("Pong from process %d, round-trip time is: %s", msg.SourceID, now.Sub(msg.Pong.SentAt))
+			break
+		}
+		// A peer speaking an older version of the pong leaves its clock readings out
+		if msg.Pong.ReceivedAt.IsZero() {
+			process.logger.Errorf("process %d did not report its clock, cannot estimate the offset", msg.SourceID)
+			break
+		}
+		offset, rtt := clockOffset(msg.Pong.SentAt, msg.Pong.ReceivedAt, msg.Pong.RepliedAt, now)
+		direction := "ahead of"
+		if offset < 0 {
+			direction, offset = "behind", -offset
+		}
+		process.logger.Infof("Clock of process %d is %s %s this process, round-trip time is: %s", msg.SourceID, offset, direction, rtt)
+	case KindLockRequest:
+		process.clock.Update(msg.Timestamp)
+		if process.mutex.Receive(process.ID, msg.SourceID, msg.LockReq.Timestamp) {
+			replyLock(process, msg.SourceID, msg.LockReq.Timestamp)
+		}
+	case KindLockReply:
+		process.clock.Update(msg.Timestamp)
+		if process.mutex.Reply(msg.SourceID, msg.LockReply.RequestTimestamp) {
+			enteredLock(process)
+		}
+	case KindToken:
+		receiveToken(process, *msg.Token)
+	case KindCoordinator:
+		process.election.SetLeader(msg.Leader.LeaderID)
+		process.logger.Infof("Process %d is the leader, system time is: %s", msg.Leader.LeaderID, process.wallTime().Format(time.RFC3339))
+		process.publish(EventLeaderElected, msg.Leader.LeaderID, UnicastMessage{})
+	case KindAck:
+		if process.acks.Ack(msg.SourceID, msg.Ack.Seq) {
+			process.sendSucceeded(msg.SourceID)
+			process.logger.Infof("ACK received for seq %d from process %d", msg.Ack.Seq, msg.SourceID)
+			traceEvent(process, TraceAcked, UnicastMessage{Seq: msg.Ack.Seq}, msg.SourceID)
+		}
+		if message, acked, total, committed := process.quorum.Ack(msg.SourceID, msg.Ack.Seq); committed {
+			process.logger.Infof("Message committed: %s, acknowledged by %d of %d processes, system time is: %s", message, acked, total, process.wallTime().Format(time.RFC3339))
+		}
+	default:
+		traceEvent(process, TraceReceive, msg, msg.SourceID)
+		// Without retransmission a missing message never arrives, so nothing is acknowledged or held back
+		if !process.config.atLeastOnce() {
+			deliverOnArrival(process, msg)
+			return
+		}
+		// Acknowledge the message over the connection back to its sender
+		ack := UnicastMessage{Kind: KindAck, SourceID: process.ID, Ack: &AckMessage{SenderID: msg.SourceID, Seq: msg.Seq}, Priority: PriorityControl}
+		// A duplicate is still acknowledged, since its first ack may have been lost
+		if err := unicast_send(process, msg.SourceID, ack); err != nil {
+			process.dropPeer(msg.SourceID, err)
+		}
+		traceEvent(process, TraceAck, msg, msg.SourceID)
+		// Silently drop retransmitted copies of messages that were already received
+		if !process.tracker.MarkSeen(msg.SourceID, msg.Seq) {
+			return
+		}
+		// An unordered message is delivered right away, but still passes through the FIFO queue below,
+		// which would otherwise wait for its sequence number forever
+		released := msg.Ordering == OrderingNone
+		if released {
+			deliverMessage(process, msg)
+		}
+		// isMsg reports whether a message handed on by a holdback queue is the one that just arrived
+		isMsg := func(other UnicastMessage) bool { return other.SourceID == msg.SourceID && other.Seq == msg.Seq }
+		// Put the messages of the source back in send order, then hand causal ones to the causal holdback queue,
+		// which delivers them once their dependencies are met
+		from, to, missing := process.fifo.Receive(msg, func(msg UnicastMessage) {
+			// Count the message for the snapshots before it is delivered, in send order
+			for _, snapshot := range process.snapshots.Receive(msg) {
+				saveSnapshot(process, snapshot)
+			}
+			switch msg.Ordering {
+			case OrderingNone:
+				// Delivered when it arrived
+			case OrderingFIFO:
+				released = released || isMsg(msg)
+				deliverMessage(process, msg)
+			default:
+				process.causal.Receive(msg, func(msg UnicastMessage) {
+					released = released || isMsg(msg)
+					deliverMessage(process, msg)
+				})
+			}
+		})
+		if !released {
+			traceEvent(process, TraceBuffer, msg, msg.SourceID)
+		}
+		// Ask the source for the messages that did not arrive, instead of waiting for it to time out
+		if missing {
+			nak := UnicastMessage{Kind: KindNak, SourceID: process.ID, Nak: &NakMessage{SenderID: msg.SourceID, From: from, To: to}, Priority: PriorityControl}
+			if err := unicast_send(process, msg.SourceID, nak); err != nil {
+				process.dropPeer(msg.SourceID, err)
+			}
+		}
+	}
+}
+
+// deliverOnArrival function delivers a plain message as soon as it arrives, for at-most-once delivery.
+// Its vector is still merged into the local clock, but neither FIFO nor causal order is restored.
+func deliverOnArrival(process *Process, msg UnicastMessage) {
+	for _, snapshot := range process.snapshots.Receive(msg) {
+		saveSnapshot(process, snapshot)
+	}
+	process.causal.Merge(msg.Vector)
+	deliverMessage(process, msg)
+}
+
+// DeliveryGate struct holds plain messages back from the application while delivery is paused. The held
+// messages are delivered in the order they reached the gate by a goroutine waiting on cond, so a message
+// that arrives while they are being delivered queues up behind them instead of overtaking them. A message
+// stays held until it is delivered, so the last one is not overtaken either.
+type DeliveryGate struct {
+	mu     sync.Mutex       // Protects paused, held and closed
+	cond   *sync.Cond       // Signaled when delivery resumes, a message is held or the gate closes
+	paused bool             // Whether delivery is paused
+	held   []UnicastMessage // Messages waiting to be delivered, in arrival order
+	closed bool             // Whether the process shut down
+}
+
+// NewDeliveryGate function creates an open gate.
+func NewDeliveryGate() *DeliveryGate {
+	g := &DeliveryGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Pause function stops delivery. It reports whether delivery was running.
+func (g *DeliveryGate) Pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	wasRunning := !g.paused
+	g.paused = true
+	return wasRunning
+}
+
+// Resume function lets the held messages through. It returns how many are waiting, or -1 if delivery
+// was not paused.
+func (g *DeliveryGate) Resume() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return -1
+	}
+	g.paused = false
+	g.cond.Broadcast()
+	return len(g.held)
+}
+
+// Hold function keeps a message back if delivery is paused or earlier messages are still waiting.
+// It reports whether it did, otherwise the caller delivers the message itself.
+func (g *DeliveryGate) Hold(msg UnicastMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused && len(g.held) == 0 {
+		return false
+	}
+	g.held = append(g.held, msg)
+	g.cond.Broadcast()
+	return true
+}
+
+// Next function waits until delivery runs and a message is held, and returns the first one without removing it.
+// It returns false once the gate is closed.
+func (g *DeliveryGate) Next() (UnicastMessage, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for !g.closed && (g.paused || len(g.held) == 0) {
+		g.cond.Wait()
+	}
+	if g.closed {
+		return UnicastMessage{}, false
+	}
+	return g.held[0], true
+}
+
+// Done function removes the message Next returned, once it has been delivered.
+func (g *DeliveryGate) Done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.held = g.held[1:]
+}
+
+// Close function wakes up Next for good, the messages still held are never delivered.
+func (g *DeliveryGate) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	g.cond.Broadcast()
+}
+
+// releaseLoop function delivers the messages the delivery gate held back, until the process shuts down.
+func releaseLoop(process *Process) {
+	for {
+		msg, ok := process.gate.Next()
+		if !ok {
+			return
+		}
+		releaseMessage(process, msg)
+		process.gate.Done()
+	}
+}
+
+// deliverMessage function delivers a plain message to the application, unless delivery is paused,
+// in which case the delivery gate holds it back until the resume command.
+func deliverMessage(process *Process, msg UnicastMessage) {
+	if process.gate.Hold(msg) {
+		return
+	}
+	releaseMessage(process, msg)
+}
+
+// releaseMessage function hands a plain message to the application: it records it in the message log,
+// prints it and hands it to the DeliveryHandler of the process, if there is one.
+func releaseMessage(process *Process, msg UnicastMessage) {
+	// A message that is no longer useful is dropped without touching the logical clock. The deadline was set
+	// without the sender's clock skew, so it is compared without the skew of this process either
+	if now := process.Time.Now(); !msg.Deadline.IsZero() && now.After(msg.Deadline) {
+		process.stats.RecordExpired(msg.SourceID)
+		process.logger.Infof("Expired message: %s from process %d, %s past its deadline, system time is: %s", msg.Message, msg.SourceID, now.Sub(msg.Deadline).Round(time.Millisecond), process.wallTime().Format(time.RFC3339))
+		return
+	}
+	// Apply the Lamport receive rule
+	logicalTime := process.clock.Update(msg.Timestamp)
+	traceEvent(process, TraceClock, msg, msg.SourceID)
+	now := process.wallTime()
+	// Record the delivery in the message log before printing it
+	if process.messageLog != nil {
+		entry := LogEntry{SourceID: msg.SourceID, Message: msg.Message, LogicalTime: logicalTime, SystemTime: now}
+		if err := process.messageLog.Append(entry); err != nil {
+			process.logger.Errorf("could not write message log: %v", err)
+		}
+	}
+	// Only causal messages carry the vector timestamp the verify command checks
+	if msg.Ordering == "" || msg.Ordering == OrderingCausal {
+		process.trace.Record(msg)
+	}
+	traceEvent(process, TraceDeliver, msg, msg.SourceID)
+	// Print the received message, the sender's process ID, the logical time and the current time
+	process.logger.Infof("Received message: %s from process %d, logical time is: %d, vector time is: %s, system time is: %s", msg.Message, msg.SourceID, logicalTime, msg.Vector, now.Format(time.RFC3339))
+	if process.DeliveryHandler != nil {
+		process.DeliveryHandler(msg)
+	}
+	process.publish(EventMessageDelivered, msg.SourceID, msg)
+}
+
+// handleNak function resends the messages a destination reported as missing, as far as they are still
+// in the send history, each with the usual random delay.
+func handleNak(process *Process, destinationID int, nak NakMessage) {
+	process.logger.Debugf("NAK received for seq %d-%d from process %d", nak.From, nak.To, destinationID)
+	for _, msg := range process.history.Get(destinationID, nak.From, nak.To) {
+		unicast_send_with_delay(process, destinationID, msg, messageDelay(process, destinationID))
+	}
+}
+
+// ping function sends a ping to a peer, without the simulated delay. The round-trip time is printed when the pong
+// arrives, and with drift also the estimated offset between the clocks of the two processes.
+func ping(process *Process, peerID int, drift bool) error {
+	nonce := process.pings.Start(peerID, drift)
+	msg := UnicastMessage{Kind: KindPing, SourceID: process.ID, Ping: &PingMessage{Nonce: nonce, SentAt: process.wallTime()}}
+	if err := unicast_send(process, peerID, msg); err != nil {
+		process.pings.Cancel(nonce)
+		return err
+	}
+	return nil
+}
+
+// clockOffset function estimates, as NTP does, how far the clock of a peer is ahead of the local clock from the
+// four times of a ping exchange: the ping sent and the pong received by the local clock, the ping received and the
+// pong sent by the peer's clock. It also returns the round-trip time without the time the peer took to answer.
+// The estimate is exact when both directions take equally long.
+func clockOffset(sent time.Time, peerReceived time.Time, peerReplied time.Time, received time.Time) (time.Duration, time.Duration) {
+	offset := (peerReceived.Sub(sent) + peerReplied.Sub(received)) / 2
+	rtt := received.Sub(sent) - peerReplied.Sub(peerReceived)
+	return offset, rtt
+}
+
+// start_snapshot function starts a new Chandy-Lamport snapshot of the global state, initiated by this process.
+func start_snapshot(process *Process) {
+	id := process.snapshots.NextID(process.ID)
+	process.logger.Infof("Started snapshot %s, system time is: %s", id, process.wallTime().Format(time.RFC3339))
+	recordSnapshot(process, id)
+}
+
+// recordSnapshot function records the local state of the process for a snapshot and sends a marker on every
+// outgoing channel. It does nothing if the process already recorded that snapshot.
+func recordSnapshot(process *Process, id string) {
+	var peers []int
+	for _, peerID := range process.connections.IDs() {
+		if peerID != process.ID {
+			peers = append(peers, peerID)
+		}
+	}
+	snapshot := &Snapshot{ID: id, ProcessID: process.ID, LogicalTime: process.clock.Time(), VectorTime: process.causal.Vector(), Sent: make(map[int]int)}
+	for _, peerID := range peers {
+		snapshot.Sent[peerID] = process.acks.LastSeq(peerID)
+	}
+	recorded, completed := process.snapshots.Record(snapshot, peers)
+	if !recorded {
+		return
+	}
+	// Markers are sent without delay, every plain message sent from now on comes after them on the connection
+	for _, peerID := range peers {
+		marker := UnicastMessage{Kind: KindMarker, SourceID: process.ID, Marker: &MarkerMessage{SnapshotID: id, LastSeq: snapshot.Sent[peerID]}}
+		if err := unicast_send(process, peerID, marker); err != nil {
+			process.dropPeer(peerID, err)
+		}
+	}
+	if completed != nil {
+		saveSnapshot(process, completed)
+	}
+}
+
+// handleMarker function handles a snapshot marker from a peer. The first marker of a snapshot makes the process
+// record its own state; every marker closes the channel it arrived on.
+func handleMarker(process *Process, peerID int, marker MarkerMessage) {
+	recordSnapshot(process, marker.SnapshotID)
+	if completed := process.snapshots.Marker(peerID, marker); completed != nil {
+		saveSnapshot(process, completed)
+	}
+}
+
+// snapshotFile function returns the name of the file a process writes its part of a snapshot to.
+func snapshotFile(processID int, snapshotID string) string {
+	return fmt.Sprintf("snapshot_%d_%s.json", processID, snapshotID)
+}
+
+// saveSnapshot function writes the completed part of a snapshot recorded by the process to its file.
+func saveSnapshot(process *Process, snapshot *Snapshot) {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err == nil {
+		err = os.WriteFile(snapshotFile(process.ID, snapshot.ID), append(data, '\n'), 0644)
+	}
+	if err != nil {
+		process.logger.Errorf("could not write snapshot %s: %v", snapshot.ID, err)
+		return
+	}
+	process.logger.Infof("Recorded snapshot %s in %s, system time is: %s", snapshot.ID, snapshotFile(process.ID, snapshot.ID), process.wallTime().Format(time.RFC3339))
+}
+
+// start_election function starts a Bully election in the background, unless the process is already holding one.
+func start_election(process *Process) {
+	round, started := process.election.Start()
+	if !started {
+		return
+	}
+	go runElection(process, round)
+}
+
+// runElection function holds a Bully election. The process sends an election message to every process with
+// a higher ID. If none answers within ElectionTimeout it is the highest live process and announces itself as leader.
+// Otherwise a higher process took over; if its announcement does not arrive within CoordinatorTimeout,
+// the election starts over.
+func runElection(process *Process, round int) {
+	process.logger.Infof("Started an election, system time is: %s", process.wallTime().Format(time.RFC3339))
+	election := UnicastMessage{Kind: KindElection, SourceID: process.ID, Election: &ElectionMessage{CandidateID: process.ID}}
+	higher := 0
+	for _, peerID := range process.connections.IDs() {
+		if peerID > process.ID {
+			if err := unicast_send(process, peerID, election); err != nil {
+				process.dropPeer(peerID, err)
+				continue
+			}
+			higher++
+		}
+	}
+	if higher > 0 && !waitElection(process, ElectionTimeout) {
+		return
+	}
+	if higher == 0 || !process.election.Answered() {
+		// Only finish after the announcement, so an election message arriving meanwhile does not start another one
+		announceLeader(process)
+		process.election.Finish()
+		return
+	}
+	// A higher process is holding the election now, wait for it to announce the winner
+	if !waitElection(process, CoordinatorTimeout) {
+		return
+	}
+	process.election.Finish()
+	if _, current := process.election.Leader(); current == round {
+		process.logger.Infof("No leader was announced, starting over")
+		start_election(process)
+	}
+}
+
+// waitElection function pauses a running election, returning false if the process shut down meanwhile.
+func waitElection(process *Process, timeout time.Duration) bool {
+	select {
+	case <-process.done:
+		return false
+	case <-process.Time.After(timeout):
+		return true
+	}
+}
+
+// announceLeader function makes the process the leader and announces it to every peer.
+func announceLeader(process *Process) {
+	process.election.SetLeader(process.ID)
+	msg := UnicastMessage{Kind: KindCoordinator, SourceID: process.ID, Leader: &CoordinatorMessage{LeaderID: process.ID}}
+	for _, peerID := range process.connections.IDs() {
+		if err := unicast_send(process, peerID, msg); err != nil {
+			process.dropPeer(peerID, err)
+		}
+	}
+	process.logger.Infof("Elected as the leader, system time is: %s", process.wallTime().Format(time.RFC3339))
+	process.publish(EventLeaderElected, process.ID, UnicastMessage{})
+}
+
+// request_lock function asks every connected peer for the distributed lock, following Ricart-Agrawala.
+// The request is sent without the simulated delay, like the election messages, and the process enters the
+// critical section once every peer asked has replied. A peer that crashes without replying keeps it waiting.
+// With the token-ring mutex option the process waits for the token instead.
+func request_lock(process *Process) error {
+	if process.config.Mutex == MutexTokenRing {
+		return request_token(process)
+	}
+	var peerIDs []int
+	for _, peerID := range process.connections.IDs() {
+		if peerID != process.ID {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	timestamp := process.clock.Tick()
+	held, err := process.mutex.Request(timestamp, peerIDs)
+	if err != nil {
+		return err
+	}
+	if held {
+		enteredLock(process)
+		return nil
+	}
+	process.logger.Infof("Requested the lock at logical time %d, waiting for %d replies", timestamp, len(peerIDs))
+	msg := UnicastMessage{Kind: KindLockRequest, SourceID: process.ID, Timestamp: timestamp, LockReq: &LockRequestMessage{Timestamp: timestamp}}
+	for _, peerID := range peerIDs {
+		if err := unicast_send(process, peerID, msg); err != nil {
+			process.dropPeer(peerID, err)
+			// A peer that cannot be asked cannot be in the critical section either
+			if process.mutex.Cancel(peerID) {
+				enteredLock(process)
+			}
+		}
+	}
+	return nil
+}
+
+// release_lock function leaves the critical section and answers every request deferred while the lock was held,
+// or passes the token on with the token-ring mutex option.
+func release_lock(process *Process) error {
+	if process.config.Mutex == MutexTokenRing {
+		if err := process.ring.Release(); err != nil {
+			return err
+		}
+		process.logger.Infof("Left the critical section, system time is: %s", process.wallTime().Format(time.RFC3339))
+		passToken(process)
+		return nil
+	}
+	deferred, err := process.mutex.Release()
+	if err != nil {
+		return err
+	}
+	process.logger.Infof("Left the critical section, system time is: %s", process.wallTime().Format(time.RFC3339))
+	for peerID, timestamp := range deferred {
+		replyLock(process, peerID, timestamp)
+	}
+	return nil
+}
+
+// replyLock function grants a peer's lock request.
+func replyLock(process *Process, peerID int, requestTimestamp int) {
+	msg := UnicastMessage{Kind: KindLockReply, SourceID: process.ID, Timestamp: process.clock.Tick(), LockReply: &LockReplyMessage{RequestTimestamp: requestTimestamp}}
+	if err := unicast_send(process, peerID, msg); err != nil {
+		process.dropPeer(peerID, err)
+	}
+}
+
+// request_token function asks for the lock in token ring mode. The process enters the critical section
+// right away if it has the token, otherwise when the token reaches it.
+func request_token(process *Process) error {
+	held, err := process.ring.Request()
+	if err != nil {
+		return err
+	}
+	if held {
+		enteredLock(process)
+	} else {
+		process.logger.Infof("Requested the lock, waiting for the token")
+	}
+	return nil
+}
+
+// receiveToken function takes the token. A process waiting for the lock enters the critical section and keeps
+// the token until it unlocks; any other process passes it on after TokenHoldTime.
+func receiveToken(process *Process, token TokenMessage) {
+	accepted, entered := process.ring.Receive(token)
+	if !accepted {
+		process.logger.Debugf("Dropping a stale token of generation %d", token.Generation)
+		return
+	}
+	process.logger.Debugf("Received the token, generation %d", token.Generation)
+	if entered {
+		enteredLock(process)
+		return
+	}
+	go holdToken(process)
+}
+
+// holdToken function waits TokenHoldTime and passes the token on, unless the process crashes or shuts down meanwhile.
+func holdToken(process *Process) {
+	alive := process.aliveSignal()
+	select {
+	case <-process.done:
+	case <-alive:
+	case <-process.Time.After(TokenHoldTime):
+		passToken(process)
+	}
+}
+
+// passToken function passes the token to the next process of the ring: the next higher member ID that is
+// connected and not FAILED, wrapping around to the lowest. Without such a process the token is kept and
+// passing is tried again later. A token that cannot be sent comes back to this process.
+func passToken(process *Process) {
+	nextID, ok := nextInRing(process)
+	if !ok {
+		go holdToken(process)
+		return
+	}
+	token, ok := process.ring.Pass(nextID)
+	if !ok {
+		return
+	}
+	msg := UnicastMessage{Kind: KindToken, SourceID: process.ID, Token: &token}
+	if err := unicast_send(process, nextID, msg); err != nil {
+		process.dropPeer(nextID, err)
+		receiveToken(process, token)
+	}
+}
+
+// nextInRing function returns the process the token goes to next, reporting false if there is none.
+func nextInRing(process *Process) (int, bool) {
+	status := process.detector.Members()
+	var ring []int
+	for _, member := range process.memberList() {
+		if member.ID == process.ID || status[member.ID] == StatusFailed {
+			continue
+		}
+		if _, ok := process.connections.Get(member.ID); ok {
+			ring = append(ring, member.ID)
+		}
+	}
+	if len(ring) == 0 {
+		return 0, false
+	}
+	// The member list is sorted, so the first ID above ours is the successor
+	for _, id := range ring {
+		if id > process.ID {
+			return id, true
+		}
+	}
+	return ring[0], true
+}
+
+// enteredLock function reports that the process holds the lock.
+func enteredLock(process *Process) {
+	process.logger.Infof("Entered the critical section, system time is: %s", process.wallTime().Format(time.RFC3339))
+}
+
+// retransmitLoop function runs in the background for one peer and resends every message whose ack deadline
+// has passed, with the usual random delay. After Config.Retransmit.MaxRetries resends a message is reported as
+// permanently failed and forgotten. The loop ends when the process shuts down or crashes.
+func retransmitLoop(process *Process, peerID int) {
+	alive := process.aliveSignal()
+	retransmit := process.config.Retransmit
+	// Scan several times per timeout so a late message is resent soon after its deadline
+	for {
+		select {
+		case <-process.done:
+			return
+		case <-alive:
+			return
+		case now := <-process.Time.After(retransmit.Timeout / 4):
+			resend, failed := process.acks.Expired(peerID, now, retransmit.MaxRetries)
+			for _, msg := range resend {
+				process.logger.Debugf("Retransmitting seq %d to process %d", msg.Seq, peerID)
+				unicast_send_with_delay(process, peerID, msg, messageDelay(process, peerID))
+			}
+			for _, msg := range failed {
+				process.logger.Errorf("message seq %d to process %d was not acknowledged after %d retries, giving up", msg.Seq, peerID, retransmit.MaxRetries)
+				process.deadLetter(peerID, msg, fmt.Sprintf("not acknowledged after %d retries", retransmit.MaxRetries))
+				process.sendFailed(peerID)
+			}
+		}
+	}
+}
+
+// heartbeatLoop function multicasts a heartbeat to every peer each Config.HeartbeatInterval, give or take
+// the jitter of heartbeatDelay, and updates the failure detector, logging every status change. The loop ends when the process shuts down or crashes.
+func heartbeatLoop(process *Process) {
+	alive := process.aliveSignal()
+	process.detector.Reset(process.Time.Now())
+	count := 0
+	for {
+		select {
+		case <-process.done:
+			return
+		case <-alive:
+			return
+		case now := <-process.Time.After(heartbeatDelay(process)):
+			count++
+			msg := UnicastMessage{Kind: KindHeartbeat, SourceID: process.ID, Heartbeat: &HeartbeatMessage{Count: count}, Priority: PriorityControl}
+			for _, peerID := range process.connections.IDs() {
+				if err := unicast_send(process, peerID, msg); err != nil {
+					process.dropPeer(peerID, err)
+				}
+			}
+			for peerID, status := range process.detector.Check(now) {
+				process.logger.Infof("process %d is %s", peerID, status)
+				if status == StatusFailed {
+					process.publish(EventPeerFailed, peerID, UnicastMessage{})
+				} else if status == StatusSuspected {
+					process.publish(EventPeerSuspected, peerID, UnicastMessage{})
+				}
+				// Replace a leader that crashed
+				if leaderID, _ := process.election.Leader(); status == StatusFailed && peerID == leaderID {
+					start_election(process)
+				}
+				// Replace a token that was lost with the process it was passed to
+				if status == StatusFailed {
+					if token, ok := process.ring.Regenerate(peerID); ok {
+						process.logger.Infof("The token was lost with process %d, regenerating it", peerID)
+						receiveToken(process, token)
+					}
+				}
+			}
+		}
+	}
+}
+
+// heartbeatDelay function returns the time until the next heartbeat: Config.HeartbeatInterval, shortened or
+// lengthened by a random fraction of up to Config.HeartbeatJitter, so processes started together do not keep
+// sending their heartbeats at the same moments.
+func heartbeatDelay(process *Process) time.Duration {
+	interval := process.config.HeartbeatInterval
+	jitter := process.config.HeartbeatJitter * (2*process.rng.Float64() - 1)
+	return interval + time.Duration(jitter*float64(interval))
+}
+
+// reconnectLoop function checks the connections every Config.ReconnectInterval. A connection to a peer the
+// failure detector marks FAILED is dropped, since writes to a peer that is gone can keep succeeding on a
+// half-open connection, unless the peer is only blocked. Every member with a lower ID that has no connection is
+// then dialed once; members with a higher ID dial this process, so each pair has a single dialing side, as at
+// startup. The loop ends when the process shuts down or crashes.
+func reconnectLoop(process *Process) {
+	alive := process.aliveSignal()
+	once := RetryPolicy{MaxAttempts: 1}
+	for {
+		select {
+		case <-process.done:
+			return
+		case <-alive:
+			return
+		case <-process.Time.After(process.config.ReconnectInterval):
+			for peerID, status := range process.detector.Members() {
+				if status == StatusFailed && !process.blocked.Blocked(peerID) {
+					if process.connections.Remove(peerID) {
+						process.logger.Infof("Dropped the connection to process %d, it sends no heartbeats", peerID)
+					}
+				}
+			}
+			for _, member := range process.memberList() {
+				if member.ID >= process.ID {
+					continue
+				}
+				if _, ok := process.connections.Get(member.ID); ok {
+					continue
+				}
+				if err := connectPeer(process, member, once); err != nil {
+					process.logger.Debugf("could not reconnect to process %d: %v", member.ID, err)
+					continue
+				}
+				process.logger.Infof("Reconnected to process %d", member.ID)
+			}
+		}
+	}
+}
+
+// printConnections function prints every connection, ordered by process ID,
+// with its remote address, the outcome of the last write and the state of its circuit breaker, followed by the
+// peers whose breaker tripped and that have no connection.
+func printConnections(process *Process) {
+	now := process.Time.Now()
+	process.connections.Range(func(id int, peer *peerConn) bool {
+		messages, writes := peer.writeCounts()
+		fmt.Printf("Process %d: remote address %s, last write %s, %d messages in %d writes, circuit breaker %s\n", id, peer.conn.RemoteAddr(), peer.lastWrite(), messages, writes, process.breaker.State(id, now))
+		return true
+	})
+	// A peer whose breaker tripped may have no connection left
+	for _, id := range process.breaker.Tripped() {
+		if _, connected := process.connections.Get(id); !connected {
+			fmt.Printf("Process %d: not connected, circuit breaker %s\n", id, process.breaker.State(id, now))
+		}
+	}
+}
+
+// printStats function prints a table of the traffic exchanged with every peer, ordered by process ID.
+func printStats(process *Process) {
+	stats := process.stats.Snapshot()
+	ids := make([]int, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	fmt.Printf("%-8s %8s %8s %8s %8s %12s %12s  %s\n", "Process", "Sent", "Received", "Dropped", "Expired", "Bytes sent", "Bytes recv", "Last activity")
+	for _, id := range ids {
+		peer := stats[id]
+		fmt.Printf("%-8d %8d %8d %8d %8d %12d %12d  %s\n", id, peer.Sent, peer.Received, peer.Dropped, peer.Expired, peer.BytesSent, peer.BytesReceived, peer.LastActivity.Format(time.RFC3339))
+	}
+}
+
+// printMembers function prints the failure detector's view of every peer, ordered by process ID.
+func printMembers(process *Process) {
+	members := process.detector.Members()
+	ids := make([]int, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Printf("Process %d: %s\n", id, members[id])
+	}
+}
+
+// printCluster function prints the address of every member, ordered by process ID. The membership starts as
+// the configured processes and follows joins and leaves.
+func printCluster(process *Process) {
+	for _, member := range process.memberList() {
+		suffix := ""
+		if member.ID == process.ID {
+			suffix = " (this process)"
+		}
+		fmt.Printf("Process %d: %s%s\n", member.ID, net.JoinHostPort(member.IP, member.Port), suffix)
+	}
+}
+
+// formatConfig function writes a configuration in the plain text format ParseConfig reads: the delays,
+// the option lines and one line per process, with the bind address only where it differs from the IP.
+func formatConfig(minDelay int, maxDelay int, optionLines []string, processes []Process) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %d\n", minDelay, maxDelay)
+	for _, line := range optionLines {
+		fmt.Fprintln(&b, line)
+	}
+	for _, process := range processes {
+		fmt.Fprintf(&b, "%d %s %s", process.ID, process.IP, process.Port)
+		if process.BindAddr != "" && process.BindAddr != process.IP {
+			fmt.Fprintf(&b, " %s", process.BindAddr)
+		}
+		fmt.Fprintln(&b)
+	}
+	return b.String()
+}
+
+// saveConfig function writes the current membership, including processes that joined or without those that
+// left, to a config file, so the cluster can be restarted as it is now. The delays are the current ones of the
+// process; the options are those read from its configuration. It returns the number of processes written.
+func saveConfig(process *Process, filename string) (int, error) {
+	minDelay, maxDelay := process.delays.Get()
+	members := process.memberList()
+	if err := os.WriteFile(filename, []byte(formatConfig(minDelay, maxDelay, process.config.OptionLines, members)), 0644); err != nil {
+		return 0, err
+	}
+	return len(members), nil
+}
+
+// Codec interface encodes and decodes the messages on one connection. Both ends of a connection
+// must use the same codec.
+type Codec interface {
+	Encode(msg UnicastMessage) error  // Writes a message, called by the writer goroutine of the connection only
+	Decode(msg *UnicastMessage) error // Reads the next message, called by the receive loop only
+}
+
+// Codecs accepted by the codec option.
+const (
+	CodecGob  = "gob"  // Go's gob stream, only understood by Go peers
+	CodecJSON = "json" // Length-prefixed JSON frames, for peers written in other languages
+)
+
+// NewCodec function creates the codec with the given name for a connection, gob if the name is unknown.
+// Decoding fails with errMessageTooLarge on a message longer than maxBytes.
+func NewCodec(name string, stream io.ReadWriter, maxBytes int) Codec {
+	if name == CodecJSON {
+		return NewJSONCodec(stream, maxBytes)
+	}
+	return NewGobCodec(stream, maxBytes)
+}
+
+// errMessageTooLarge is returned for a message larger than Config.MaxMessageBytes.
+var errMessageTooLarge = errors.New("message too large")
+
+// errIsolated is returned for a send from a process that is the only member of the cluster.
+var errIsolated = errors.New("running as isolated node; no peers configured")
+
+// errUnknownDestination is returned for a send to a process that is neither connected nor a member of the cluster.
+var errUnknownDestination = errors.New("not a member of the cluster")
+
+// errShuttingDown is returned for a send from a process that is shutting down.
+var errShuttingDown = errors.New("shutting down")
+
+// errCircuitOpen is returned for a send to a peer whose circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// errOutboxFull is returned for a send to a member without a connection whose outbox has no room left.
+var errOutboxFull = errors.New("outbox is full")
+
+// messageLimiter struct is a buffered reader that lets at most limit bytes be read per message. The gob
+// decoder reads through it directly, since it is an io.ByteReader, so exactly the bytes of the messages
+// are counted and an oversized one is cut off before it is read into memory.
+type messageLimiter struct {
+	reader    *bufio.Reader // Buffered reader on the connection
+	limit     int           // Bytes allowed per message
+	remaining int           // Bytes left for the message being decoded
+}
+
+// newMessageLimiter function creates a limiter reading from stream.
+func newMessageLimiter(stream io.Reader, limit int) *messageLimiter {
+	return &messageLimiter{reader: bufio.NewReader(stream), limit: limit}
+}
+
+// reset function starts counting a new message.
+func (l *messageLimiter) reset() {
+	l.remaining = l.limit
+}
+
+// Read function reads at most the bytes left for the current message.
+func (l *messageLimiter) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", errMessageTooLarge, l.limit)
+	}
+	if len(p) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= n
+	return n, err
+}
+
+// ReadByte function reads one byte of the current message.
+func (l *messageLimiter) ReadByte() (byte, error) {
+	if l.remaining <= 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", errMessageTooLarge, l.limit)
+	}
+	b, err := l.reader.ReadByte()
+	if err == nil {
+		l.remaining--
+	}
+	return b, err
+}
+
+// negotiateCodec function agrees with the peer on the compression of a new connection and creates its codec.
+// Before any message, both ends write one byte telling whether they want compression and read the byte of
+// the other end. The connection is compressed only if both want it, so the two ends always agree.
+func negotiateCodec(conn net.Conn, config *Config) (Codec, error) {
+	want := []byte{0}
+	if config.Compression {
+		want[0] = 1
+	}
+	// Do not wait forever for a peer that never answers, the accept loop waits too.
+	// The deadline covers the write, since on a TLS connection the first write runs the TLS handshake.
+	conn.SetDeadline(time.Now().Add(NegotiationTimeout))
+	defer conn.SetDeadline(time.Time{})
+	// Write while reading, since a write on an unbuffered connection such as net.Pipe only ends when the peer reads
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(want)
+		written <- err
+	}()
+	peerWants := make([]byte, 1)
+	_, err := io.ReadFull(conn, peerWants)
+	if writeErr := <-written; writeErr != nil {
+		return nil, writeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Compression && peerWants[0] == 1 {
+		return NewCodec(config.Codec, newCompressedStream(conn), config.MaxMessageBytes), nil
+	}
+	return NewCodec(config.Codec, conn, config.MaxMessageBytes), nil
+}
+
+// compressedStream struct gzips a connection in both directions. Every write is flushed right away,
+// so the peer can decode a message as soon as it is sent.
+type compressedStream struct {
+	conn   net.Conn     // Underlying network connection
+	writer *gzip.Writer // Compresses what is written to conn
+	reader *gzip.Reader // Decompresses what is read from conn, created by the first read
+}
+
+// newCompressedStream function wraps a connection in a gzip stream.
+func newCompressedStream(conn net.Conn) *compressedStream {
+	return &compressedStream{conn: conn, writer: gzip.NewWriter(conn)}
+}
+
+// Write function compresses p and flushes it to the connection.
+func (s *compressedStream) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.writer.Flush()
+}
+
+// Read function reads decompressed data. The gzip reader is only created here, since creating it reads
+// the gzip header, which blocks until the peer writes its first message.
+func (s *compressedStream) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		reader, err := gzip.NewReader(s.conn)
+		if err != nil {
+			return 0, err
+		}
+		s.reader = reader
+	}
+	return s.reader.Read(p)
+}
+
+// GobCodec struct encodes messages as a gob stream.
+type GobCodec struct {
+	encoder *gob.Encoder    // Encoder writing to the connection
+	decoder *gob.Decoder    // Decoder reading from the connection through limiter
+	limiter *messageLimiter // Bounds the size of every decoded message
+}
+
+// NewGobCodec function creates a gob codec for a connection, accepting messages of at most maxBytes.
+func NewGobCodec(stream io.ReadWriter, maxBytes int) *GobCodec {
+	limiter := newMessageLimiter(stream, maxBytes)
+	return &GobCodec{encoder: gob.NewEncoder(stream), decoder: gob.NewDecoder(limiter), limiter: limiter}
+}
+
+// Encode function writes a message to the gob stream.
+func (c *GobCodec) Encode(msg UnicastMessage) error {
+	return c.encoder.Encode(msg)
+}
+
+// Decode function reads the next message from the gob stream.
+func (c *GobCodec) Decode(msg *UnicastMessage) error {
+	c.limiter.reset()
+	return c.decoder.Decode(msg)
+}
+
+// JSONCodec struct encodes every message as a JSON object preceded by its length,
+// a 4-byte big-endian unsigned integer.
+type JSONCodec struct {
+	writer   io.Writer     // Connection the frames are written to
+	reader   *bufio.Reader // Buffered reader on the connection
+	maxBytes int           // Largest frame accepted, in bytes
+}
+
+// NewJSONCodec function creates a length-prefixed JSON codec for a connection, accepting frames of at most maxBytes.
+func NewJSONCodec(stream io.ReadWriter, maxBytes int) *JSONCodec {
+	return &JSONCodec{writer: stream, reader: bufio.NewReader(stream), maxBytes: maxBytes}
+}
+
+// Encode function writes a message as one frame.
+func (c *JSONCodec) Encode(msg UnicastMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	_, err = c.writer.Write(frame)
+	return err
+}
+
+// Decode function reads the next frame and unmarshals the message it holds.
+func (c *JSONCodec) Decode(msg *UnicastMessage) error {
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > uint32(c.maxBytes) {
+		return fmt.Errorf("%w: frame of %d bytes exceeds the limit of %d", errMessageTooLarge, size, c.maxBytes)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, msg)
+}
+
+// peerConn struct is the connection to a peer together with the codec reading and writing it.
+// The same connection carries the messages in both directions. All writes go through the outbound
+// queue to a single writer goroutine, so messages sent concurrently are never interleaved.
+type peerConn struct {
+	conn      net.Conn      // Underlying network connection
+	codec     Codec         // Codec encoding messages on conn
+	timeout   time.Duration // Write deadline of every message, 0 for none
+	outbound  outboundQueue // Messages waiting for the writer goroutine, highest priority first
+	queued    int           // Number of messages queued so far, orders messages of equal priority
+	wake      chan struct{} // Signals the writer goroutine that the queue is not empty
+	closed    chan struct{} // Closed by close, stops the writer goroutine
+	closeOnce sync.Once     // Makes close idempotent
+	mu        sync.Mutex    // Protects outbound, queued, written, lastErr and poisoned
+	written   bool          // Whether anything was written to the connection yet
+	lastErr   error         // Error of the last write, nil if it succeeded
+	poisoned  error         // Error of a write that failed, after which the stream cannot be trusted; nil until then
+	batchSize int           // Most messages per write, batching is off below 2
+	window    time.Duration // How long to wait for more messages to fill a batch
+	maxBytes  int           // Largest message the peer accepts, which a batch must stay below
+	messages  int           // Number of messages written so far
+	writes    int           // Number of writes so far, fewer than messages when batching
+}
+
+// outboundMessage struct is a message handed to the writer goroutine of a peerConn.
+type outboundMessage struct {
+	msg    UnicastMessage // Message to encode
+	result chan error     // Receives the outcome of the write
+	order  int            // Position in which the message was queued
+}
+
+// outboundQueue type is a heap of outbound messages: higher Priority first, and in queueing order
+// among messages of the same priority. It implements heap.Interface.
+type outboundQueue []outboundMessage
+
+// Len function returns the number of queued messages.
+func (q outboundQueue) Len() int { return len(q) }
+
+// Less function reports whether message i is written before message j.
+func (q outboundQueue) Less(i, j int) bool {
+	if q[i].msg.Priority != q[j].msg.Priority {
+		return q[i].msg.Priority > q[j].msg.Priority
+	}
+	return q[i].order < q[j].order
+}
+
+// Swap function swaps two messages, for the heap package.
+func (q outboundQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+// Push function appends a message, for the heap package.
+func (q *outboundQueue) Push(x interface{}) { *q = append(*q, x.(outboundMessage)) }
+
+// Pop function removes the last message, for the heap package.
+func (q *outboundQueue) Pop() interface{} {
+	old := *q
+	out := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return out
+}
+
+// newPeerConn function wraps a connection with its codec and starts its writer goroutine, which writes
+// with the write timeout and batching of the configuration.
+func newPeerConn(conn net.Conn, codec Codec, config *Config) *peerConn {
+	c := &peerConn{conn: conn, codec: codec, timeout: config.WriteTimeout, wake: make(chan struct{}, 1), closed: make(chan struct{}),
+		batchSize: config.BatchSize, window: config.BatchWindow, maxBytes: config.MaxMessageBytes}
+	go c.writeLoop()
+	return c
+}
+
+// writeLoop function is the only goroutine encoding on the connection. It writes the queued messages
+// highest priority first, until the connection is closed. A peer that stops reading makes a
+// write block once the TCP buffers are full, so every write has a deadline; the timeout is returned like any other write error.
+// With batching, several messages are written at once as a single BatchMessage.
+func (c *peerConn) writeLoop() {
+	for {
+		select {
+		case <-c.wake:
+		case <-c.closed:
+			return
+		}
+		for {
+			if !c.fillBatch() {
+				return
+			}
+			batch := c.nextBatch()
+			if len(batch) == 0 {
+				break
+			}
+			msg := batch[0].msg
+			if len(batch) > 1 {
+				msg = UnicastMessage{Kind: KindBatch, SourceID: msg.SourceID, Priority: msg.Priority}
+				for _, out := range batch {
+					msg.Batch = append(msg.Batch, out.msg)
+				}
+			}
+			if c.timeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+			}
+			err := c.codec.Encode(msg)
+			c.mu.Lock()
+			c.written = true
+			c.lastErr = err
+			c.messages += len(batch)
+			c.writes++
+			c.mu.Unlock()
+			for _, out := range batch {
+				out.result <- err
+			}
+			if err != nil {
+				c.poison(err)
+				return
+			}
+		}
+	}
+}
+
+// poison function tears the connection down after a failed write. The encoder may have written part of a
+// message, and a gob stream also keeps type information sent earlier, so anything written after it would be
+// misread by the peer. The connection is closed instead and the messages still queued fail; the receive loop
+// then ends and the connection is dialed again like any broken one.
+func (c *peerConn) poison(err error) {
+	c.mu.Lock()
+	c.poisoned = err
+	waiting := c.outbound
+	c.outbound = nil
+	c.mu.Unlock()
+	c.close()
+	for _, out := range waiting {
+		out.result <- fmt.Errorf("connection to %s was closed after a failed write: %w", c.conn.RemoteAddr(), err)
+	}
+}
+
+// writeError function returns the error of the write that poisoned the connection, nil if no write failed.
+func (c *peerConn) writeError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.poisoned
+}
+
+// fillBatch function waits up to the batch window for enough queued messages to fill a batch. It does not
+// wait for the first message of a connection, which the peer reads as the handshake, nor when a control
+// message is waiting, since acks and heartbeats must not be held back. It returns false if the connection is closed.
+func (c *peerConn) fillBatch() bool {
+	if c.batchSize < 2 || c.window == 0 {
+		return true
+	}
+	timeout := time.After(c.window)
+	for {
+		c.mu.Lock()
+		ready := !c.written || c.outbound.Len() == 0 || c.outbound.Len() >= c.batchSize || c.outbound[0].msg.Priority >= PriorityControl
+		c.mu.Unlock()
+		if ready {
+			return true
+		}
+		select {
+		case <-c.wake:
+		case <-timeout:
+			return true
+		case <-c.closed:
+			return false
+		}
+	}
+}
+
+// nextBatch function takes the next messages to write off the queue: one without batching, otherwise up to
+// batchSize of them, as long as their estimated size stays below half the peer's message limit.
+// The first message of a connection is always written alone.
+func (c *peerConn) nextBatch() []outboundMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var batch []outboundMessage
+	size := 0
+	for c.outbound.Len() > 0 && (len(batch) == 0 || (c.written && len(batch) < c.batchSize)) {
+		next := messageSize(c.outbound[0].msg)
+		if len(batch) > 0 && size+next > c.maxBytes/2 {
+			break
+		}
+		batch = append(batch, heap.Pop(&c.outbound).(outboundMessage))
+		size += next
+	}
+	return batch
+}
+
+// send function queues a message for the writer goroutine and waits until it is written.
+// It returns the write error, or an error if the connection is closed first.
+func (c *peerConn) send(msg UnicastMessage) error {
+	result := c.queue(msg)
+	select {
+	case err := <-result:
+		return err
+	case <-c.closed:
+		return fmt.Errorf("connection to %s is closed", c.conn.RemoteAddr())
+	}
+}
+
+// queue function hands a message to the writer goroutine without waiting for it to be written.
+// The returned channel receives the outcome of the write.
+func (c *peerConn) queue(msg UnicastMessage) <-chan error {
+	result := make(chan error, 1)
+	// Every write is unique, even a retransmission, so only a replayed copy repeats a nonce
+	msg.Nonce = newNonce()
+	c.mu.Lock()
+	c.queued++
+	heap.Push(&c.outbound, outboundMessage{msg: msg, result: result, order: c.queued})
+	c.mu.Unlock()
+	// Wake the writer goroutine, unless it is already signalled
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// close function closes the connection and stops its writer goroutine. It may be called more than once.
+func (c *peerConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// writeCounts function returns how many messages were written to the connection and in how many writes.
+func (c *peerConn) writeCounts() (messages int, writes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.messages, c.writes
+}
+
+// lastWrite function describes the outcome of the last write on the connection.
+func (c *peerConn) lastWrite() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.written {
+		return "no writes yet"
+	}
+	if c.lastErr != nil {
+		return "failed: " + c.lastErr.Error()
+	}
+	return "ok"
+}
+
+// ConnectionManager struct is the thread-safe map of peer connections, keyed by process ID.
+// It is read by the sending goroutines and changed at runtime by joins, leaves and failures.
+type ConnectionManager struct {
+	mu     sync.RWMutex      // Protects peers and closed
+	peers  map[int]*peerConn // Connection to each peer
+	closed bool              // Set by CloseAll, no connection can be added afterwards
+}
+
+// NewConnectionManager function creates an empty connection manager.
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{peers: make(map[int]*peerConn)}
+}
+
+// Add function registers the connection to a peer. It returns false, leaving the manager untouched,
+// if there already is a connection to that peer or the manager was closed; the caller then owns peer.
+func (m *ConnectionManager) Add(id int, peer *peerConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[id]; ok || m.closed {
+		return false
+	}
+	m.peers[id] = peer
+	return true
+}
+
+// Remove function closes the connection to a peer and removes it. It reports whether there was one.
+func (m *ConnectionManager) Remove(id int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peer, ok := m.peers[id]
+	if !ok {
+		return false
+	}
+	peer.close()
+	delete(m.peers, id)
+	return true
+}
+
+// RemoveConn function closes and removes the connection to a peer, but only if conn is the one
+// registered for it. It reports whether it was.
+func (m *ConnectionManager) RemoveConn(id int, conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peer, ok := m.peers[id]
+	if !ok || peer.conn != conn {
+		return false
+	}
+	peer.close()
+	delete(m.peers, id)
+	return true
+}
+
+// Get function returns the connection to a peer, if there is one.
+func (m *ConnectionManager) Get(id int) (*peerConn, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	peer, ok := m.peers[id]
+	return peer, ok
+}
+
+// Range function calls f for every connection in process ID order, until f returns false.
+// f runs on a snapshot without the lock held, so it may call the other methods.
+func (m *ConnectionManager) Range(f func(id int, peer *peerConn) bool) {
+	m.mu.RLock()
+	ids := make([]int, 0, len(m.peers))
+	snapshot := make(map[int]*peerConn, len(m.peers))
+	for id, peer := range m.peers {
+		ids = append(ids, id)
+		snapshot[id] = peer
+	}
+	m.mu.RUnlock()
+	sort.Ints(ids)
+	for _, id := range ids {
+		if !f(id, snapshot[id]) {
+			return
+		}
+	}
+}
+
+// IDs function returns the IDs of all connected peers in ascending order.
+func (m *ConnectionManager) IDs() []int {
+	var ids []int
+	m.Range(func(id int, _ *peerConn) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// Reopen function lets a manager closed by CloseAll accept connections again.
+func (m *ConnectionManager) Reopen() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = false
+}
+
+// CloseAll function closes and removes every connection and refuses new ones.
+func (m *ConnectionManager) CloseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for id, peer := range m.peers {
+		peer.close()
+		delete(m.peers, id)
+	}
+}
+
+// States of a circuit breaker, as the conns command shows them.
+const (
+	BreakerClosed   = "closed"    // Messages are sent
+	BreakerOpen     = "open"      // Messages fail right away
+	BreakerHalfOpen = "half-open" // The cooldown has passed, the next message is sent as a trial
+)
+
+// breakerState struct is the circuit breaker of one peer.
+type breakerState struct {
+	failures int       // Consecutive failed sends while closed
+	open     bool      // Whether the breaker is open or half-open
+	openedAt time.Time // When the breaker last opened
+	trial    bool      // Whether the trial message of a half-open breaker is on its way
+}
+
+// CircuitBreaker struct stops sending to peers that keep failing. After Failures consecutive failed sends to a peer
+// its breaker opens and new messages to it fail right away. Once Cooldown has passed it is half-open: one trial
+// message is sent, and the breaker closes if it succeeds or opens again if it fails.
+type CircuitBreaker struct {
+	mu     sync.Mutex            // Protects peers
+	config BreakerConfig         // Threshold and cooldown of every breaker
+	peers  map[int]*breakerState // Breaker of each peer that failed since its last success
+}
+
+// NewCircuitBreaker function creates closed breakers for every peer.
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{config: config, peers: make(map[int]*breakerState)}
+}
+
+// Allow function reports whether a new message may be sent to a peer. A half-open breaker lets a single trial
+// message through and refuses the others until it succeeds or fails.
+func (b *CircuitBreaker) Allow(peerID int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.peers[peerID]
+	if !ok || !state.open {
+		return true
+	}
+	if state.trial || now.Sub(state.openedAt) < b.config.Cooldown {
+		return false
+	}
+	state.trial = true
+	return true
+}
+
+// Success function closes the breaker of a peer after a successful send. It reports whether the breaker was open.
+func (b *CircuitBreaker) Success(peerID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.peers[peerID]
+	delete(b.peers, peerID)
+	return ok && state.open
+}
+
+// Failure function counts a failed send to a peer. It reports whether that opened the breaker, either because
+// there were Failures in a row or because the trial message of a half-open breaker failed.
+func (b *CircuitBreaker) Failure(peerID int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Failures == 0 {
+		return false
+	}
+	state, ok := b.peers[peerID]
+	if !ok {
+		state = &breakerState{}
+		b.peers[peerID] = state
+	}
+	if state.open {
+		// Messages sent before the breaker opened may still fail, only the trial decides
+		if !state.trial {
+			return false
+		}
+		state.trial = false
+		state.openedAt = now
+		return true
+	}
+	state.failures++
+	if state.failures < b.config.Failures {
+		return false
+	}
+	state.open = true
+	state.openedAt = now
+	return true
+}
+
+// State function returns the state of the breaker of a peer.
+func (b *CircuitBreaker) State(peerID int, now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.peers[peerID]
+	switch {
+	case !ok || !state.open:
+		return BreakerClosed
+	case state.trial || now.Sub(state.openedAt) >= b.config.Cooldown:
+		return BreakerHalfOpen
+	default:
+		return BreakerOpen
+	}
+}
+
+// Tripped function returns the peers whose breaker is open or half-open, ordered by process ID.
+func (b *CircuitBreaker) Tripped() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []int
+	for id, state := range b.peers {
+		if state.open {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Forget function drops the breaker of a peer that left the cluster.
+func (b *CircuitBreaker) Forget(peerID int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.peers, peerID)
+}
+
+// sendFailed function counts a failed send to a peer in its circuit breaker.
+func (p *Process) sendFailed(peerID int) {
+	if p.breaker.Failure(peerID, p.Time.Now()) {
+		p.logger.Errorf("circuit breaker to process %d is open, messages to it fail for %s", peerID, p.config.Breaker.Cooldown)
+	}
+}
+
+// sendSucceeded function closes the circuit breaker of a peer a message reached.
+func (p *Process) sendSucceeded(peerID int) {
+	if p.breaker.Success(peerID) {
+		p.logger.Infof("circuit breaker to process %d is closed again", peerID)
+	}
+}
+
+// Outbox struct holds the messages sent to members that have no connection yet, such as a peer that is slow
+// to start, until the connection is made. At most size messages are kept per peer.
+type Outbox struct {
+	mu       sync.Mutex               // Protects messages
+	size     int                      // Most messages kept per peer
+	messages map[int][]UnicastMessage // Messages waiting for each peer, in send order
+}
+
+// NewOutbox function creates an empty outbox keeping at most size messages per peer.
+func NewOutbox(size int) *Outbox {
+	return &Outbox{size: size, messages: make(map[int][]UnicastMessage)}
+}
+
+// Add function keeps a message for a peer. It returns an error if the peer already has size messages waiting.
+func (o *Outbox) Add(peerID int, msg UnicastMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.messages[peerID]) >= o.size {
+		return fmt.Errorf("%w, %d messages to process %d are waiting for the connection", errOutboxFull, o.size, peerID)
+	}
+	o.messages[peerID] = append(o.messages[peerID], msg)
+	return nil
+}
+
+// Take function removes and returns the messages waiting for a peer, in send order.
+func (o *Outbox) Take(peerID int) []UnicastMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	messages := o.messages[peerID]
+	delete(o.messages, peerID)
+	return messages
+}
+
+// ReceivePool struct bounds the receive loops of a process. Every connection, accepted or dialed, runs one
+// receive loop for as long as it is open, so the pool also limits the open connections.
+type ReceivePool struct {
+	slots chan struct{} // Holds one entry per running receive loop, nil for no limit
+}
+
+// NewReceivePool function creates a pool of size receive loops, or an unlimited one if size is 0.
+func NewReceivePool(size int) *ReceivePool {
+	if size == 0 {
+		return &ReceivePool{}
+	}
+	return &ReceivePool{slots: make(chan struct{}, size)}
+}
+
+// Acquire function takes a slot for a new receive loop. It returns an error instead of waiting when all slots are taken.
+func (r *ReceivePool) Acquire() error {
+	if r.slots == nil {
+		return nil
+	}
+	select {
+	case r.slots <- struct{}{}:
+		return nil
+	default:
+		return r.limitError()
+	}
+}
+
+// Release function frees the slot of a receive loop that ended.
+func (r *ReceivePool) Release() {
+	if r.slots != nil {
+		<-r.slots
+	}
+}
+
+// Check function returns the error Acquire would return if every slot is taken, without taking one.
+func (r *ReceivePool) Check() error {
+	if r.slots != nil && len(r.slots) == cap(r.slots) {
+		return r.limitError()
+	}
+	return nil
+}
+
+// limitError function describes a full pool.
+func (r *ReceivePool) limitError() error {
+	return fmt.Errorf("%d connections open, the limit is %d", len(r.slots), cap(r.slots))
+}
+
+// dropPeer function closes the connection to a single peer after an error and removes it from the
+// connection map, so the rest of the cluster keeps being served. A message refused for its size left
+// nothing on the connection, which is kept.
+func (p *Process) dropPeer(peerID int, err error) {
+	if errors.Is(err, errMessageTooLarge) {
+		return
+	}
+	if p.connections.Remove(peerID) {
+		p.logger.Errorf("dropping connection to process %d: %v", peerID, err)
+	}
+}
+
+// Shutdown function stops the process: it drains the delayed messages, then closes the listener and every
+// connection. Calling it more than once has no effect.
+func (p *Process) Shutdown() {
+	p.Drain()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		return // Already shut down
+	default:
+	}
+	close(p.done)
+	p.gate.Close()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.control != nil {
+		p.control.Close()
+	}
+	if p.discovery != nil {
+		p.discovery.Close()
+	}
+	for conn := range p.receiving {
+		conn.Close()
+	}
+	p.connections.CloseAll()
+}
+
+// Drain function stops new delayed messages and gives the ones already scheduled up to Config.DrainTimeout
+// to wait out their delay and be written, so they are not lost when the connections close. It reports whether
+// all of them were sent in time.
+func (p *Process) Drain() bool {
+	unsent := p.pending.Drain(p.config.DrainTimeout)
+	if unsent > 0 {
+		p.logger.Errorf("%d delayed messages were not sent before shutting down", unsent)
+	}
+	return unsent == 0
+}
+
+// Crash function simulates a crash of the process: the listener and every connection are closed and the
+// heartbeat and retransmission loops stop, so the peers see the process fail. Unlike Shutdown the process
+// keeps its state and can be brought back with Restart.
+func (p *Process) Crash() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isShutdown() {
+		return fmt.Errorf("process %d is shut down", p.ID)
+	}
+	if p.crashed() {
+		return fmt.Errorf("process %d is already crashed", p.ID)
+	}
+	close(p.alive)
+	p.ring.Drop()
+	p.listener.Close()
+	// Unregister the connections first, so their receive loops end without reporting a disconnect
+	p.connections.CloseAll()
+	for conn := range p.receiving {
+		conn.Close()
+	}
+	return nil
+}
+
+// Restart function brings a crashed process back: it listens on its port again, restarts the heartbeats
+// and reconnects to every member. The peers do not redial a process that crashed, so all of them are dialed,
+// not only those with a lower ID.
+func (p *Process) Restart() error {
+	p.mu.Lock()
+	if p.isShutdown() {
+		p.mu.Unlock()
+		return fmt.Errorf("process %d is shut down", p.ID)
+	}
+	if !p.crashed() {
+		p.mu.Unlock()
+		return fmt.Errorf("process %d is not crashed", p.ID)
+	}
+	ln, err := p.listen()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	p.listener = ln
+	p.alive = make(chan struct{})
+	p.mu.Unlock()
+	p.connections.Reopen()
+	go acceptLoop(p, ln)
+	go heartbeatLoop(p)
+	if p.config.ReconnectInterval > 0 {
+		go reconnectLoop(p)
+	}
+	for _, member := range p.memberList() {
+		if member.ID == p.ID {
+			continue
+		}
+		if err := connectPeer(p, member, p.config.Retry); err != nil {
+			p.logger.Errorf("could not connect to process %d: %v", member.ID, err)
+		}
+	}
+	return nil
+}
+
+// crashed function reports whether the process is crashed. The caller must hold p.mu.
+func (p *Process) crashed() bool {
+	select {
+	case <-p.alive:
+		return true
+	default:
+		return false
+	}
+}
+
+// isCrashed function reports whether Crash has been called without a Restart since.
+func (p *Process) isCrashed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.crashed()
+}
+
+// aliveSignal function returns the channel closed when the process crashes next.
+// Loops that must stop during a crash watch it next to done.
+func (p *Process) aliveSignal() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.alive
+}
+
+// isShutdown function reports whether Shutdown has been called.
+func (p *Process) isShutdown() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialAddress function returns the host:port address other processes dial to reach this process.
+// IPv6 literals such as ::1 are bracketed by net.JoinHostPort.
+func (p *Process) dialAddress() string {
+	return net.JoinHostPort(p.IP, p.Port)
+}
+
+// listenAddress function returns the host:port address the process listens on.
+func (p *Process) listenAddress() string {
+	return net.JoinHostPort(p.BindAddr, p.Port)
+}
+
+// connectPeer function dials another process, retrying according to the policy, introduces itself with a
+// handshake and registers the connection under the peer's ID. It does nothing if the process is already
+// connected to that peer.
+func connectPeer(process *Process, otherProcess Process, policy RetryPolicy) error {
+	if _, ok := process.connections.Get(otherProcess.ID); ok {
+		return nil
+	}
+	if err := resolveHost(otherProcess); err != nil {
+		return err
+	}
+	conn, err := dialWithRetry(process.transport, otherProcess.dialAddress(), policy, process.Time)
+	if err != nil {
+		return err
+	}
+	if err := setKeepAlive(conn, process.config.KeepAlive); err != nil {
+		process.logger.Errorf("could not set keepalive on the connection to process %d: %v", otherProcess.ID, err)
+	}
+	codec, err := negotiateCodec(conn, process.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	peer := newPeerConn(conn, codec, process.config)
+	if !process.registerPeer(otherProcess.ID, peer) {
+		// Another goroutine connected in the meantime, or the process was shut down
+		peer.close()
+		if process.isShutdown() {
+			return fmt.Errorf("process %d is shut down", process.ID)
+		}
+		return nil
+	}
+	if err := peer.send(newHandshake(process.ID)); err != nil {
+		process.dropPeer(otherProcess.ID, err)
+		return err
+	}
+	if err := process.serve(peer, otherProcess.ID); err != nil {
+		process.dropPeer(otherProcess.ID, err)
+		return err
+	}
+	process.flushOutbox(otherProcess.ID)
+	return nil
+}
+
+// dialLoop function connects to a peer in the background, so a peer that is slow to start does not hold up the
+// process. Failed attempts are retried according to Config.Retry, with the pause capped at MaxDialBackoff, until
+// the connection is made or the process shuts down, crashes or forgets the peer. A failure is reported once,
+// after Config.Retry.MaxAttempts attempts; the loop keeps trying after that.
+func dialLoop(process *Process, member Process) {
+	alive := process.aliveSignal()
+	once := RetryPolicy{MaxAttempts: 1}
+	for attempt := 1; ; attempt++ {
+		err := connectPeer(process, member, once)
+		if err == nil {
+			if attempt > 1 {
+				process.logger.Infof("Connected to process %d after %d attempts", member.ID, attempt)
+			}
+			return
+		}
+		if attempt == process.config.Retry.MaxAttempts {
+			process.logger.Errorf("could not connect to process %d, retrying in the background: %v", member.ID, err)
+		}
+		// Keep the shift of an exponential backoff in range, the pause is capped anyway
+		pause := process.config.Retry.pause(min(attempt, 16))
+		if pause > MaxDialBackoff {
+			pause = MaxDialBackoff
+		}
+		select {
+		case <-process.done:
+			return
+		case <-alive:
+			return
+		case <-process.Time.After(pause):
+		}
+		if !process.isMember(member.ID) {
+			return
+		}
+	}
+}
+
+// registerPeer function adds the connection to a peer to the connection manager and starts retransmitting
+// to it. It returns false if the process already has a connection to that peer or is shut down.
+func (p *Process) registerPeer(peerID int, peer *peerConn) bool {
+	if !p.connections.Add(peerID, peer) {
+		return false
+	}
+	p.publish(EventPeerConnected, peerID, UnicastMessage{})
+	// Resend messages to this peer that are not acknowledged in time
+	if p.config.atLeastOnce() {
+		go retransmitLoop(p, peerID)
+	}
+	return true
+}
+
+// flushOutbox function sends the messages that waited in the outbox for a peer that is now connected,
+// in the order they were sent, each with the usual random delay.
+func (p *Process) flushOutbox(peerID int) {
+	waiting := p.outbox.Take(peerID)
+	for _, msg := range waiting {
+		unicast_send_with_delay(p, peerID, msg, messageDelay(p, peerID))
+	}
+	if len(waiting) > 0 {
+		p.logger.Infof("Sent %d messages that waited for the connection to process %d", len(waiting), peerID)
+	}
+}
+
+// serve function starts receiving on a connection in a new goroutine. peerID is UnknownPeer for a
+// connection that was accepted, or dialed before the other side's ID was known.
+// If Config.MaxConnections receive loops are running already, the connection is closed and an error returned.
+func (p *Process) serve(peer *peerConn, peerID int) error {
+	// Track the connection so Shutdown and Crash can close it
+	p.mu.Lock()
+	if p.isShutdown() || p.crashed() {
+		p.mu.Unlock()
+		peer.close()
+		return nil
+	}
+	if err := p.receivePool.Acquire(); err != nil {
+		p.mu.Unlock()
+		peer.close()
+		return err
+	}
+	p.receiving[peer.conn] = true
+	p.receivers.Add(1)
+	p.mu.Unlock()
+	go serveConn(p, peer, peerID)
+	return nil
+}
+
+// serveConn function runs the receive loop of a connection. The first message is the handshake of the other side.
+// If the peer is not known yet, the connection is registered under the ID it carries, so replies and later sends
+// reuse it. If it is known from the configuration, a different ID is logged as a warning.
+// The connection is closed and unregistered when the loop ends.
+func serveConn(process *Process, peer *peerConn, peerID int) {
+	defer process.receivers.Done()
+	defer process.receivePool.Release()
+	msg := UnicastMessage{}
+	err := peer.codec.Decode(&msg)
+	// Refuse a peer whose messages would be misread before handling any of them
+	if err == nil {
+		version := 0
+		if msg.Kind == KindHandshake {
+			version = msg.Handshake.Version
+		}
+		err = checkVersion(version)
+	}
+	if err == nil {
+		remoteID := msg.SourceID
+		if msg.Kind == KindHandshake {
+			remoteID = msg.Handshake.ID
+		}
+		if peerID == UnknownPeer {
+			if process.registerPeer(remoteID, peer) {
+				peerID = remoteID
+				process.flushOutbox(peerID)
+			} else if !process.isShutdown() {
+				err = fmt.Errorf("already connected to process %d", remoteID)
+			}
+		} else if remoteID != peerID {
+			process.logger.Errorf("warning: expected process %d at %s, but process %d answered", peerID, peer.conn.RemoteAddr(), remoteID)
+		}
+		if peerID != UnknownPeer {
+			handleMessage(process, msg)
+			err = unicast_receive(process, peer.codec)
+		}
+	}
+	// A connection that was removed on purpose, by a leave or a send error, needs no message.
+	// A peer closing its end is normal, only other receive errors are reported as errors.
+	if peerID == UnknownPeer {
+		if !process.isShutdown() {
+			process.logger.Errorf("closing connection from %s: %v", peer.conn.RemoteAddr(), err)
+		}
+	} else if process.connections.RemoveConn(peerID, peer.conn) && !process.isShutdown() {
+		process.publish(EventPeerDisconnected, peerID, UnicastMessage{})
+		if writeErr := peer.writeError(); writeErr != nil {
+			process.logger.Errorf("closing connection to process %d, a failed write left it unusable: %v", peerID, writeErr)
+		} else if isDisconnect(err) {
+			process.logger.Infof("process %d disconnected", peerID)
+		} else {
+			process.logger.Errorf("closing connection to process %d: %v", peerID, err)
+		}
+	}
+	peer.close()
+	process.mu.Lock()
+	delete(process.receiving, peer.conn)
+	process.mu.Unlock()
+}
+
+// isDisconnect function reports whether a receive error means that the connection was closed, by the peer
+// or locally, rather than that something went wrong. A gzip stream is never ended cleanly, so its peer
+// closing shows up as an unexpected EOF.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
+
+// addMember function records a process in the membership and lets the failure detector watch it.
+// It reports whether the process is new.
+func (p *Process) addMember(member Process) bool {
+	p.mu.Lock()
+	_, known := p.members[member.ID]
+	p.members[member.ID] = member
+	p.mu.Unlock()
+	if !known && member.ID != p.ID {
+		p.detector.Add(member.ID, p.Time.Now())
+	}
+	return !known
+}
+
+// memberList function returns every known member, ordered by process ID.
+func (p *Process) memberList() []Process {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	members := make([]Process, 0, len(p.members))
+	for _, member := range p.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// isMember function reports whether a process is a member of the cluster, other than the process itself.
+func (p *Process) isMember(memberID int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.members[memberID]
+	return ok && memberID != p.ID
+}
+
+// isolated function reports whether the process is the only member of the cluster, so it has nobody to talk to.
+func (p *Process) isolated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, self := p.members[p.ID]
+	return len(p.members) == 1 && self
+}
+
+// removeMember function forgets a process that left the cluster: it leaves the membership and the
+// failure detector, its connection is closed and messages still waiting for its ack are dropped.
+func (p *Process) removeMember(memberID int) {
+	p.mu.Lock()
+	delete(p.members, memberID)
+	p.mu.Unlock()
+	p.detector.Remove(memberID)
+	for _, msg := range p.acks.Forget(memberID) {
+		p.deadLetter(memberID, msg, "not acknowledged before the process left the cluster")
+	}
+	p.quorum.Forget(memberID)
+	p.breaker.Forget(memberID)
+	for _, msg := range p.outbox.Take(memberID) {
+		p.deadLetter(memberID, msg, "not sent before the process left the cluster")
+	}
+	p.history.Forget(memberID)
+	p.connections.Remove(memberID)
+}
+
+// join_cluster function is the bootstrap step of a process joining a running cluster: it dials the member
+// listening on ip:port and announces itself. The rest happens when the JoinResponse arrives on the same
+// connection, which then stays open as the connection to the contact.
+func join_cluster(process *Process, ip string, port string) error {
+	conn, err := process.transport.Dial(net.JoinHostPort(ip, port))
+	if err != nil {
+		return err
+	}
+	if err := setKeepAlive(conn, process.config.KeepAlive); err != nil {
+		process.logger.Errorf("could not set keepalive on the connection to %s: %v", conn.RemoteAddr(), err)
+	}
+	codec, err := negotiateCodec(conn, process.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	peer := newPeerConn(conn, codec, process.config)
+	request := JoinRequest{ID: process.ID, IP: process.IP, Port: process.Port, Reply: true}
+	if err := peer.send(newHandshake(process.ID)); err != nil {
+		peer.close()
+		return err
+	}
+	if err := peer.send(UnicastMessage{Kind: KindJoinRequest, SourceID: process.ID, Join: &request}); err != nil {
+		peer.close()
+		return err
+	}
+	// The contact's ID is learned from its handshake
+	return process.serve(peer, UnknownPeer)
+}
+
+// handleJoinRequest function adds a joining process to the membership. The newcomer has already
+// connected to this process. If it asked for a reply, the current member list is sent back to it.
+func handleJoinRequest(process *Process, sourceID int, request JoinRequest) {
+	newcomer := Process{ID: request.ID, IP: request.IP, Port: request.Port, BindAddr: request.IP}
+	// Refuse an ID that already belongs to a different process
+	for _, member := range process.memberList() {
+		if member.ID == newcomer.ID && (member.IP != newcomer.IP || member.Port != newcomer.Port) {
+			process.logger.Infof("refusing join of process %d from %s, the ID is already in use", newcomer.ID, newcomer.dialAddress())
+			if request.Reply {
+				response := JoinResponse{Error: fmt.Sprintf("process ID %d is already in use", newcomer.ID)}
+				unicast_send(process, sourceID, UnicastMessage{Kind: KindJoinResponse, SourceID: process.ID, Members: &response})
+			}
+			process.connections.Remove(sourceID)
+			return
+		}
+	}
+	if process.addMember(newcomer) {
+		process.logger.Infof("Process %d joined the cluster, system time is: %s", newcomer.ID, process.wallTime().Format(time.RFC3339))
+	}
+	if request.Reply {
+		response := JoinResponse{Members: process.memberList(), Vector: process.causal.Vector()}
+		if err := unicast_send(process, newcomer.ID, UnicastMessage{Kind: KindJoinResponse, SourceID: process.ID, Members: &response}); err != nil {
+			process.dropPeer(newcomer.ID, err)
+		}
+	}
+}
+
+// handleJoinResponse function completes a join: it takes over the contact's vector time, connects to every
+// other member of the cluster and announces itself to them. The contact already knows about it.
+func handleJoinResponse(process *Process, contactID int, response JoinResponse) {
+	if response.Error != "" {
+		process.logger.Errorf("Join refused by process %d: %s", contactID, response.Error)
+		return
+	}
+	// Count the multicasts sent before the join as delivered, the next ones from their senders would wait for them forever
+	process.causal.Merge(response.Vector)
+	announce := JoinRequest{ID: process.ID, IP: process.IP, Port: process.Port}
+	for _, member := range response.Members {
+		if member.ID == process.ID {
+			continue
+		}
+		if member.ID == contactID {
+			process.addMember(member)
+			continue
+		}
+		if err := connectPeer(process, member, process.config.Retry); err != nil {
+			process.logger.Errorf("could not connect to member %d: %v", member.ID, err)
+			continue
+		}
+		process.addMember(member)
+		if err := unicast_send(process, member.ID, UnicastMessage{Kind: KindJoinRequest, SourceID: process.ID, Join: &announce}); err != nil {
+			process.dropPeer(member.ID, err)
+		}
+	}
+	process.logger.Infof("Joined the cluster through process %d with %d members, system time is: %s", contactID, len(response.Members), process.wallTime().Format(time.RFC3339))
+}
+
+// leave_cluster function makes a process leave the cluster on purpose: it multicasts a LeaveMessage,
+// waits up to LeaveAckTimeout for every peer to acknowledge it and then shuts the process down.
+func leave_cluster(process *Process) {
+	peers := process.connections.IDs()
+	acks := make(chan int, len(peers))
+	process.mu.Lock()
+	process.leaveAcks = acks
+	process.mu.Unlock()
+	msg := UnicastMessage{Kind: KindLeave, SourceID: process.ID, Leave: &LeaveMessage{ID: process.ID}}
+	for _, peerID := range peers {
+		if err := unicast_send(process, peerID, msg); err != nil {
+			process.dropPeer(peerID, err)
+		}
+	}
+	// Wait briefly for the acknowledgments, a peer that does not answer will detect the departure anyway
+	timeout := process.Time.After(LeaveAckTimeout)
+	for acked := 0; acked < len(peers); {
+		select {
+		case <-acks:
+			acked++
+		case <-timeout:
+			process.logger.Errorf("only %d of %d peers acknowledged the leave", acked, len(peers))
+			acked = len(peers)
+		}
+	}
+	process.mu.Lock()
+	process.leaveAcks = nil
+	process.mu.Unlock()
+	process.Shutdown()
+}
+
+// handleLeave function acknowledges a leave announcement and removes the departing process,
+// without marking it as failed.
+func handleLeave(process *Process, departingID int) {
+	// Acknowledge first, the connection to the departing process is closed right after
+	if err := unicast_send(process, departingID, UnicastMessage{Kind: KindLeaveAck, SourceID: process.ID}); err != nil {
+		process.logger.Errorf("could not acknowledge the leave of process %d: %v", departingID, err)
+	}
+	process.removeMember(departingID)
+	process.logger.Infof("process %d left the cluster", departingID)
+	if leaderID, _ := process.election.Leader(); departingID == leaderID {
+		start_election(process)
+	}
+}
+
+// dialWithRetry function connects to addr, retrying according to the policy and pausing on the given clock.
+// It returns the last error if every attempt fails, so the caller can carry on without this peer.
+func dialWithRetry(transport Transport, addr string, policy RetryPolicy, clock Clock) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	// Try to establish the connection
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		// Dial the other process
+		conn, err = transport.Dial(addr)
+		if err == nil { // If the connection is successful, return it
+			return conn, nil
+		}
+		// If the connection is not successful, wait for a period and retry
+		if attempt < policy.MaxAttempts {
+			<-clock.After(policy.pause(attempt))
+		}
+	}
+	return nil, err
+}
+
+// resolveHost function checks that the host of a process, an IP address or a hostname, resolves to an address.
+// Dialing resolves it again, but a failed lookup reported here names the host and the process it belongs to.
+func resolveHost(process Process) error {
+	if _, err := net.LookupHost(process.IP); err != nil {
+		return fmt.Errorf("cannot resolve host %s for process %d: %w", process.IP, process.ID, err)
+	}
+	return nil
+}
+
+// Transport interface opens the listeners and connections the processes talk over. The codec is
+// negotiated on top of the connections it returns, so every transport carries the same messages.
+type Transport interface {
+	Listen(addr string) (net.Listener, error) // Listens for the connections dialed to addr
+	Dial(addr string) (net.Conn, error)       // Connects to the process listening on addr
+}
+
+// TCPTransport struct connects processes over TCP, encrypted with TLS if the tls option is set.
+type TCPTransport struct {
+	tlsConfig *tls.Config // Certificate of the process and the CA its peers are verified against, nil for plaintext
+}
+
+// NewTCPTransport function creates the TCP transport for a configuration, loading its TLS certificates.
+func NewTCPTransport(config *Config) (*TCPTransport, error) {
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the TLS certificates: %w", err)
+	}
+	return &TCPTransport{tlsConfig: tlsConfig}, nil
+}
+
+// Listen function listens on the TCP address addr, over TLS if it is configured.
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	if t.tlsConfig != nil {
+		return tls.Listen("tcp", addr, t.tlsConfig)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Dial function connects to the TCP address addr, over TLS if it is configured.
+func (t *TCPTransport) Dial(addr string) (net.Conn, error) {
+	if t.tlsConfig != nil {
+		return tls.Dial("tcp", addr, t.tlsConfig)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// PipeTransport struct connects processes running in the same program in memory, through net.Pipe,
+// without opening any port. It lets tests run a cluster deterministically and fast.
+type PipeTransport struct {
+	mu        sync.Mutex               // Protects listeners
+	listeners map[string]*pipeListener // Listener of each address
+}
+
+// NewPipeTransport function creates an in-memory transport without listeners.
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{listeners: make(map[string]*pipeListener)}
+}
+
+// Listen function registers a listener for addr. Only one listener may use an address at a time.
+func (t *PipeTransport) Listen(addr string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[addr]; ok {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+	ln := &pipeListener{transport: t, addr: pipeAddr(addr), conns: make(chan net.Conn), closed: make(chan struct{})}
+	t.listeners[addr] = ln
+	return ln, nil
+}
+
+// Dial function connects to the listener of addr, handing it one end of a new pipe.
+func (t *PipeTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	ln, ok := t.listeners[addr]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial pipe %s: connection refused", addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.closed:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("dial pipe %s: connection refused", addr)
+	}
 }
 
-// Config struct represents the configuration of the system.
-// It includes the minimum and maximum delay for sending messages,
-// and a list of all processes in the system.
-type Config struct {
-	MinDelay  int       // Minimum delay for sending messages
-	MaxDelay  int       // Maximum delay for sending messages
-	Processes []Process // List of all processes in the system
+// pipeListener struct accepts the pipes dialed to one address of a PipeTransport.
+type pipeListener struct {
+	transport *PipeTransport // Transport the listener is registered with
+	addr      pipeAddr       // Address the listener was opened on
+	conns     chan net.Conn  // Server ends of the dialed pipes, waiting to be accepted
+	closed    chan struct{}  // Closed by Close
+	once      sync.Once      // Makes Close idempotent
 }
 
-// UnicastMessage is the struct for passing messages between processes
-// it includes the source id and it's corresponding messages
-type UnicastMessage struct {
-	SourceID int    //Source ID or Sender ID
-	Message  string // Message from the sender
+// Accept function waits for the next pipe dialed to the listener, or returns net.ErrClosed once it is closed.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
 }
 
-// ParseConfig function reads a configuration file and returns a Config struct.
-// The configuration file should have the following format:
-// - The first line contains two integers, representing the minimum and maximum delay.
-// - Each subsequent line represents a process, with the format: ID IP Port.
-func ParseConfig(filename string) (*Config, error) {
-	// Open the configuration file.
-	file, err := os.Open(filename)
+// Close function stops the listener and frees its address, so it can be listened on again.
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mu.Unlock()
+	})
+	return nil
+}
+
+// Addr function returns the address the listener was opened on.
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeAddr type is the address of a pipeListener.
+type pipeAddr string
+
+// Network function returns the name of the network, "pipe".
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+// String function returns the address.
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// setKeepAlive function turns TCP keepalive on with the given period, or off if the period is 0,
+// so idle connections are not silently dropped by firewalls. TLS connections are configured on their
+// underlying TCP connection, and in-memory connections of a PipeTransport have nothing to configure.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period == 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// loadTLSConfig function loads the certificate, key and CA of the tls option. Both ends of a connection
+// present the certificate and verify the other one against the CA. It returns nil if TLS is off.
+func loadTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
 	if err != nil {
-		return nil, err // Return an error if the file cannot be opened.
+		return nil, err
 	}
-	defer file.Close() // Ensure the file is closed when the function returns. As defer delays the activity until the function returns some value
+	caPEM, err := os.ReadFile(config.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", config.TLSCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
 
-	// Create a scanner to read the file line by line.
-	scanner := bufio.NewScanner(file)
-	scanner.Scan()                                     // Read the first line of the file.
-	minMaxDelays := strings.Split(scanner.Text(), " ") // Split the first line into two parts.
-	minDelay, _ := strconv.Atoi(minMaxDelays[0])       // Convert the first part to an integer.
-	maxDelay, _ := strconv.Atoi(minMaxDelays[1])       // Convert the second part to an integer.
+// pause function returns how long to wait after the given failed attempt, counting from 1.
+// Exponential pauses are drawn between half and all of BaseDelay doubled per attempt, so processes
+// retrying at the same time spread out.
+func (r RetryPolicy) pause(attempt int) time.Duration {
+	if r.Backoff == BackoffExponential {
+		pause := r.BaseDelay << (attempt - 1)
+		if pause <= 1 {
+			return pause
+		}
+		return pause/2 + time.Duration(rand.Int63n(int64(pause/2)))
+	}
+	return r.BaseDelay * time.Duration(attempt)
+}
 
-	// Create a new Config struct and set the minimum and maximum delay.
-	config := &Config{
-		MinDelay: minDelay,
-		MaxDelay: maxDelay,
+// sendRequest struct is the JSON body of a POST /send request to the control endpoint.
+type sendRequest struct {
+	Dest    int    `json:"dest"`
+	Message string `json:"message"`
+}
+
+// memberInfo struct describes one member in the response to GET /members.
+type memberInfo struct {
+	ID     int        `json:"id"`
+	IP     string     `json:"ip"`
+	Port   string     `json:"port"`
+	Status PeerStatus `json:"status,omitempty"` // Failure detector status, empty for the process itself
+}
+
+// writeMetrics function writes the traffic counters per peer and the send delay histogram
+// in the Prometheus text format.
+func writeMetrics(w io.Writer, stats map[int]Stats, delays DelayHistogram) {
+	ids := make([]int, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
 	}
-	// Read the rest of the file line by line.
-	for scanner.Scan() {
-		processInfo := strings.Split(scanner.Text(), " ") // Split each line after every space, into three parts.
-		processID, _ := strconv.Atoi(processInfo[0])      // Convert the first part to an integer.
-		// Create a new Process struct and add it to the list of processes.
-		process := Process{
-			ID:   processID,
-			IP:   processInfo[1],
-			Port: processInfo[2],
+	sort.Ints(ids)
+	counters := []struct {
+		name  string
+		help  string
+		value func(Stats) int
+	}{
+		{"messages_sent_total", "Messages sent to each peer.", func(s Stats) int { return s.Sent }},
+		{"messages_received_total", "Messages received from each peer.", func(s Stats) int { return s.Received }},
+		{"messages_dropped_total", "Messages to or from each peer dropped by the drop rate or a block.", func(s Stats) int { return s.Dropped }},
+		{"messages_expired_total", "Messages from each peer dropped because their deadline had passed.", func(s Stats) int { return s.Expired }},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for _, id := range ids {
+			fmt.Fprintf(w, "%s{peer=\"%d\"} %d\n", counter.name, id, counter.value(stats[id]))
 		}
-		config.Processes = append(config.Processes, process)
 	}
-	// Check for errors that occurred while reading the file.
-	if err := scanner.Err(); err != nil {
-		return nil, err // Return an error if there was a problem reading the file.
+	fmt.Fprintf(w, "# HELP send_delay_seconds Random delay of the sent messages.\n# TYPE send_delay_seconds histogram\n")
+	for i, bound := range DelayBuckets {
+		fmt.Fprintf(w, "send_delay_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), delays.Counts[i])
 	}
-	// Return the Config struct.
-	return config, nil
+	fmt.Fprintf(w, "send_delay_seconds_bucket{le=\"+Inf\"} %d\n", delays.Count)
+	fmt.Fprintf(w, "send_delay_seconds_sum %g\n", delays.Sum)
+	fmt.Fprintf(w, "send_delay_seconds_count %d\n", delays.Count)
 }
 
-// unicast_send function sends a message to a process through a network connection.
-func unicast_send(encoder *gob.Encoder, sourceID int, message string) {
-	//creating a new instance of UnicastMessage Struct
-	msg := UnicastMessage{SourceID: sourceID, Message: message}
-	//Encoding the msg object
-	err := encoder.Encode(msg)
+// sendStatus function returns the HTTP status POST /send answers with when Process.Send fails: 404 for a
+// destination that is not a member, 503 while the process cannot send, 429 while messages to the destination
+// pile up, 413 for an oversized message and 400 for a message to the process itself.
+func sendStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownDestination):
+		return http.StatusNotFound
+	case errors.Is(err, errIsolated), errors.Is(err, errShuttingDown), errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errOutboxFull):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errMessageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// startControlServer function starts the HTTP control endpoint of a process on Config.ControlPort plus its ID.
+// POST /send sends a message like the send command, GET /members returns the membership as JSON.
+// The process keeps running without the endpoint if its port cannot be bound.
+func startControlServer(process *Process) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var request sendRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := process.Send(request.Dest, request.Message); err != nil {
+			http.Error(w, err.Error(), sendStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, process.stats.Snapshot(), process.stats.Delays())
+	})
+	mux.HandleFunc("/members", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		statuses := process.detector.Members()
+		members := []memberInfo{}
+		for _, member := range process.memberList() {
+			members = append(members, memberInfo{ID: member.ID, IP: member.IP, Port: member.Port, Status: statuses[member.ID]})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	})
+
+	address := net.JoinHostPort(process.BindAddr, strconv.Itoa(process.config.ControlPort+process.ID))
+	ln, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal(err)
+		process.logger.Errorf("could not start the HTTP control endpoint: %v", err)
+		return
+	}
+	server := &http.Server{Handler: mux}
+	// Register the server so Shutdown closes it
+	process.mu.Lock()
+	if process.isShutdown() {
+		process.mu.Unlock()
+		ln.Close()
+		return
 	}
+	process.control = server
+	process.mu.Unlock()
+	go server.Serve(ln)
 }
 
-// unicast_send_with_delay function sends a message to a process with a delay.
-// The delay is a random duration between the minimum and maximum delay specified in the configuration.
-func unicast_send_with_delay(encoder *gob.Encoder, processID int, message string, delay time.Duration) {
-	// Start a new goroutine to send the message after the delay.
-	go func() {
-		time.Sleep(delay)
-		unicast_send(encoder, processID, message)
-	}()
+// DiscoveryAnnouncement struct is what a process in discovery mode broadcasts about itself, as JSON.
+type DiscoveryAnnouncement struct {
+	ID      int    `json:"id"`      // ID of the announcing process
+	IP      string `json:"ip"`      // Address the process is dialed at
+	Port    string `json:"port"`    // TCP port the process listens on
+	Version int    `json:"version"` // Protocol version the process speaks
+}
+
+// startDiscovery function opens the UDP socket of the discovery announcements and starts announcing the process
+// every DiscoveryInterval and handling the announcements of the others. The process keeps running without
+// discovery if the socket cannot be opened.
+func startDiscovery(process *Process) {
+	port, err := strconv.Atoi(process.Port)
+	if err != nil || port < process.config.Discovery.FirstPort || port > process.config.Discovery.LastPort {
+		process.logger.Errorf("port %s is outside the discovery ports %d to %d, no other process will hear of process %d", process.Port, process.config.Discovery.FirstPort, process.config.Discovery.LastPort, process.ID)
+	}
+	// Listen on every address, a socket bound to a single address does not receive broadcasts
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort("", process.Port))
+	if err != nil {
+		process.logger.Errorf("could not start discovery: %v", err)
+		return
+	}
+	// Register the socket so Shutdown closes it
+	process.mu.Lock()
+	if process.isShutdown() {
+		process.mu.Unlock()
+		conn.Close()
+		return
+	}
+	process.discovery = conn
+	process.mu.Unlock()
+	go announceLoop(process, conn)
+	go discoveryLoop(process, conn)
 }
 
-// unicast_receive function listens for incoming messages from a process.
-func unicast_receive(decoder *gob.Decoder) {
+// announceLoop function sends the announcement of the process to every discovery port every DiscoveryInterval,
+// until the process shuts down. A crashed process stays silent.
+func announceLoop(process *Process, conn net.PacketConn) {
+	announcement, err := json.Marshal(DiscoveryAnnouncement{ID: process.ID, IP: process.IP, Port: process.Port, Version: ProtocolVersion})
+	if err != nil {
+		process.logger.Errorf("could not encode discovery announcement: %v", err)
+		return
+	}
+	ip := net.ParseIP(process.config.Discovery.BroadcastAddr)
 	for {
-		// Create a new UnicastMessage struct to store the incoming message
-		msg := UnicastMessage{}
-		//  decoding the incoming message
-		err := decoder.Decode(&msg)
+		if !process.isCrashed() {
+			for port := process.config.Discovery.FirstPort; port <= process.config.Discovery.LastPort; port++ {
+				if _, err := conn.WriteTo(announcement, &net.UDPAddr{IP: ip, Port: port}); err != nil && !process.isShutdown() {
+					process.logger.Debugf("could not send discovery announcement to port %d: %v", port, err)
+				}
+			}
+		}
+		select {
+		case <-process.done:
+			return
+		case <-process.Time.After(DiscoveryInterval):
+		}
+	}
+}
 
+// discoveryLoop function handles the announcements arriving on the discovery socket until it is closed.
+func discoveryLoop(process *Process, conn net.PacketConn) {
+	buf := make([]byte, 1024)
+	for {
+		n, from, err := conn.ReadFrom(buf)
 		if err != nil {
-			log.Fatal(err)
+			return
+		}
+		var announcement DiscoveryAnnouncement
+		if err := json.Unmarshal(buf[:n], &announcement); err != nil {
+			process.logger.Debugf("ignoring invalid discovery announcement from %s: %v", from, err)
+			continue
 		}
-		// Print the received message, the sender's process ID, and the current time
-		fmt.Printf("Received message: %s from process %d, system time is: %s\n", msg.Message, msg.SourceID, time.Now().Format(time.RFC3339))
+		handleAnnouncement(process, announcement)
 	}
 }
 
-// startProcess function starts a process.
-func startProcess(process Process, config *Config) {
-	// initialize a wait group to sync multiple goroutines
-	var wg sync.WaitGroup
-	// Create a map to store gob.Encoder objects for each connection
-	connMap := make(map[int]*gob.Encoder)
+// handleAnnouncement function adds a process that announced itself to the membership if it is new. As at startup,
+// the process with the higher ID of the two dials the connection; the other one accepts it.
+func handleAnnouncement(process *Process, announcement DiscoveryAnnouncement) {
+	if announcement.ID == process.ID || process.isCrashed() || process.isMember(announcement.ID) {
+		return
+	}
+	if err := checkVersion(announcement.Version); err != nil {
+		process.logger.Debugf("ignoring discovery announcement of process %d: %v", announcement.ID, err)
+		return
+	}
+	member := Process{ID: announcement.ID, IP: announcement.IP, Port: announcement.Port, BindAddr: announcement.IP}
+	if !process.addMember(member) {
+		return
+	}
+	process.logger.Infof("Discovered process %d at %s, system time is: %s", member.ID, member.dialAddress(), process.wallTime().Format(time.RFC3339))
+	if member.ID < process.ID {
+		go dialLoop(process, member)
+	}
+}
 
-	// Server side
-	go func() {
-		// Start listening for incoming connections
-		ln, _ := net.Listen("tcp", ":"+process.Port)
-		for {
-			// Accept an incoming connection
-			conn, _ := ln.Accept()
-			// Create a new gob.Decoder for the connection
-			decoder := gob.NewDecoder(conn)
-			// Increment the wait group counter
-			wg.Add(1)
-			// Start a new goroutine
-			go func() {
-				unicast_receive(decoder)
-				// Decrement the counter when the goroutine completes
-				wg.Done()
-			}()
+// listen function opens the listener of the process on its port through its transport.
+func (p *Process) listen() (net.Listener, error) {
+	ln, err := p.transport.Listen(p.listenAddress())
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on port %s: %w", p.Port, err)
+	}
+	return ln, nil
+}
+
+// acceptLoop function accepts the connections of other processes on ln until it is closed,
+// on shutdown or crash. Every accepted connection introduces itself with a handshake.
+func acceptLoop(p *Process, ln net.Listener) {
+	for {
+		// Accept an incoming connection
+		conn, err := ln.Accept()
+		if err != nil {
+			return
 		}
-	}()
+		// Refuse the connection before the handshake if there is no room for its receive loop
+		if err := p.receivePool.Check(); err != nil {
+			p.logger.Errorf("refusing connection from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		if err := setKeepAlive(conn, p.config.KeepAlive); err != nil {
+			p.logger.Errorf("could not set keepalive on the connection from %s: %v", conn.RemoteAddr(), err)
+		}
+		codec, err := negotiateCodec(conn, p.config)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		// Introduce ourselves, the dialing process does the same with its first message. The handshake is
+		// queued first, so it is written before anything else, but not waited for: the dialing process only
+		// reads it once its own handshake was read, and an unbuffered connection such as net.Pipe would deadlock.
+		// A failed write breaks the connection, which ends the receive loop.
+		peer := newPeerConn(conn, codec, p.config)
+		peer.queue(newHandshake(p.ID))
+		if err := p.serve(peer, UnknownPeer); err != nil {
+			p.logger.Errorf("refusing connection from %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// startProcess function starts a process that talks to the others over transport and reads its commands
+// from the standard input. It returns once the process has been shut down and all its receiving goroutines
+// have finished, or right away with the error if the process cannot listen on its port.
+func startProcess(process Process, config *Config, transport Transport) error {
+	p, err := launchProcess(process, config, transport)
+	if err != nil {
+		return err
+	}
+	// Start a goroutine to handle user input
+	go handleUserInput(p)
+	p.Wait()
+	return nil
+}
+
+// launchProcess function starts a process like startProcess, but returns it once it has dialed its peers
+// and does not read the standard input, so a test can drive the process and stop it with Shutdown.
+func launchProcess(process Process, config *Config, transport Transport) (*Process, error) {
+	p := &process
+	p.config = config
+	p.transport = transport
+	if p.Time == nil {
+		p.Time = systemClock{}
+	}
+	if p.Events == nil {
+		p.Events = NewEventBus()
+	}
+	// Create the logger first, everything below may print through it
+	if p.Output == nil {
+		p.Output = os.Stdout
+	}
+	p.logger = NewLogger(p.ID, config.LogLevel, p.Output)
+	// Create the manager holding the connection to each peer
+	p.connections = NewConnectionManager()
+	p.receiving = make(map[net.Conn]bool)
+	// initialize a wait group to sync the receiving goroutines
+	p.receivers = &sync.WaitGroup{}
+	p.receivePool = NewReceivePool(config.MaxConnections)
+	p.outbox = NewOutbox(OutboxSize)
+	p.breaker = NewCircuitBreaker(config.Breaker)
+	p.mu = &sync.Mutex{}
+	p.done = make(chan struct{})
+	p.alive = make(chan struct{})
+	// Start with the membership from the configuration, processes may join later
+	p.members = make(map[int]Process)
+	for _, member := range config.Processes {
+		p.members[member.ID] = member
+	}
+	// Create the Lamport clock shared by the sending and receiving goroutines
+	p.clock = &LamportClock{}
+	// Create the vector clock and holdback queue for causal delivery
+	p.causal = NewCausalDelivery(config)
+	// Create the holdback queue restoring the send order of each source
+	p.fifo = NewFIFODelivery()
+	p.trace = NewDeliveryTrace()
+	// Create the gate the pause and resume commands hold delivery back with
+	p.gate = NewDeliveryGate()
+	// Create the holdback buffer for totally ordered broadcasts
+	p.total = NewTotalOrderDelivery()
+	p.sequencer = &Sequencer{}
+	// Create the replica of the key-value store, written through the sequencer
+	p.kv = NewKVStore()
+	// Create the proposals and holdback queue of the ISIS total order multicast
+	p.isis = NewISISState()
+	// Create the tracker for acknowledgments of plain messages
+	p.acks = NewAckTracker(config.Retransmit.Timeout, config.WindowSize, p.Time)
+	p.quorum = NewQuorumTracker()
+	p.history = NewSendHistory(SendHistorySize)
+	// Create the state of the Chandy-Lamport snapshots
+	p.snapshots = NewSnapshotState()
+	p.election = NewElectionState()
+	p.pings = NewPingTracker()
+	p.mutex = NewMutexState()
+	p.ring = NewTokenRing()
+	// Create the tracker dropping retransmitted copies, replayed frames and gossip seen before
+	p.tracker = NewMessageTracker(DedupWindow, NonceWindow)
+	p.arrivals = NewArrivalOrder()
+	// Create the failure detector, watching every other configured process
+	var peerIDs []int
+	for _, otherProcess := range config.Processes {
+		if otherProcess.ID != p.ID {
+			peerIDs = append(peerIDs, otherProcess.ID)
+		}
+	}
+	p.detector = NewFailureDetector(peerIDs, config.HeartbeatInterval, p.Time.Now())
+	p.gossip = NewGossipState()
+	p.rng = NewRandom(processSeed(config, p.ID))
+	p.stats = NewTrafficStats(p.Time)
+	p.blocked = NewBlocklist()
+	p.limiter = NewRateLimiter(config.RateLimit)
+	p.delays = NewDelayBounds(config.MinDelay, config.MaxDelay)
+	p.pending = NewPendingSends(p.Time)
+	p.scheduled = NewDelayQueue()
+	// Start listening for incoming connections, a process that cannot bind its port cannot take part
+	ln, err := p.listen()
+	if err != nil {
+		return nil, err
+	}
+	p.listener = ln
+	// Open the log of delivered messages, the process still runs without it if that fails
+	messageLog, err := NewMessageLog(p.ID)
+	if err != nil {
+		p.logger.Errorf("could not open message log: %v", err)
+	} else {
+		p.messageLog = messageLog
+	}
+	// Open the file of the dead letters, they are still kept in memory if that fails
+	deadLetters, err := NewDeadLetterQueue(config.DeadLetterFile)
+	if err != nil {
+		p.logger.Errorf("could not open dead letter file: %v", err)
+	}
+	p.deadLetters = deadLetters
+
+	go releaseLoop(p)
+	if config.DelayMode == DelayModeQueued {
+		go dispatchLoop(p)
+	}
+	// Server side
+	go acceptLoop(p, ln)
+	if len(config.Processes) == 1 {
+		// Nobody to dial, the process only listens until another process joins it
+		p.logger.Infof("running as isolated node; no peers configured")
+	}
 
 	// Client side
+	// Each pair of processes shares one connection, dialed by the process with the higher ID. Peers are dialed
+	// in the background, messages sent to them meanwhile wait in the outbox.
 	for _, otherProcess := range config.Processes {
-		if otherProcess.ID != process.ID {
-			var conn net.Conn
-			var err error
-			retries := 5
-			// Try to establish the connection
-			for i := 0; i < retries; i++ {
-				// Dial the other process
-				conn, err = net.Dial("tcp", otherProcess.IP+":"+otherProcess.Port)
-				if err == nil { // If the connection is successful, break the loop
-					break
-				}
-				// If the connection is not successful, wait for a period and retry
-				time.Sleep(time.Second * time.Duration(i+1))
-			}
-			// If the connection is still not successful after all retries, log the error
-			if err != nil {
-				log.Fatal(err)
-			}
-			// Close the connection when the function returns
-			defer conn.Close()
-			// Create a new gob.Encoder for the connection and store it in the map
-			connMap[otherProcess.ID] = gob.NewEncoder(conn)
+		if otherProcess.ID < p.ID {
+			go dialLoop(p, otherProcess)
 		}
 	}
 
-	// Start a goroutine to handle user input
-	go handleUserInput(process, connMap, config.MinDelay, config.MaxDelay)
-	// Wait for all goroutines to complete
-	wg.Wait()
+	// Start the HTTP control endpoint if one is configured
+	if config.ControlPort != 0 {
+		startControlServer(p)
+	}
+	// Start announcing the process and listening for the others if discovery is configured
+	if config.Discovery.FirstPort != 0 {
+		startDiscovery(p)
+	}
+	// Start sending heartbeats and watching the peers
+	go heartbeatLoop(p)
+	// Start replacing connections that break
+	if config.ReconnectInterval > 0 {
+		go reconnectLoop(p)
+	}
+	// The lowest process creates the token of the token ring
+	if config.Mutex == MutexTokenRing && p.ID == sequencerID(config) {
+		receiveToken(p, TokenMessage{})
+	}
+	return p, nil
+}
+
+// Wait function blocks until the process is shut down and all its receiving goroutines have finished,
+// then closes the message log and the dead letter file.
+func (p *Process) Wait() {
+	<-p.done
+	p.receivers.Wait()
+	if p.messageLog != nil {
+		p.messageLog.Close()
+	}
+	p.deadLetters.Close()
 }
 
 // handleUserInput function listens for user input.
-func handleUserInput(process Process, connections map[int]*gob.Encoder, minDelay int, maxDelay int) {
+// Every command that parses is kept in an in-memory history: "history" prints it and "replay [n]"
+// runs the last n commands again, in order.
+func handleUserInput(process *Process) {
 	scanner := bufio.NewScanner(os.Stdin)
+	var history []string
 	// Continuously read from input
 	for scanner.Scan() {
+		line := scanner.Text()
 		// Split the input into words
-		command := strings.Split(scanner.Text(), " ")
-		if command[0] == "send" && len(command) > 1 {
-			// convert the second word to an integer
-			destinationID, err := strconv.Atoi(command[1])
-			if err == nil {
-				// Check if there is a connection to the destination process
-				if encoder, ok := connections[destinationID]; ok {
-					message := strings.Join(command[2:], " ")
-					// Calculate a random delay within the specified range
-					delay := time.Duration(minDelay+rand.Intn(maxDelay-minDelay)) * time.Millisecond
-					// Send the message to the destination process after the delay
-					unicast_send_with_delay(encoder, process.ID, message, delay)
-					fmt.Printf("Sent message: %s to process %d, system time is: %s\n", message, destinationID, time.Now().Format(time.RFC3339))
-				} else {
-					fmt.Printf("Invalid destination process ID: %d\n", destinationID)
+		command := strings.Split(line, " ")
+		if command[0] == "history" {
+			for i, entry := range history {
+				fmt.Printf("%d: %s\n", i+1, entry)
+			}
+			continue
+		}
+		if command[0] == "replay" && len(command) == 2 {
+			n, err := strconv.Atoi(command[1])
+			if err != nil || n <= 0 {
+				fmt.Println("Invalid command format. Use: replay [n]")
+				continue
+			}
+			if n > len(history) {
+				n = len(history)
+			}
+			for _, entry := range history[len(history)-n:] {
+				fmt.Printf("Replaying: %s\n", entry)
+				if _, stop := executeCommand(process, strings.Split(entry, " ")); stop {
+					return
+				}
+			}
+			continue
+		}
+		parsed, stop := executeCommand(process, command)
+		if parsed {
+			history = append(history, line)
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// executeCommand function runs one user command, split into words.
+// It reports whether the command could be parsed and whether the process stopped, after exit or leave.
+func executeCommand(process *Process, command []string) (parsed bool, stop bool) {
+	// A crashed process neither sends nor receives, it only waits to be restarted
+	if process.isCrashed() && command[0] != "restart" && command[0] != "exit" {
+		fmt.Println("The process is crashed. Use: restart")
+		return false, false
+	}
+	if command[0] == "exit" {
+		// Close the listener and every connection of this process
+		process.Shutdown()
+		process.logger.Infof("Process %d shut down", process.ID)
+		return true, true
+	} else if command[0] == "leave" {
+		// Tell the peers we are leaving, then shut down
+		leave_cluster(process)
+		process.logger.Infof("Process %d left the cluster", process.ID)
+		return true, true
+	} else if command[0] == "conns" {
+		// Print the outgoing connections and their state
+		printConnections(process)
+	} else if (command[0] == "block" || command[0] == "unblock") && len(command) == 2 {
+		// Cut off or reconnect a peer to create or heal a partition
+		peerID, err := strconv.Atoi(command[1])
+		if err != nil {
+			fmt.Printf("Invalid command format. Use: %s [id]\n", command[0])
+			return false, false
+		}
+		if command[0] == "block" && process.blocked.Block(peerID) {
+			fmt.Printf("Blocked process %d\n", peerID)
+		} else if command[0] == "unblock" && process.blocked.Unblock(peerID) {
+			fmt.Printf("Unblocked process %d\n", peerID)
+		} else {
+			fmt.Printf("Process %d is already %sed\n", peerID, command[0])
+		}
+	} else if command[0] == "deadletters" {
+		// Print the messages the process gave up on
+		printDeadLetters(process)
+	} else if command[0] == "stats" {
+		// Print the messages and bytes exchanged with every peer
+		printStats(process)
+	} else if command[0] == "members" {
+		// Print the failure detector's view of the peers
+		printMembers(process)
+	} else if command[0] == "elect" {
+		// Hold a Bully election, the highest live process becomes the leader
+		start_election(process)
+	} else if command[0] == "lock" {
+		// Ask the peers for the distributed lock, the process enters the critical section once all replied
+		if err := request_lock(process); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+	} else if command[0] == "unlock" {
+		// Leave the critical section and let the waiting processes in
+		if err := release_lock(process); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+	} else if command[0] == "leader" {
+		// Print the current leader
+		if leaderID, _ := process.election.Leader(); leaderID == UnknownPeer {
+			fmt.Println("No leader was elected yet")
+		} else {
+			fmt.Printf("Process %d is the leader\n", leaderID)
+		}
+	} else if command[0] == "ping" && len(command) == 2 {
+		// Measure the round-trip time to a peer
+		peerID, err := strconv.Atoi(command[1])
+		if err != nil {
+			fmt.Println("Invalid command format. Use: ping [id]")
+			return false, false
+		}
+		if err := ping(process, peerID, false); err != nil {
+			fmt.Println(err)
+		}
+	} else if command[0] == "drift" && len(command) == 2 {
+		// Estimate the offset between the clock of a peer and this process's clock
+		peerID, err := strconv.Atoi(command[1])
+		if err != nil {
+			fmt.Println("Invalid command format. Use: drift [id]")
+			return false, false
+		}
+		if err := ping(process, peerID, true); err != nil {
+			fmt.Println(err)
+		}
+	} else if command[0] == "whoami" {
+		// Print the identity and address of this process
+		fmt.Printf("Process %d at %s, listening on %s\n", process.ID, process.dialAddress(), process.listenAddress())
+	} else if command[0] == "cluster" {
+		// Print the address of every member
+		printCluster(process)
+	} else if command[0] == "saveconfig" && len(command) == 2 {
+		// Write the current membership to a config file
+		saved, err := saveConfig(process, command[1])
+		if err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		fmt.Printf("Saved %d processes to %s\n", saved, command[1])
+	} else if command[0] == "setdelay" && len(command) == 3 {
+		// Change the delay bounds of the following sends
+		minDelay, err1 := strconv.Atoi(command[1])
+		maxDelay, err2 := strconv.Atoi(command[2])
+		if err1 != nil || err2 != nil {
+			fmt.Println("Invalid command format. Use: setdelay [min] [max]")
+			return false, false
+		}
+		if err := process.delays.Set(minDelay, maxDelay); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		fmt.Printf("Delays set to %d-%d milliseconds\n", minDelay, maxDelay)
+	} else if command[0] == "latency" && len(command) == 3 {
+		// Add a fixed delay to the following sends to one peer, to simulate a slow link
+		peerID, err1 := strconv.Atoi(command[1])
+		latency, err2 := strconv.Atoi(command[2])
+		if err1 != nil || err2 != nil {
+			fmt.Println("Invalid command format. Use: latency [id] [ms]")
+			return false, false
+		}
+		if !process.isMember(peerID) {
+			fmt.Printf("Process %d is not a member\n", peerID)
+			return false, false
+		}
+		if err := process.delays.SetLatency(peerID, latency); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		if latency == 0 {
+			fmt.Printf("Extra latency to process %d cleared\n", peerID)
+		} else {
+			fmt.Printf("Extra latency to process %d set to %d milliseconds\n", peerID, latency)
+		}
+	} else if command[0] == "clock" {
+		// Print the current logical clocks without advancing them
+		fmt.Printf("Logical time is: %d, vector time is: %s\n", process.clock.Time(), process.causal.Vector())
+	} else if command[0] == "verify" {
+		// Check that every message so far was delivered after its causal predecessors
+		trace := process.trace.Entries()
+		violations := CheckCausalOrder(process.ID, trace)
+		for _, violation := range violations {
+			fmt.Println(violation)
+		}
+		fmt.Printf("Checked %d deliveries, %d causal order violations\n", len(trace), len(violations))
+	} else if command[0] == "pause" {
+		// Hold received messages back from the application, sending goes on
+		if !process.gate.Pause() {
+			fmt.Println("Delivery is already paused")
+			return false, false
+		}
+		fmt.Println("Delivery paused")
+	} else if command[0] == "resume" {
+		// Deliver the held messages in arrival order, then every new one as usual
+		held := process.gate.Resume()
+		if held < 0 {
+			fmt.Println("Delivery is not paused")
+			return false, false
+		}
+		fmt.Printf("Delivery resumed, delivering %d held messages\n", held)
+	} else if command[0] == "crash" {
+		// Stop sending and receiving until restart, the peers should detect the failure
+		if err := process.Crash(); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		process.logger.Infof("Process %d crashed", process.ID)
+	} else if command[0] == "restart" {
+		// Listen again and reconnect to every member
+		if err := process.Restart(); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		process.logger.Infof("Process %d restarted", process.ID)
+	} else if command[0] == "snapshot" {
+		// Record a consistent global state, every process writes its part to a file
+		start_snapshot(process)
+	} else if command[0] == "join" && len(command) == 3 {
+		// Join a running cluster through the member listening on ip:port
+		if err := join_cluster(process, command[1], command[2]); err != nil {
+			process.logger.Errorf("Could not join through %s: %v", net.JoinHostPort(command[1], command[2]), err)
+		}
+	} else if command[0] == "sendfile" && len(command) == 3 {
+		// Send each line of a file as a message of its own
+		destinationID, err := strconv.Atoi(command[1])
+		if err != nil {
+			fmt.Println("Invalid command format. Use: sendfile [destinationID] [path]")
+			return false, false
+		}
+		sent, err := process.SendFile(destinationID, command[2])
+		if err != nil {
+			fmt.Println(err)
+			if sent == 0 {
+				return false, false
+			}
+		}
+		fmt.Printf("Sent %d lines to process %d\n", sent, destinationID)
+	} else if command[0] == "sendgroup" && len(command) > 2 {
+		// Multicast the rest of the line to the members of a group
+		sent, err := group_send(process, command[1], strings.Join(command[2:], " "))
+		if err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		fmt.Printf("Message sent to %d processes\n", sent)
+	} else if command[0] == "qsend" && len(command) > 1 {
+		// Multicast the rest of the line, committed once a majority acknowledges it
+		if _, err := quorum_broadcast(process, strings.Join(command[1:], " ")); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+	} else if command[0] == "osend" && len(command) > 2 {
+		// Multicast the rest of the line with the given ordering class
+		sent, err := multicast_ordered(process, command[1], strings.Join(command[2:], " "))
+		if err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		if command[1] != OrderingTotal {
+			fmt.Printf("Message sent to %d processes\n", sent)
+		}
+	} else if command[0] == "tsend" && len(command) > 3 {
+		// Send the rest of the line, dropped by the receiver if it arrives more than TTL milliseconds from now
+		ttl, err := strconv.Atoi(command[1])
+		if err != nil || ttl <= 0 {
+			fmt.Printf("invalid ttl %q\n", command[1])
+			return false, false
+		}
+		destinationID, err := strconv.Atoi(command[2])
+		if err != nil {
+			fmt.Println("Invalid command format. Use: tsend [ttlMs] [destinationID] [message]")
+			return false, false
+		}
+		if err := process.SendWithTTL(destinationID, strings.Join(command[3:], " "), time.Duration(ttl)*time.Millisecond); err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+	} else if command[0] == "gossip" && len(command) > 1 {
+		// Spread the rest of the line through the cluster by gossip
+		start_gossip(process, strings.Join(command[1:], " "))
+	} else if command[0] == "isend" && len(command) > 1 {
+		// Multicast the rest of the line in total order using the ISIS agreement
+		isis_multicast(process, strings.Join(command[1:], " "))
+	} else if command[0] == "border" && len(command) > 1 {
+		// Broadcast the rest of the line in total order through the sequencer
+		ordered_broadcast(process, strings.Join(command[1:], " "))
+	} else if command[0] == "put" && len(command) > 2 {
+		// Write a key of the replicated store, the value is the rest of the line
+		ordered_put(process, command[1], strings.Join(command[2:], " "))
+	} else if command[0] == "get" && len(command) == 2 {
+		// Read a key from the local replica
+		if value, ok := process.kv.Get(command[1]); ok {
+			fmt.Printf("%s = %s\n", command[1], value)
+		} else {
+			fmt.Printf("Key %s is not set\n", command[1])
+		}
+	} else if command[0] == "sendexcept" && len(command) > 2 {
+		// Send the rest of the line to every other process but the excluded one
+		excludedID, err := strconv.Atoi(command[1])
+		if err != nil {
+			fmt.Println("Invalid command format. Use: sendexcept [excludedID] [message]")
+			return false, false
+		}
+		sent, err := multicast_send_except(process, excludedID, strings.Join(command[2:], " "))
+		if err != nil {
+			fmt.Println(err)
+			return false, false
+		}
+		fmt.Printf("Message sent to %d processes, all except process %d\n", sent, excludedID)
+	} else if command[0] == "msend" && len(command) > 1 {
+		// Send the rest of the line to every other process
+		if multicast_send(process, strings.Join(command[1:], " ")) == 0 && process.isolated() {
+			fmt.Printf("No message sent: %v\n", errIsolated)
+		}
+	} else if command[0] == "send" && len(command) > 1 && command[1] == "*" {
+		// send * is a shortcut for msend
+		sent := multicast_send(process, strings.Join(command[2:], " "))
+		if sent == 0 && process.isolated() {
+			fmt.Printf("No message sent: %v\n", errIsolated)
+		} else {
+			fmt.Printf("Message sent to %d processes\n", sent)
+		}
+	} else if command[0] == "send" && len(command) > 1 {
+		// convert the second word to an integer
+		destinationID, err := strconv.Atoi(command[1])
+		if err == nil {
+			// Send the rest of the line, split at | into several messages sent in order
+			for _, message := range splitMessages(strings.Join(command[2:], " ")) {
+				if err := process.Send(destinationID, message); err != nil {
+					fmt.Println(err)
+					break
 				}
-			} else {
-				fmt.Println("Invalid command format. Use: send [destinationID] [message]")
 			}
 		} else {
 			fmt.Println("Invalid command format. Use: send [destinationID] [message]")
+			return false, false
+		}
+	} else {
+		fmt.Println("Invalid command format. Use: send [destinationID] [message]")
+		return false, false
+	}
+	return true, false
+}
+
+// splitMessages function splits the text of a send command at every | into the messages it lists,
+// trimming the spaces around them and skipping empty ones. Text without a | is a single message.
+func splitMessages(text string) []string {
+	if !strings.Contains(text, MessageSeparator) {
+		return []string{text}
+	}
+	var messages []string
+	for _, message := range strings.Split(text, MessageSeparator) {
+		if message = strings.TrimSpace(message); message != "" {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// parseArgs function parses the command line: an optional configuration file name, config.txt by default,
+// and an optional --id ID flag (or its older name --process), before or after the file name, to run only that
+// process. Without the flag, envID, the value of the PROCESS_ID environment variable, selects the process.
+// single reports whether a process was selected.
+func parseArgs(args []string, envID string) (filename string, processID int, single bool, err error) {
+	flags := flag.NewFlagSet("mp1", flag.ContinueOnError)
+	process := flags.String("id", "", "run only the process with this ID instead of all of them")
+	flags.StringVar(process, "process", "", "same as -id")
+	if err := flags.Parse(args); err != nil {
+		return "", 0, false, err
+	}
+	filename = "config.txt"
+	if flags.NArg() > 0 {
+		filename = flags.Arg(0)
+		// Flags may also follow the file name
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return "", 0, false, err
+		}
+		if flags.NArg() > 0 {
+			return "", 0, false, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+		}
+	}
+	if *process == "" {
+		*process = envID
+	}
+	if *process == "" {
+		return filename, 0, false, nil
+	}
+	processID, err = strconv.Atoi(*process)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid process ID %q", *process)
+	}
+	return filename, processID, true, nil
+}
+
+// selectProcesses function returns the processes of the configuration to start: all of them,
+// or only the one with processID if single is set.
+func selectProcesses(config *Config, processID int, single bool) ([]Process, error) {
+	if !single {
+		return config.Processes, nil
+	}
+	for _, process := range config.Processes {
+		if process.ID == processID {
+			return []Process{process}, nil
 		}
 	}
+	return nil, fmt.Errorf("process %d is not in the configuration", processID)
 }
 
-// main function parses the configuration file and starts a goroutine for each process.
-// Then it waits indefinitely.
+// main function parses the configuration file and starts a goroutine for each process,
+// or only for the process selected with --id or PROCESS_ID. Then it waits until every process has shut down.
 func main() {
+	filename, processID, single, err := parseArgs(os.Args[1:], os.Getenv("PROCESS_ID"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	// Parse the config file
-	config, err := ParseConfig("config.txt")
+	config, err := ParseConfigFile(filename)
 	if err != nil {
 		log.Fatal(err) // Log an error and exit if there's a problem parsing the configuration file.
 	}
+	processes, err := selectProcesses(config, processID, single)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Talk over TCP, the certificates are loaded once for every process of the program
+	transport, err := NewTCPTransport(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Start a goroutine for each process
-	for _, process := range config.Processes {
-		go startProcess(process, config)
+	var wg sync.WaitGroup
+	for _, process := range processes {
+		wg.Add(1)
+		go func(process Process) {
+			defer wg.Done()
+			if err := startProcess(process, config, transport); err != nil {
+				log.Printf("Process %d: %v", process.ID, err)
+			}
+		}(process)
 	}
 
-	// Wait indefinitely
-	select {}
+	// Wait for every process to shut down
+	wg.Wait()
 }
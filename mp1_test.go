@@ -0,0 +1,3880 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer struct collects the output of a process, safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex   // Protects buf
+	buf bytes.Buffer // Everything written so far
+}
+
+// Write function appends p to the buffer.
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Lines function returns the lines written so far that contain text, oldest first.
+func (b *syncBuffer) Lines(text string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []string
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		if strings.Contains(line, text) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Messages function returns the messages of the lines containing prefix, such as "Received message: ",
+// which is the text between the prefix and " from process", oldest first.
+func (b *syncBuffer) Messages(prefix string) []string {
+	var messages []string
+	for _, line := range b.Lines(prefix) {
+		message := line[strings.Index(line, prefix)+len(prefix):]
+		if end := strings.Index(message, " from process"); end >= 0 {
+			message = message[:end]
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// captureOutput function collects what is printed to the standard output until the test ends, which are the
+// replies to commands. What a process logs goes to its own Output instead.
+func captureOutput(t *testing.T) *syncBuffer {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &syncBuffer{}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(output, reader)
+		close(copied)
+	}()
+	stdout := os.Stdout
+	os.Stdout = writer
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		writer.Close()
+		<-copied
+		reader.Close()
+	})
+	return output
+}
+
+// testCluster struct is a cluster of processes running in memory over loopback TCP connections.
+type testCluster struct {
+	config    *Config             // Configuration shared by the processes
+	transport Transport           // Transport connecting the processes
+	processes map[int]*Process    // Running processes by ID
+	outputs   map[int]*syncBuffer // What each process logged
+}
+
+// freePort function returns a TCP port on the loopback interface that nothing listens on right now.
+func freePort(t *testing.T) int {
+	t.Helper()
+	return freePorts(t, 1)[0]
+}
+
+// freePorts function returns n different TCP ports on the loopback interface that nothing listens on right now.
+// Every port stays bound until all are found, so the system cannot hand out the same one twice.
+func freePorts(t *testing.T, n int) []int {
+	t.Helper()
+	ports := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+// newTCPTransport function creates the TCP transport of a configuration, for tests that need real connections.
+func newTCPTransport(t *testing.T, config *Config) *TCPTransport {
+	t.Helper()
+	transport, err := NewTCPTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// newTestConfig function creates the configuration of processes with IDs 1 to n on free loopback ports,
+// with the shortest message delays and the default options.
+func newTestConfig(t *testing.T, n int) *Config {
+	t.Helper()
+	config := newConfig(0, 1)
+	for i, port := range freePorts(t, n) {
+		config.Processes = append(config.Processes, Process{ID: i + 1, IP: "127.0.0.1", Port: strconv.Itoa(port), BindAddr: "127.0.0.1"})
+	}
+	return config
+}
+
+// startCluster function launches every process of the configuration over a new PipeTransport and waits until
+// each is connected to all the others.
+func startCluster(t *testing.T, config *Config) *testCluster {
+	t.Helper()
+	return startClusterOver(t, config, NewPipeTransport())
+}
+
+// startClusterOver function launches every process of the configuration over transport in ID order, each
+// dialing the ones before it, and waits until each is connected to all the others. The processes run in a
+// temporary directory, where they write their message logs, and are shut down when the test ends.
+func startClusterOver(t *testing.T, config *Config, transport Transport) *testCluster {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	cluster := &testCluster{config: config, transport: transport, processes: make(map[int]*Process), outputs: make(map[int]*syncBuffer)}
+	for _, process := range config.Processes {
+		cluster.launch(t, config, process)
+	}
+	for _, process := range config.Processes {
+		cluster.waitConnected(t, process.ID)
+	}
+	return cluster
+}
+
+// launch function launches a process with the given configuration over the transport of the cluster,
+// adds it to the cluster and records its output. An Output already set on the process still receives everything it logs.
+func (c *testCluster) launch(t *testing.T, config *Config, process Process) *Process {
+	t.Helper()
+	output := &syncBuffer{}
+	if process.Output != nil {
+		process.Output = io.MultiWriter(process.Output, output)
+	} else {
+		process.Output = output
+	}
+	p, err := launchProcess(process, config, c.transport)
+	if err != nil {
+		t.Fatalf("process %d: %v", process.ID, err)
+	}
+	c.processes[p.ID] = p
+	c.outputs[p.ID] = output
+	t.Cleanup(func() {
+		p.Shutdown()
+		p.Wait()
+	})
+	return p
+}
+
+// waitConnected function waits until a process has a connection to every other member it knows.
+func (c *testCluster) waitConnected(t *testing.T, processID int) {
+	t.Helper()
+	p := c.processes[processID]
+	waitFor(t, fmt.Sprintf("process %d to connect", processID), func() bool {
+		for _, member := range p.memberList() {
+			if _, ok := p.connections.Get(member.ID); member.ID != p.ID && !ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// fakePeer struct plays one process of the configuration in a test, so the test sees exactly what a launched
+// process sends it and decides what it gets back.
+type fakePeer struct {
+	codec Codec // Encodes messages to the process and decodes what it sends, over the same connection
+}
+
+// launchWithFakePeer function launches process 1 of a configuration of two processes over TCP, whose buffers
+// hold what the process sends while the test is not reading, in a temporary directory, and plays process 2, which dials process 1, negotiates the codec and exchanges
+// handshakes with it. It returns the process, what it logs and the fake peer. Both are shut down when the
+// test ends.
+func launchWithFakePeer(t *testing.T, config *Config) (*Process, *syncBuffer, *fakePeer) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	output := &syncBuffer{}
+	process := config.Processes[0]
+	process.Output = output
+	transport := newTCPTransport(t, config)
+	p, err := launchProcess(process, config, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.Shutdown()
+		p.Wait()
+	})
+	conn, err := transport.Dial(p.dialAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	codec, err := negotiateCodec(conn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &fakePeer{codec: codec}
+	if err := peer.codec.Encode(newHandshake(2)); err != nil {
+		t.Fatal(err)
+	}
+	if handshake := peer.receive(t, time.Second); handshake.Kind != KindHandshake || handshake.Handshake.ID != 1 {
+		t.Fatalf("the first message is %+v, want the handshake of process 1", handshake)
+	}
+	waitFor(t, "process 1 to register the fake peer", func() bool {
+		_, ok := p.connections.Get(2)
+		return ok
+	})
+	return p, output, peer
+}
+
+// receive function decodes the next message the process sends to the fake peer, failing the test
+// if there is none within timeout.
+func (f *fakePeer) receive(t *testing.T, timeout time.Duration) UnicastMessage {
+	t.Helper()
+	msg, ok := f.receiveWithin(timeout)
+	if !ok {
+		t.Fatalf("no message within %s", timeout)
+	}
+	return msg
+}
+
+// receiveWithin function decodes the next message the process sends to the fake peer, skipping heartbeats,
+// and reports whether there was one within timeout. After a timeout the fake peer cannot receive anymore.
+func (f *fakePeer) receiveWithin(timeout time.Duration) (UnicastMessage, bool) {
+	received := make(chan UnicastMessage, 1)
+	go func() {
+		for {
+			var msg UnicastMessage
+			if f.codec.Decode(&msg) != nil {
+				return
+			}
+			if msg.Kind != KindHeartbeat {
+				received <- msg
+				return
+			}
+		}
+	}()
+	select {
+	case msg := <-received:
+		return msg, true
+	case <-time.After(timeout):
+		return UnicastMessage{}, false
+	}
+}
+
+// waitFor function polls cond until it holds, failing the test if it does not within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	waitWithin(t, 5*time.Second, what, cond)
+}
+
+// waitWithin function polls cond until it holds, failing the test if it does not within timeout.
+func waitWithin(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fakeClock struct is a Clock whose time only moves when the test advances it.
+type fakeClock struct {
+	mu      sync.Mutex   // Protects now and waiters
+	now     time.Time    // Current fake time
+	waiters []fakeWaiter // Channels returned by After that have not fired yet
+}
+
+// fakeWaiter struct is a channel returned by After and the time it fires at.
+type fakeWaiter struct {
+	at time.Time      // Time the channel receives at
+	ch chan time.Time // Channel returned by After
+}
+
+// newFakeClock function creates a fake clock reading an arbitrary fixed time.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now function returns the current fake time.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After function returns a channel receiving the fake time once the clock has advanced by d.
+// A duration that is not positive fires at once.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance function moves the clock forward by d and fires every channel that is due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			pending = append(pending, waiter)
+		} else {
+			waiter.ch <- c.now
+		}
+	}
+	c.waiters = pending
+}
+
+// TestLamportClock checks the Lamport rules: a tick advances the clock by one, and a received timestamp
+// sets it to max(local, received)+1, whether the received timestamp is ahead of the local time or not.
+func TestLamportClock(t *testing.T) {
+	clock := &LamportClock{}
+	if got := clock.Tick(); got != 1 {
+		t.Fatalf("first tick = %d, want 1", got)
+	}
+	if got := clock.Update(5); got != 6 {
+		t.Fatalf("update with 5 = %d, want 6", got)
+	}
+	if got := clock.Update(2); got != 7 {
+		t.Fatalf("update with 2 = %d, want 7", got)
+	}
+	if got := clock.Tick(); got != 8 {
+		t.Fatalf("tick after updates = %d, want 8", got)
+	}
+}
+
+// TestLamportClockConcurrent ticks and updates the clock from many goroutines and checks that no event is lost:
+// every tick and update returns a distinct time, and the clock ends at the number of events.
+func TestLamportClockConcurrent(t *testing.T) {
+	const goroutines, events = 8, 100
+	clock := &LamportClock{}
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				var time int
+				if g%2 == 0 {
+					time = clock.Tick()
+				} else {
+					// A timestamp from the past only counts as one event
+					time = clock.Update(0)
+				}
+				mu.Lock()
+				if seen[time] {
+					t.Errorf("time %d returned twice", time)
+				}
+				seen[time] = true
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if got := clock.Tick(); got != goroutines*events+1 {
+		t.Fatalf("final tick = %d, want %d", got, goroutines*events+1)
+	}
+}
+
+// TestNewMessageStamps checks that every new message ticks the clock and is stamped with the new time.
+func TestNewMessageStamps(t *testing.T) {
+	clock := &LamportClock{}
+	clock.Update(3)
+	causal := NewCausalDelivery(&Config{Processes: []Process{{ID: 1}, {ID: 2}}})
+	for i, want := range []string{"hello", "again"} {
+		msg := newMessage(1, want, clock, causal)
+		if msg.SourceID != 1 || msg.Message != want || msg.Timestamp != 5+i {
+			t.Fatalf("created %+v, want %q from process 1 at logical time %d", msg, want, 5+i)
+		}
+	}
+}
+
+// TestCausalDeliveryConcurrentMessages delivers three messages arriving concurrently on different connections
+// and checks that every message waits for its causal predecessors, whatever the arrival order.
+func TestCausalDeliveryConcurrentMessages(t *testing.T) {
+	config := &Config{Processes: []Process{{ID: 1}, {ID: 2}, {ID: 3}}}
+	// Process 1 sends a, process 2 sends b after delivering a, then process 1 sends c
+	messages := []UnicastMessage{
+		{SourceID: 1, Message: "a", Vector: VectorClock{1: 1, 2: 0, 3: 0}},
+		{SourceID: 2, Message: "b", Vector: VectorClock{1: 1, 2: 1, 3: 0}},
+		{SourceID: 1, Message: "c", Vector: VectorClock{1: 2, 2: 0, 3: 0}},
+	}
+	for run := 0; run < 100; run++ {
+		causal := NewCausalDelivery(config)
+		var delivered []string
+		var wg sync.WaitGroup
+		for _, msg := range messages {
+			wg.Add(1)
+			go func(msg UnicastMessage) {
+				defer wg.Done()
+				// deliver runs with the lock of the holdback queue held, so appending needs no lock of its own
+				causal.Receive(msg, func(msg UnicastMessage) { delivered = append(delivered, msg.Message) })
+			}(msg)
+		}
+		wg.Wait()
+		if len(delivered) != len(messages) {
+			t.Fatalf("run %d: delivered %v, want all of a, b and c", run, delivered)
+		}
+		// b and c both depend on a, and are concurrent with each other
+		if delivered[0] != "a" {
+			t.Fatalf("run %d: delivered %v, want a first", run, delivered)
+		}
+	}
+}
+
+// TestCausalDeliveryHoldsBackGap checks that a message is held back while an earlier message of its sender
+// is missing, and released together with it once it arrives.
+func TestCausalDeliveryHoldsBackGap(t *testing.T) {
+	causal := NewCausalDelivery(&Config{Processes: []Process{{ID: 1}, {ID: 2}}})
+	var delivered []string
+	record := func(msg UnicastMessage) { delivered = append(delivered, msg.Message) }
+	causal.Receive(UnicastMessage{SourceID: 1, Message: "second", Vector: VectorClock{1: 2, 2: 0}}, record)
+	if len(delivered) != 0 {
+		t.Fatalf("delivered %v before the first message arrived", delivered)
+	}
+	causal.Receive(UnicastMessage{SourceID: 1, Message: "first", Vector: VectorClock{1: 1, 2: 0}}, record)
+	if want := []string{"first", "second"}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("delivered %v, want %v", delivered, want)
+	}
+}
+
+// TestMulticastSend multicasts a message from one of three processes and checks that it is sent to and
+// delivered by each of the two others exactly once, and never sent back to the sender.
+func TestMulticastSend(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	multicast_send(cluster.processes[1], "hello all")
+	waitFor(t, "both peers to deliver the message", func() bool {
+		return len(cluster.outputs[2].Lines("Received message: hello all from process 1")) == 1 &&
+			len(cluster.outputs[3].Lines("Received message: hello all from process 1")) == 1
+	})
+	sent := cluster.outputs[1].Lines("Sent message: hello all to process")
+	if len(sent) != 2 || strings.Contains(strings.Join(sent, "\n"), "to process 1,") {
+		t.Fatalf("sent lines %q, want one to each of processes 2 and 3", sent)
+	}
+	// Give a duplicate delivery time to show up
+	time.Sleep(50 * time.Millisecond)
+	for id := 2; id <= 3; id++ {
+		if received := cluster.outputs[id].Lines("Received message: hello all"); len(received) != 1 {
+			t.Fatalf("process %d received %q, want the message once", id, received)
+		}
+	}
+}
+
+// TestOrderedBroadcastIdenticalOrder lets three processes broadcast through the sequencer at the same time,
+// with every sequenced message reaching each receiver after its own random delay, and checks that all of them
+// deliver the broadcasts in the same order.
+func TestOrderedBroadcastIdenticalOrder(t *testing.T) {
+	const processes, perProcess = 3, 5
+	sequencer := &Sequencer{}
+	receivers := make([]*TotalOrderDelivery, processes)
+	delivered := make([][]string, processes)
+	for i := range receivers {
+		receivers[i] = NewTotalOrderDelivery()
+	}
+	var wg sync.WaitGroup
+	for origin := 1; origin <= processes; origin++ {
+		wg.Add(1)
+		go func(origin int) {
+			defer wg.Done()
+			for n := 0; n < perProcess; n++ {
+				msg := SequencedMessage{Seq: sequencer.Next(), OriginID: origin, Message: fmt.Sprintf("%d-%d", origin, n)}
+				for i := range receivers {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+						// deliver runs with the lock of the receiver held
+						receivers[i].Receive(msg, func(msg SequencedMessage) { delivered[i] = append(delivered[i], msg.Message) })
+					}(i)
+				}
+			}
+		}(origin)
+	}
+	wg.Wait()
+	for i := range delivered {
+		if len(delivered[i]) != processes*perProcess {
+			t.Fatalf("receiver %d delivered %d broadcasts, want %d", i+1, len(delivered[i]), processes*perProcess)
+		}
+		if !reflect.DeepEqual(delivered[i], delivered[0]) {
+			t.Fatalf("receiver %d delivered %v, receiver 1 delivered %v", i+1, delivered[i], delivered[0])
+		}
+	}
+}
+
+// TestCrashedPeerDropped shuts one of three processes down and checks that a process sending to it only drops
+// that connection, and keeps delivering to and receiving from the remaining peer.
+func TestCrashedPeerDropped(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	p1, p2 := cluster.processes[1], cluster.processes[2]
+	cluster.processes[3].Shutdown()
+	// A write to a closed connection may still succeed once, before the peer's reset arrives
+	waitFor(t, "process 1 to drop process 3", func() bool {
+		multicast_send(p1, "probe")
+		_, ok := p1.connections.Get(3)
+		return !ok
+	})
+	if _, ok := p1.connections.Get(2); !ok {
+		t.Fatal("process 1 dropped its connection to process 2 too")
+	}
+	multicast_send(p1, "after crash")
+	multicast_send(p2, "reply")
+	waitFor(t, "the remaining processes to exchange messages", func() bool {
+		return len(cluster.outputs[2].Lines("Received message: after crash from process 1")) == 1 && len(cluster.outputs[1].Lines("Received message: reply from process 2")) == 1
+	})
+}
+
+// writeFile function writes content to a file called name in a temporary directory of the test and returns its path.
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestParseConfigIPv6 parses a configuration with IPv6 addresses and checks that they are bracketed when dialed.
+func TestParseConfigIPv6(t *testing.T) {
+	path := writeFile(t, "config.txt", "100 200\n1 ::1 8001\n2 fe80::1 8002 ::\n3 127.0.0.1 8003\n")
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dial   string
+		listen string
+	}{
+		{"[::1]:8001", "[::1]:8001"},
+		{"[fe80::1]:8002", "[::]:8002"},
+		{"127.0.0.1:8003", "127.0.0.1:8003"},
+	}
+	for i, test := range tests {
+		process := config.Processes[i]
+		if got := process.dialAddress(); got != test.dial {
+			t.Errorf("process %d dials %q, want %q", process.ID, got, test.dial)
+		}
+		if got := process.listenAddress(); got != test.listen {
+			t.Errorf("process %d listens on %q, want %q", process.ID, got, test.listen)
+		}
+	}
+}
+
+// TestParseConfig parses valid and invalid configuration files and checks the processes or the error.
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		processes int    // Processes a valid file lists
+		err       string // Part of the error of an invalid file, empty if it is valid
+	}{
+		{"valid", "100 200\n1 127.0.0.1 8001\n2 127.0.0.1 8002\n", 2, ""},
+		{"blank lines", "100 200\n\n1 127.0.0.1 8001\n\n2 127.0.0.1 8002\n", 2, ""},
+		{"bind address", "0 0\n1 127.0.0.1 8001 0.0.0.0\n", 1, ""},
+		{"empty file", "", 0, "missing minimum and maximum delay"},
+		{"missing delay", "100\n1 127.0.0.1 8001\n", 0, "expected 2 fields"},
+		{"non-numeric delay", "100 slow\n1 127.0.0.1 8001\n", 0, "invalid maximum delay"},
+		{"min above max", "200 100\n1 127.0.0.1 8001\n", 0, "0 <= min <= max"},
+		{"missing port", "100 200\n1 127.0.0.1\n", 0, "config line 2: expected 3 fields"},
+		{"missing host and port", "100 200\n1 127.0.0.1 8001\n2\n", 0, "config line 3: expected 3 fields"},
+		{"non-numeric port", "100 200\n1 127.0.0.1 http\n", 0, "invalid port for process 1"},
+		{"port out of range", "100 200\n1 127.0.0.1 70000\n", 0, "out of range"},
+		{"duplicate ID", "100 200\n1 127.0.0.1 8001\n1 127.0.0.1 8002\n", 0, "config line 3: duplicate process ID 1"},
+		{"no processes", "100 200\n", 0, "lists no processes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseConfig(writeFile(t, "config.txt", test.content))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(config.Processes) != test.processes {
+				t.Fatalf("parsed %d processes, want %d", len(config.Processes), test.processes)
+			}
+		})
+	}
+}
+
+// TestAcknowledgments multicasts a message and checks that the sender prints the ack of each destination and
+// keeps no message outstanding once both acks arrived.
+func TestAcknowledgments(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	p1, output := cluster.processes[1], cluster.outputs[1]
+	multicast_send(p1, "confirm me")
+	waitFor(t, "the acks of both destinations", func() bool {
+		return len(output.Lines("ACK received for seq 1 from process 2")) == 1 && len(output.Lines("ACK received for seq 1 from process 3")) == 1
+	})
+	p1.acks.mu.Lock()
+	defer p1.acks.mu.Unlock()
+	for destinationID, outstanding := range p1.acks.outstanding {
+		if len(outstanding) != 0 {
+			t.Fatalf("%d messages to process %d still outstanding", len(outstanding), destinationID)
+		}
+	}
+}
+
+// TestRetransmitAfterLostAck leaves the first copy of a message unacknowledged and checks that the sender
+// retransmits it exactly once, with the same sequence number, and stops once the copy is acknowledged.
+func TestRetransmitAfterLostAck(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.Retransmit = RetransmitConfig{Timeout: 100 * time.Millisecond, MaxRetries: 3}
+	p, _, peer := launchWithFakePeer(t, config)
+	multicast_send(p, "hello")
+	first := peer.receive(t, time.Second)
+	// The ack of the first copy is lost: nothing is sent back
+	resent := peer.receive(t, time.Second)
+	if resent.Message != "hello" || resent.Seq != first.Seq {
+		t.Fatalf("resent %+v, want hello with seq %d", resent, first.Seq)
+	}
+	ack := UnicastMessage{Kind: KindAck, SourceID: 2, Ack: &AckMessage{SenderID: 1, Seq: resent.Seq}}
+	if err := peer.codec.Encode(ack); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := peer.receiveWithin(4 * config.Retransmit.Timeout); ok {
+		t.Fatalf("sent %+v after the ack", msg)
+	}
+}
+
+// TestDuplicateSequenceNumberDeliveredOnce sends a process the same message twice and checks that it prints
+// a single delivery, but acknowledges both copies, since the first ack may have been lost.
+func TestDuplicateSequenceNumberDeliveredOnce(t *testing.T) {
+	_, output, peer := launchWithFakePeer(t, newTestConfig(t, 2))
+	msg := UnicastMessage{Kind: KindData, SourceID: 2, Message: "hello", Timestamp: 1, Seq: 1, Vector: VectorClock{1: 0, 2: 1}}
+	for i := 0; i < 2; i++ {
+		if err := peer.codec.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+		if ack := peer.receive(t, time.Second); ack.Kind != KindAck || ack.Ack.Seq != 1 {
+			t.Fatalf("copy %d answered with %+v, want the ack of seq 1", i+1, ack)
+		}
+	}
+	if got := output.Lines("Received message: hello"); len(got) != 1 {
+		t.Fatalf("printed %d deliveries, want 1: %v", len(got), got)
+	}
+}
+
+// TestFailureDetectorMissedHeartbeats stops the heartbeats of one of two peers and checks that it becomes
+// SUSPECTED, then FAILED, while the other stays ALIVE.
+func TestFailureDetectorMissedHeartbeats(t *testing.T) {
+	interval := time.Second
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	detector := NewFailureDetector([]int{2, 3}, interval, start)
+	want := map[int]map[int]PeerStatus{
+		SuspectAfterMissed: {3: StatusSuspected},
+		FailAfterMissed:    {3: StatusFailed},
+	}
+	for tick := 1; tick <= FailAfterMissed+2; tick++ {
+		now := start.Add(time.Duration(tick) * interval)
+		// Only process 2 keeps sending heartbeats
+		detector.Heartbeat(2, now)
+		changed := detector.Check(now)
+		if fmt.Sprint(changed) != fmt.Sprint(want[tick]) {
+			t.Fatalf("after %d intervals the changes are %v, want %v", tick, changed, want[tick])
+		}
+	}
+	if members := detector.Members(); members[2] != StatusAlive || members[3] != StatusFailed {
+		t.Fatalf("members are %v, want 2 ALIVE and 3 FAILED", members)
+	}
+}
+
+// TestGossipReachesAllNodes gossips a message among five processes with a fanout of 2 and checks that each
+// of the four others receives it exactly once, however often it is forwarded to them. The seed makes the
+// forwarding targets, and so the coverage, the same on every run.
+func TestGossipReachesAllNodes(t *testing.T) {
+	config := newTestConfig(t, 5)
+	config.RandSeed = 1
+	config.Fanout = 2
+	cluster := startCluster(t, config)
+	start_gossip(cluster.processes[1], "rumor")
+	waitFor(t, "every process to receive the gossip", func() bool {
+		for id := 2; id <= 5; id++ {
+			if len(cluster.outputs[id].Lines("Received gossip 1-1: rumor")) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	// Give a duplicate delivery time to show up
+	time.Sleep(50 * time.Millisecond)
+	for id, output := range cluster.outputs {
+		if got := output.Lines("Received gossip 1-1: rumor"); id != 1 && len(got) != 1 {
+			t.Fatalf("process %d received the gossip %d times, want once: %v", id, len(got), got)
+		}
+	}
+}
+
+// TestMessageLog sends three messages and checks that the message log of the receiver holds exactly three
+// entries, in the order they were sent and with increasing logical times.
+func TestMessageLog(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	sent := []string{"first", "second", "third"}
+	for _, message := range sent {
+		multicast_send(cluster.processes[1], message)
+	}
+	waitFor(t, "the deliveries", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == len(sent) })
+	entries, err := LoadLog(messageLogFile(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(sent) {
+		t.Fatalf("the log has %d entries, want %d", len(entries), len(sent))
+	}
+	for i, entry := range entries {
+		if entry.SourceID != 1 || entry.Message != sent[i] {
+			t.Fatalf("entry %d is %q from process %d, want %q from process 1", i, entry.Message, entry.SourceID, sent[i])
+		}
+		if i > 0 && entry.LogicalTime <= entries[i-1].LogicalTime {
+			t.Fatalf("entry %d has logical time %d, not after %d", i, entry.LogicalTime, entries[i-1].LogicalTime)
+		}
+	}
+}
+
+// TestJoinRunningCluster lets a fourth process join a running cluster of three through one of them
+// and checks that it learns every member and can then send to all of them.
+func TestJoinRunningCluster(t *testing.T) {
+	config := newTestConfig(t, 4)
+	// The cluster starts without the newcomer, whose configuration only lists itself
+	clusterConfig, joinConfig := *config, *config
+	clusterConfig.Processes, joinConfig.Processes = config.Processes[:3], config.Processes[3:]
+	cluster := startCluster(t, &clusterConfig)
+	// Multicasts sent before the join must not hold back the ones sent after it at the newcomer
+	multicast_send(cluster.processes[1], "before")
+	waitFor(t, "the members to deliver the first message", func() bool {
+		return len(cluster.outputs[2].Lines("Received message: before")) == 1 && len(cluster.outputs[3].Lines("Received message: before")) == 1
+	})
+	newcomer := cluster.launch(t, &joinConfig, joinConfig.Processes[0])
+	if err := join_cluster(newcomer, "127.0.0.1", config.Processes[0].Port); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the newcomer to learn the members", func() bool { return len(newcomer.memberList()) == 4 })
+	for id := 1; id <= 4; id++ {
+		cluster.waitConnected(t, id)
+	}
+	multicast_send(newcomer, "hello")
+	waitFor(t, "every member to deliver the message", func() bool {
+		for id := 1; id <= 3; id++ {
+			if len(cluster.outputs[id].Lines("Received message: hello from process 4")) != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	multicast_send(cluster.processes[1], "after")
+	waitFor(t, "the newcomer to deliver the second message", func() bool {
+		return len(cluster.outputs[4].Lines("Received message: after from process 1")) == 1
+	})
+}
+
+// TestLeaveIsNotFailure makes one of three processes leave and checks that the others drop it from their
+// membership and stop watching it, so it is never reported as failed once its heartbeats stop.
+func TestLeaveIsNotFailure(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.HeartbeatInterval = 20 * time.Millisecond
+	cluster := startCluster(t, config)
+	leave_cluster(cluster.processes[3])
+	for _, id := range []int{1, 2} {
+		p := cluster.processes[id]
+		waitFor(t, fmt.Sprintf("process %d to remove process 3", id), func() bool {
+			for _, member := range p.memberList() {
+				if member.ID == 3 {
+					return false
+				}
+			}
+			_, connected := p.connections.Get(3)
+			return !connected
+		})
+	}
+	// Leave enough time for a failure to be detected, were process 3 still watched
+	time.Sleep(2 * FailAfterMissed * config.HeartbeatInterval)
+	for _, id := range []int{1, 2} {
+		if status, ok := cluster.processes[id].detector.Members()[3]; ok {
+			t.Fatalf("process %d still watches process 3, which is %s", id, status)
+		}
+	}
+}
+
+// TestExtraLeaveAckDoesNotBlock checks that a leave ack arriving while the channel collecting them is full
+// is dropped instead of blocking the receive loop with the process mutex held.
+func TestExtraLeaveAckDoesNotBlock(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[1]
+	p.mu.Lock()
+	p.leaveAcks = make(chan int)
+	p.mu.Unlock()
+	handled := make(chan struct{})
+	go func() {
+		handleMessage(p, UnicastMessage{Kind: KindLeaveAck, SourceID: 2})
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handling the leave ack blocked")
+	}
+	p.mu.Lock()
+	p.leaveAcks = nil
+	p.mu.Unlock()
+}
+
+// TestPrintConnections checks that the conns command lists every outgoing connection of a process,
+// ordered by process ID, with the address of the peer and a successful last write.
+func TestPrintConnections(t *testing.T) {
+	output := captureOutput(t)
+	config := newTestConfig(t, 3)
+	transport := newTCPTransport(t, config)
+	cluster := startClusterOver(t, config, transport)
+	multicast_send(cluster.processes[3], "hello")
+	waitFor(t, "the deliveries", func() bool {
+		return len(cluster.outputs[1].Lines("Received message: hello")) == 1 && len(cluster.outputs[2].Lines("Received message: hello")) == 1
+	})
+	// Process 3 dialed both its peers, so the remote addresses are their listening addresses
+	printConnections(cluster.processes[3])
+	var want []string
+	for _, process := range config.Processes[:2] {
+		want = append(want, fmt.Sprintf("Process %d: remote address %s, last write ok, ", process.ID, net.JoinHostPort(process.IP, process.Port)))
+	}
+	waitFor(t, "the connection list", func() bool { return len(output.Lines("remote address")) == len(want) })
+	// The write counts that follow include heartbeats, so only the start of each line is checked
+	got := output.Lines("remote address")
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Fatalf("printed %q, want lines starting with %q", got, want)
+		}
+	}
+}
+
+// TestConnectionManagerConcurrentUse adds, looks up, lists and removes connections from many goroutines at once.
+// Run with -race, it checks that the manager needs no locking by its callers.
+func TestConnectionManagerConcurrentUse(t *testing.T) {
+	config := newConfig(0, 0)
+	manager := NewConnectionManager()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := (worker + i) % 8
+				local, remote := net.Pipe()
+				defer remote.Close()
+				if !manager.Add(id, newPeerConn(local, NewGobCodec(local, config.MaxMessageBytes), config)) {
+					local.Close()
+				}
+				// Another goroutine may have removed it in between
+				manager.Get(id)
+				manager.IDs()
+				manager.Remove((id + 1) % 8)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	manager.CloseAll()
+	if ids := manager.IDs(); len(ids) != 0 {
+		t.Fatalf("%v are still connected after CloseAll", ids)
+	}
+	if manager.Add(1, nil) {
+		t.Fatal("a closed manager accepted a connection")
+	}
+}
+
+// TestSingleConnectionPerPair checks that every pair of processes shares one TCP connection, seen from
+// both sides, and that a message and its acknowledgment both travel over it.
+func TestSingleConnectionPerPair(t *testing.T) {
+	config := newTestConfig(t, 3)
+	transport := newTCPTransport(t, config)
+	cluster := startClusterOver(t, config, transport)
+	for a := 1; a <= 3; a++ {
+		for b := a + 1; b <= 3; b++ {
+			peerA, _ := cluster.processes[a].connections.Get(b)
+			peerB, _ := cluster.processes[b].connections.Get(a)
+			if peerA.conn.LocalAddr().String() != peerB.conn.RemoteAddr().String() || peerA.conn.RemoteAddr().String() != peerB.conn.LocalAddr().String() {
+				t.Fatalf("processes %d and %d use different connections: %s->%s and %s->%s", a, b,
+					peerA.conn.LocalAddr(), peerA.conn.RemoteAddr(), peerB.conn.LocalAddr(), peerB.conn.RemoteAddr())
+			}
+		}
+	}
+	// Process 1 dialed no one, its connections were all accepted
+	if err := unicast_send(cluster.processes[1], 3, newMessage(1, "hello", cluster.processes[1].clock, cluster.processes[1].causal)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the acknowledgment", func() bool { return len(cluster.outputs[1].Lines("ACK received for seq 1 from process 3")) == 1 })
+}
+
+// TestHandshakeIDMismatch lets a process dial the configured address of process 1, where another process
+// answers with ID 7, and checks that the mismatch is logged as a warning.
+func TestHandshakeIDMismatch(t *testing.T) {
+	config := newTestConfig(t, 2)
+	transport := newTCPTransport(t, config)
+	ln, err := transport.Listen(config.Processes[0].listenAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan Codec, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		codec, err := negotiateCodec(conn, config)
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		codec.Encode(newHandshake(7))
+		accepted <- codec
+	}()
+	t.Chdir(t.TempDir())
+	output := &syncBuffer{}
+	process := config.Processes[1]
+	process.Output = output
+	p, err := launchProcess(process, config, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.Shutdown()
+		p.Wait()
+	})
+	codec, ok := <-accepted
+	if !ok {
+		t.FailNow()
+	}
+	var handshake UnicastMessage
+	if err := codec.Decode(&handshake); err != nil {
+		t.Fatal(err)
+	}
+	if handshake.Kind != KindHandshake || handshake.Handshake.ID != 2 {
+		t.Fatalf("the first message is %+v, want the handshake of process 2", handshake)
+	}
+	waitFor(t, "the warning", func() bool {
+		return len(output.Lines("warning: expected process 1 at "+config.Processes[0].dialAddress()+", but process 7 answered")) == 1
+	})
+}
+
+// TestSampleDelayModels samples many delays from each model and checks that they stay within the bounds and
+// that their mean is close to the one the model predicts.
+func TestSampleDelayModels(t *testing.T) {
+	const minDelay, maxDelay, samples = 100, 200, 20000
+	tests := []struct {
+		model string
+		mean  float64 // Expected mean in milliseconds
+	}{
+		{DelayUniform, 149.5},
+		// The exponential extra delay has a mean of 50 but is capped at 100: 50 * (1 - e^-2)
+		{DelayExponential, 100 + 50*(1-math.Exp(-2))},
+		{DelayNormal, 150},
+	}
+	for _, test := range tests {
+		t.Run(test.model, func(t *testing.T) {
+			rng := NewRandom(1)
+			var total float64
+			for i := 0; i < samples; i++ {
+				delay := sampleDelay(rng, test.model, minDelay, maxDelay)
+				if delay < minDelay*time.Millisecond || delay > maxDelay*time.Millisecond {
+					t.Fatalf("sampled %s, outside [%dms, %dms]", delay, minDelay, maxDelay)
+				}
+				total += float64(delay) / float64(time.Millisecond)
+			}
+			if mean := total / samples; math.Abs(mean-test.mean) > 2 {
+				t.Fatalf("mean delay is %.1fms, want about %.1fms", mean, test.mean)
+			}
+		})
+	}
+	// Equal bounds give a fixed delay whatever the model
+	if delay := sampleDelay(NewRandom(1), DelayNormal, 50, 50); delay != 50*time.Millisecond {
+		t.Fatalf("sampled %s with equal bounds of 50ms", delay)
+	}
+}
+
+// TestDropRate sends messages with every message lost and with none lost, and checks what is delivered.
+func TestDropRate(t *testing.T) {
+	for _, dropRate := range []float64{1, 0} {
+		t.Run(fmt.Sprint(dropRate), func(t *testing.T) {
+			config := newTestConfig(t, 2)
+			config.DropRate = dropRate
+			config.Retransmit.Timeout = 50 * time.Millisecond
+			config.LogLevel = LogDebug
+			cluster := startCluster(t, config)
+			for i := 0; i < 5; i++ {
+				multicast_send(cluster.processes[1], fmt.Sprintf("m%d", i))
+			}
+			if dropRate == 0 {
+				waitFor(t, "every message", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == 5 })
+				return
+			}
+			// Wait for several retransmissions, which are lost too
+			time.Sleep(5 * config.Retransmit.Timeout)
+			if got := cluster.outputs[2].Lines("Received message: "); len(got) != 0 {
+				t.Fatalf("delivered %v, want nothing", got)
+			}
+			if got := cluster.outputs[1].Lines("dropped message to process 2"); len(got) < 5 {
+				t.Fatalf("logged %d dropped messages, want at least 5", len(got))
+			}
+		})
+	}
+}
+
+// TestSeededDelaysReproducible checks that the random sources of a process seeded from the same configured
+// seed draw the same delays, and that different processes draw different ones.
+func TestSeededDelaysReproducible(t *testing.T) {
+	config := newConfig(100, 1000)
+	config.RandSeed = 42
+	draw := func(processID int) []time.Duration {
+		rng := NewRandom(processSeed(config, processID))
+		delays := make([]time.Duration, 20)
+		for i := range delays {
+			delays[i] = randomDelay(rng, config.MinDelay, config.MaxDelay)
+		}
+		return delays
+	}
+	first, second := draw(1), draw(1)
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("two runs with the same seed drew %v and %v", first, second)
+	}
+	if other := draw(2); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Fatalf("processes 1 and 2 drew the same delays %v", first)
+	}
+}
+
+// TestSendErrors checks that Send delivers to a connected process and returns an error for a destination
+// it has no connection to.
+func TestSendErrors(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[1]
+	if err := p.Send(7, "hello"); err == nil || err.Error() != "no connection to process 7: not a member of the cluster" {
+		t.Fatalf("sending to process 7 returned %v, want %q", err, "no connection to process 7: not a member of the cluster")
+	}
+	if err := p.Send(2, "hello"); err != nil {
+		t.Fatalf("sending to process 2 returned %v", err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: hello from process 1")) == 1 })
+}
+
+// TestDialWithRetry dials a port that only starts listening after the second failed attempt, with enough
+// attempts to reach it and with too few.
+func TestDialWithRetry(t *testing.T) {
+	// Attempts are made after 0, 100 and 300ms, the listener opens after 200ms
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, Backoff: BackoffLinear}
+	transport := newTCPTransport(t, newConfig(0, 0))
+	tests := []struct {
+		attempts int
+		ok       bool
+	}{
+		{3, true},
+		{2, false},
+	}
+	for _, test := range tests {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+		opened := make(chan net.Listener, 1)
+		time.AfterFunc(2*policy.BaseDelay, func() {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Error(err)
+			}
+			opened <- ln
+		})
+		policy.MaxAttempts = test.attempts
+		conn, err := dialWithRetry(transport, addr, policy, systemClock{})
+		if test.ok != (err == nil) {
+			t.Fatalf("%d attempts: got error %v, want success %v", test.attempts, err, test.ok)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		if ln := <-opened; ln != nil {
+			ln.Close()
+		}
+	}
+	// A linear backoff waits one more base delay after every attempt
+	for attempt := 1; attempt <= 3; attempt++ {
+		if got := policy.pause(attempt); got != time.Duration(attempt)*policy.BaseDelay {
+			t.Fatalf("pause after attempt %d is %s", attempt, got)
+		}
+	}
+	// An exponential one doubles, with jitter down to half the pause
+	exponential := RetryPolicy{BaseDelay: 10 * time.Millisecond, Backoff: BackoffExponential}
+	for attempt := 1; attempt <= 4; attempt++ {
+		full := exponential.BaseDelay << (attempt - 1)
+		if got := exponential.pause(attempt); got < full/2 || got > full {
+			t.Fatalf("pause after attempt %d is %s, want between %s and %s", attempt, got, full/2, full)
+		}
+	}
+}
+
+// TestParseConfigJSONMatchesText parses the same configuration in the plain text and the JSON format and
+// checks that both give the same Config.
+func TestParseConfigJSONMatchesText(t *testing.T) {
+	text := writeFile(t, "config.txt", `100 200
+retransmit 500 3
+retry 3 50 exponential
+1 127.0.0.1 8001
+2 127.0.0.1 8002 0.0.0.0
+`)
+	document := writeFile(t, "config.json", `{
+	"minDelay": 100,
+	"maxDelay": 200,
+	"options": ["retransmit 500 3", "retry 3 50 exponential"],
+	"processes": [
+		{"id": 1, "ip": "127.0.0.1", "port": 8001},
+		{"id": 2, "ip": "127.0.0.1", "port": 8002, "bindAddr": "0.0.0.0"}
+	]
+}`)
+	fromText, err := ParseConfigFile(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParseConfigFile(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromText, fromJSON) {
+		t.Fatalf("the text format gives\n%+v\nthe JSON format gives\n%+v", fromText, fromJSON)
+	}
+	if fromJSON.Retransmit.Timeout != 500*time.Millisecond || fromJSON.Retry.Backoff != BackoffExponential {
+		t.Fatalf("the options were not applied: %+v", fromJSON)
+	}
+}
+
+// TestStartProcessPortInUse starts a process on a TCP port another listener holds and checks that startProcess
+// returns the address in use error right away.
+func TestStartProcessPortInUse(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	config := newConfig(0, 0)
+	config.Processes = []Process{{ID: 1, IP: "127.0.0.1", Port: port, BindAddr: "127.0.0.1"}}
+	transport := newTCPTransport(t, config)
+	if err := startProcess(config.Processes[0], config, transport); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("got error %v, want address already in use", err)
+	}
+}
+
+// TestCodecRoundTrip encodes messages with each codec and checks that decoding gives them back unchanged.
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []UnicastMessage{
+		{Kind: KindData, SourceID: 1, Message: "hello, world", Timestamp: 3, Vector: VectorClock{1: 2, 2: 1}, Seq: 4},
+		{Kind: KindAck, SourceID: 2, Ack: &AckMessage{SenderID: 1, Seq: 4}},
+		{Kind: KindHeartbeat, SourceID: 3, Heartbeat: &HeartbeatMessage{Count: 7}},
+	}
+	for _, name := range []string{CodecGob, CodecJSON} {
+		t.Run(name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			// A pipe has no buffer, so the messages are written while they are read
+			go func() {
+				codec := NewCodec(name, local, DefaultMaxMessageBytes)
+				for _, msg := range messages {
+					if err := codec.Encode(msg); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			codec := NewCodec(name, remote, DefaultMaxMessageBytes)
+			for _, want := range messages {
+				var got UnicastMessage
+				if err := codec.Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("decoded %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestControlSend posts a message to the /send endpoint of one process and checks that its destination delivers it.
+func TestControlSend(t *testing.T) {
+	config := newTestConfig(t, 2)
+	// The endpoint of process 1 listens on ControlPort + 1
+	port := freePort(t)
+	config.ControlPort = port - 1
+	cluster := startCluster(t, config)
+	url := fmt.Sprintf("http://127.0.0.1:%d/send", port)
+	response, err := http.Post(url, "application/json", strings.NewReader(`{"dest": 2, "message": "over http"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %s, want 202 Accepted", response.Status)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: over http from process 1")) == 1 })
+	// An unknown destination is refused
+	response, err = http.Post(url, "application/json", strings.NewReader(`{"dest": 9, "message": "lost"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %s for an unknown destination, want 404 Not Found", response.Status)
+	}
+}
+
+// TestSendStatus checks the HTTP status /send answers with for every error Send can return.
+func TestSendStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("no connection to process 9: %w", errUnknownDestination), http.StatusNotFound},
+		{fmt.Errorf("no connection to process 9: %w", errIsolated), http.StatusServiceUnavailable},
+		{fmt.Errorf("process 1 is %w", errShuttingDown), http.StatusServiceUnavailable},
+		{fmt.Errorf("cannot send to process 2: %w", errCircuitOpen), http.StatusServiceUnavailable},
+		{fmt.Errorf("%w, 64 messages to process 2 are waiting for the connection", errOutboxFull), http.StatusTooManyRequests},
+		{fmt.Errorf("%w: 70000 bytes", errMessageTooLarge), http.StatusRequestEntityTooLarge},
+		{errors.New("process 1 cannot send to itself"), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if got := sendStatus(test.err); got != test.want {
+			t.Errorf("status for %q is %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+// TestTrafficStatsCounts records a number of messages exchanged with two peers and checks the counters of each.
+func TestTrafficStatsCounts(t *testing.T) {
+	stats := NewTrafficStats(systemClock{})
+	msg := UnicastMessage{Kind: KindData, SourceID: 1, Message: "hello", Vector: VectorClock{1: 1, 2: 0}}
+	const sent, received = 7, 3
+	for i := 0; i < sent; i++ {
+		stats.RecordSent(2, msg)
+	}
+	for i := 0; i < received; i++ {
+		stats.RecordReceived(3, msg)
+	}
+	snapshot := stats.Snapshot()
+	if got := snapshot[2]; got.Sent != sent || got.BytesSent != sent*messageSize(msg) || got.Received != 0 {
+		t.Fatalf("stats of process 2 are %+v, want %d sent", got, sent)
+	}
+	if got := snapshot[3]; got.Received != received || got.BytesReceived != received*messageSize(msg) || got.Sent != 0 {
+		t.Fatalf("stats of process 3 are %+v, want %d received", got, received)
+	}
+}
+
+// TestFIFODeliveryDecreasingDelays sends three messages with decreasing delays, so they arrive in reverse order,
+// and checks that they are delivered in send order.
+func TestFIFODeliveryDecreasingDelays(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[1]
+	for i, delay := range []time.Duration{150, 75, 0} {
+		msg := newMessage(p.ID, fmt.Sprintf("m%d", i+1), p.clock, p.causal)
+		unicast_send_with_delay(p, 2, msg, delay*time.Millisecond)
+	}
+	waitFor(t, "the deliveries", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == 3 })
+	if got := strings.Join(cluster.outputs[2].Messages("Received message: "), " "); got != "m1 m2 m3" {
+		t.Fatalf("delivered %s, want m1 m2 m3", got)
+	}
+}
+
+// TestUnicastsToDifferentPeers checks that messages sent to one process each do not hold each other back,
+// and that a multicast sent after them is still delivered everywhere.
+func TestUnicastsToDifferentPeers(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	p := cluster.processes[1]
+	if err := p.Send(2, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(3, "b"); err != nil {
+		t.Fatal(err)
+	}
+	multicast_send(p, "c")
+	for id, want := range map[int]string{2: "a c", 3: "b c"} {
+		waitFor(t, fmt.Sprintf("the deliveries at process %d", id), func() bool {
+			return len(cluster.outputs[id].Lines("Received message: ")) == 2
+		})
+		if got := strings.Join(cluster.outputs[id].Messages("Received message: "), " "); got != want {
+			t.Fatalf("process %d delivered %s, want %s", id, got, want)
+		}
+	}
+}
+
+// TestConcurrentDelayedSends fires many delayed sends to one peer at once and checks that the receiver
+// decodes and delivers all of them without breaking the connection.
+func TestConcurrentDelayedSends(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.MaxDelay = 20
+	cluster := startCluster(t, config)
+	const sends = 200
+	var wg sync.WaitGroup
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := cluster.processes[1].Send(2, fmt.Sprintf("m%d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitFor(t, "every delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == sends })
+	for id, output := range cluster.outputs {
+		if lines := output.Lines("closing connection"); len(lines) != 0 {
+			t.Fatalf("process %d broke a connection: %v", id, lines)
+		}
+	}
+}
+
+// TestSendExceptUnknownProcess checks that sendexcept refuses to exclude a process that is not a member,
+// and sends to every other process otherwise.
+func TestSendExceptUnknownProcess(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	if _, err := multicast_send_except(cluster.processes[1], 9, "hello"); err == nil || err.Error() != "process 9 is not a member of the cluster" {
+		t.Fatalf("excluding process 9 returned %v", err)
+	}
+	sent, err := multicast_send_except(cluster.processes[1], 3, "hello")
+	if err != nil || sent != 1 {
+		t.Fatalf("excluding process 3 sent to %d processes with error %v, want 1", sent, err)
+	}
+	waitFor(t, "process 2 to receive", func() bool { return len(cluster.outputs[2].Lines("Received message: hello from process 1")) == 1 })
+	// Give a delivery to the excluded process time to show up
+	time.Sleep(50 * time.Millisecond)
+	if lines := cluster.outputs[3].Lines("Received message: "); len(lines) != 0 {
+		t.Fatalf("the excluded process delivered %v", lines)
+	}
+}
+
+// TestBlocklistPartition cuts a receiver off from a sender, checks that a message sent meanwhile is not delivered
+// and that delivery resumes once the sender is unblocked, over the same connection.
+func TestBlocklistPartition(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	sender, receiver, output := cluster.processes[1], cluster.processes[2], cluster.outputs[2]
+	conn, _ := receiver.connections.Get(1)
+	receiver.blocked.Block(1)
+	if err := sender.Send(2, "partitioned"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if lines := output.Lines("Received message: "); len(lines) != 0 {
+		t.Fatalf("the blocked peer delivered %v", lines)
+	}
+	receiver.blocked.Unblock(1)
+	if err := sender.Send(2, "healed"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery after unblocking", func() bool {
+		return len(output.Lines("Received message: healed from process 1")) == 1
+	})
+	if after, _ := receiver.connections.Get(1); after != conn {
+		t.Fatal("the connection was replaced while the peer was blocked")
+	}
+}
+
+// TestISISMulticastIdenticalOrder lets three processes multicast with the ISIS agreement at the same time,
+// with every message of the three phases arriving after its own random delay, and checks that all of them
+// deliver the multicasts in the same order.
+func TestISISMulticastIdenticalOrder(t *testing.T) {
+	const processes, perProcess = 3, 5
+	states := make(map[int]*ISISState)
+	// Indexed by process ID, so each process appends to its own slice only
+	delivered := make([][]string, processes+1)
+	for id := 1; id <= processes; id++ {
+		states[id] = NewISISState()
+	}
+	var wg sync.WaitGroup
+	// send runs a step of the protocol on another process after a random delay
+	send := func(step func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+			step()
+		}()
+	}
+	// deliver runs with the lock of the receiving state held
+	agree := func(id int, agreed ISISMessage) {
+		states[id].Agree(agreed, func(msg ISISMessage) { delivered[id] = append(delivered[id], msg.Message) })
+	}
+	propose := func(origin int, proposal ISISMessage) {
+		agreed, destinations, done := states[origin].AddProposal(proposal)
+		if !done {
+			return
+		}
+		for _, id := range destinations {
+			send(func() { agree(id, agreed) })
+		}
+		agree(origin, agreed)
+	}
+	for origin := 1; origin <= processes; origin++ {
+		wg.Add(1)
+		go func(origin int) {
+			defer wg.Done()
+			var destinations []int
+			for id := 1; id <= processes; id++ {
+				if id != origin {
+					destinations = append(destinations, id)
+				}
+			}
+			for n := 0; n < perProcess; n++ {
+				msg := states[origin].Start(origin, fmt.Sprintf("%d-%d", origin, n), destinations)
+				for _, id := range destinations {
+					send(func() {
+						proposal := states[id].Propose(id, msg)
+						send(func() { propose(origin, proposal) })
+					})
+				}
+				propose(origin, states[origin].Propose(origin, msg))
+			}
+		}(origin)
+	}
+	wg.Wait()
+	for id := 1; id <= processes; id++ {
+		if len(delivered[id]) != processes*perProcess {
+			t.Fatalf("process %d delivered %d multicasts, want %d", id, len(delivered[id]), processes*perProcess)
+		}
+		if !reflect.DeepEqual(delivered[id], delivered[1]) {
+			t.Fatalf("process %d delivered %v, process 1 delivered %v", id, delivered[id], delivered[1])
+		}
+	}
+}
+
+// TestNakRecoversDroppedMessage plays a sender whose middle one of three messages is lost, and checks that the
+// receiver reports the gap with a NAK and delivers all three in send order once the missing one is resent.
+// It then sends a NAK to the process and checks that it resends the message from its send history.
+func TestNakRecoversDroppedMessage(t *testing.T) {
+	p, output, peer := launchWithFakePeer(t, newTestConfig(t, 2))
+	message := func(seq int) UnicastMessage {
+		return UnicastMessage{Kind: KindData, SourceID: 2, Message: fmt.Sprintf("m%d", seq), Timestamp: seq, Vector: VectorClock{2: seq}, Seq: seq}
+	}
+	for _, seq := range []int{1, 3} {
+		if err := peer.codec.Encode(message(seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		msg := peer.receive(t, time.Second)
+		if msg.Kind == KindNak {
+			if msg.Nak.SenderID != 2 || msg.Nak.From != 2 || msg.Nak.To != 2 {
+				t.Fatalf("got NAK %+v, want seq 2-2 of process 2", *msg.Nak)
+			}
+			break
+		}
+	}
+	if err := peer.codec.Encode(message(2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the deliveries", func() bool { return len(output.Lines("Received message: ")) == 3 })
+	if got := strings.Join(output.Messages("Received message: "), " "); got != "m1 m2 m3" {
+		t.Fatalf("delivered %s, want m1 m2 m3", got)
+	}
+
+	// The other way around, the process resends what the fake peer reports missing
+	for _, text := range []string{"a", "b", "c"} {
+		if err := p.Send(2, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for received := 0; received < 3; {
+		if msg := peer.receive(t, time.Second); msg.Kind == KindData {
+			received++
+		}
+	}
+	nak := UnicastMessage{Kind: KindNak, SourceID: 2, Nak: &NakMessage{SenderID: 1, From: 2, To: 2}}
+	if err := peer.codec.Encode(nak); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg := peer.receive(t, time.Second)
+		if msg.Kind == KindData {
+			if msg.Seq != 2 || msg.Message != "b" {
+				t.Fatalf("resent %+v, want b with seq 2", msg)
+			}
+			break
+		}
+	}
+}
+
+// TestHistoryReplay types commands into a process and checks that history lists only the ones that parsed,
+// and that replay runs the last of them again.
+func TestHistoryReplay(t *testing.T) {
+	output := captureOutput(t)
+	cluster := startCluster(t, newTestConfig(t, 2))
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = reader
+	t.Cleanup(func() { os.Stdin = stdin })
+	done := make(chan struct{})
+	go func() {
+		handleUserInput(cluster.processes[1])
+		close(done)
+	}()
+	io.WriteString(writer, "msend hello\nbogus\nsendexcept 9 hello\nhistory\n")
+	waitFor(t, "the history", func() bool { return len(output.Lines("1: msend hello")) == 1 })
+	io.WriteString(writer, "replay 1\n")
+	writer.Close()
+	<-done
+	waitFor(t, "the replayed delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: hello from process 1")) == 2 })
+	for _, line := range output.Lines(": ") {
+		if strings.HasPrefix(line, "2: ") {
+			t.Fatalf("the history holds a command that did not parse: %q", line)
+		}
+	}
+	if lines := output.Lines("Replaying: msend hello"); len(lines) != 1 {
+		t.Fatalf("replayed %v, want msend hello once", lines)
+	}
+}
+
+// TestParseArgs parses command lines and checks the configuration file and the process they select.
+func TestParseArgs(t *testing.T) {
+	config := newTestConfig(t, 3)
+	tests := []struct {
+		args     []string
+		envID    string
+		filename string
+		want     []int // IDs of the processes to start, nil if parsing fails
+	}{
+		{nil, "", "config.txt", []int{1, 2, 3}},
+		{[]string{"other.txt"}, "", "other.txt", []int{1, 2, 3}},
+		{[]string{"--process", "2"}, "", "config.txt", []int{2}},
+		{[]string{"other.txt", "--id", "3"}, "", "other.txt", []int{3}},
+		{[]string{"-id=1", "other.txt"}, "", "other.txt", []int{1}},
+		{nil, "2", "config.txt", []int{2}},
+		{[]string{"--id", "3"}, "2", "config.txt", []int{3}},
+		{[]string{"--id", "x"}, "", "", nil},
+		{[]string{"a.txt", "b.txt"}, "", "", nil},
+		{[]string{"--id", "4"}, "", "config.txt", nil},
+	}
+	for _, test := range tests {
+		filename, processID, single, err := parseArgs(test.args, test.envID)
+		var processes []Process
+		if err == nil {
+			processes, err = selectProcesses(config, processID, single)
+		}
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q with PROCESS_ID=%q selected %d processes, want an error", test.args, test.envID, len(processes))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q with PROCESS_ID=%q: %v", test.args, test.envID, err)
+			continue
+		}
+		var ids []int
+		for _, process := range processes {
+			ids = append(ids, process.ID)
+		}
+		if filename != test.filename || !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%q with PROCESS_ID=%q selected %v from %s, want %v from %s", test.args, test.envID, ids, filename, test.want, test.filename)
+		}
+	}
+}
+
+// TestLoggerLevels checks that the logger prefixes every line with the process ID, discards messages less
+// severe than its level, and that acknowledgments are logged at the info level.
+func TestLoggerLevels(t *testing.T) {
+	for _, level := range []LogLevel{LogDebug, LogInfo, LogError} {
+		output := &syncBuffer{}
+		logger := NewLogger(3, level, output)
+		logger.Debugf("debug %d", 1)
+		logger.Infof("info %d", 2)
+		logger.Errorf("error %d", 3)
+		var want []string
+		for _, line := range []struct {
+			level LogLevel
+			text  string
+		}{{LogDebug, "[P3] debug 1"}, {LogInfo, "[P3] info 2"}, {LogError, "[P3] error 3"}} {
+			if line.level >= level {
+				want = append(want, line.text)
+			}
+		}
+		if got := output.Lines("[P3] "); !reflect.DeepEqual(got, want) {
+			t.Fatalf("level %d printed %q, want %q", level, got, want)
+		}
+	}
+	config := newTestConfig(t, 2)
+	config.LogLevel = LogInfo
+	cluster := startCluster(t, config)
+	multicast_send(cluster.processes[1], "hello")
+	waitFor(t, "the acknowledgment", func() bool {
+		return len(cluster.outputs[1].Lines("[P1] ACK received for seq 1 from process 2")) == 1
+	})
+	if lines := cluster.outputs[2].Lines("Received message: hello from process 1"); len(lines) != 1 || !strings.HasPrefix(lines[0], "[P2] ") {
+		t.Fatalf("process 2 printed %q, want the delivery prefixed with [P2]", lines)
+	}
+}
+
+// TestSnapshotConsistent takes a snapshot of three processes while messages between them are in flight
+// and checks that every message sent before the sender recorded its state was either received before
+// the receiver recorded its state or recorded on the channel.
+func TestSnapshotConsistent(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.MaxDelay = 50
+	cluster := startCluster(t, config)
+	const perPeer = 10
+	var wg sync.WaitGroup
+	for id, p := range cluster.processes {
+		wg.Add(1)
+		go func(id int, p *Process) {
+			defer wg.Done()
+			for i := 0; i < perPeer; i++ {
+				for peerID := range cluster.processes {
+					if peerID != id {
+						if err := p.Send(peerID, fmt.Sprintf("m%d.%d", id, i)); err != nil {
+							t.Error(err)
+						}
+					}
+				}
+				if id == 1 && i == perPeer/2 {
+					start_snapshot(p)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(id, p)
+	}
+	wg.Wait()
+	snapshots := make(map[int]Snapshot)
+	for id := range cluster.processes {
+		waitFor(t, fmt.Sprintf("process %d to record the snapshot", id), func() bool { return len(cluster.outputs[id].Lines("Recorded snapshot 1-1")) > 0 })
+		data, err := os.ReadFile(snapshotFile(id, "1-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		snapshots[id] = snapshot
+	}
+	inFlight := 0
+	for from, sender := range snapshots {
+		for to, receiver := range snapshots {
+			if from == to {
+				continue
+			}
+			recorded := receiver.Received[from] + len(receiver.Channels[from])
+			if sender.Sent[to] != recorded {
+				t.Errorf("process %d sent %d messages to process %d before the snapshot, which has %d received and %v in flight",
+					from, sender.Sent[to], to, receiver.Received[from], receiver.Channels[from])
+			}
+			inFlight += len(receiver.Channels[from])
+		}
+	}
+	t.Logf("%d messages were recorded in flight", inFlight)
+}
+
+// TestBullyElectionAfterLeaderRemoved elects a leader among four processes, crashes the leader and checks
+// that the failure detector makes the others elect the highest remaining process.
+func TestBullyElectionAfterLeaderRemoved(t *testing.T) {
+	config := newTestConfig(t, 4)
+	config.HeartbeatInterval = 50 * time.Millisecond
+	cluster := startCluster(t, config)
+	waitLeader := func(leaderID int, ids ...int) {
+		t.Helper()
+		for _, id := range ids {
+			waitFor(t, fmt.Sprintf("process %d to follow process %d", id, leaderID), func() bool {
+				leader, _ := cluster.processes[id].election.Leader()
+				return leader == leaderID
+			})
+		}
+	}
+	start_election(cluster.processes[1])
+	waitLeader(4, 1, 2, 3, 4)
+	// The losers keep waiting for an announcement until CoordinatorTimeout, and ignore new elections until then
+	for id, p := range cluster.processes {
+		waitWithin(t, ElectionTimeout+CoordinatorTimeout+5*time.Second, fmt.Sprintf("process %d to finish the election", id), func() bool {
+			p.election.mu.Lock()
+			defer p.election.mu.Unlock()
+			return !p.election.running
+		})
+	}
+	cluster.processes[4].Shutdown()
+	waitLeader(3, 1, 2, 3)
+}
+
+// TestOrderedPutReachesAllReplicas writes a key on one process and checks that every replica applies it.
+func TestOrderedPutReachesAllReplicas(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	ordered_put(cluster.processes[2], "color", "blue")
+	for id, p := range cluster.processes {
+		waitFor(t, fmt.Sprintf("process %d to apply the put", id), func() bool {
+			value, ok := p.kv.Get("color")
+			return ok && value == "blue"
+		})
+	}
+}
+
+// TestKVStoreLastWriterWins applies two conflicting puts to replicas in both orders and checks that every replica
+// keeps the value with the higher timestamp, or of the higher process ID when the timestamps are equal.
+func TestKVStoreLastWriterWins(t *testing.T) {
+	tests := []struct {
+		first, second PutMessage
+		want          string
+	}{
+		{PutMessage{Key: "k", Value: "old", Timestamp: 3, ProcessID: 2}, PutMessage{Key: "k", Value: "new", Timestamp: 5, ProcessID: 1}, "new"},
+		{PutMessage{Key: "k", Value: "low", Timestamp: 4, ProcessID: 1}, PutMessage{Key: "k", Value: "high", Timestamp: 4, ProcessID: 2}, "high"},
+	}
+	for _, test := range tests {
+		for _, order := range [][]PutMessage{{test.first, test.second}, {test.second, test.first}} {
+			replica := NewKVStore()
+			for _, put := range order {
+				replica.Put(put)
+			}
+			if value, _ := replica.Get("k"); value != test.want {
+				t.Errorf("after %+v the value is %q, want %q", order, value, test.want)
+			}
+		}
+	}
+}
+
+// countingConn struct is a connection counting the bytes written to it.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64 // Bytes written so far
+}
+
+// Write function writes p to the connection and counts it.
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// tcpPair function returns both ends of a loopback TCP connection, closed when the test ends.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	end1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	end2, err := ln.Accept()
+	if err != nil {
+		end1.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		end1.Close()
+		end2.Close()
+	})
+	return end1, end2
+}
+
+// TestCompressionWireSize sends a highly compressible 1MB message over a compressed connection and checks that
+// far fewer bytes cross the wire while the decoded message is unchanged.
+func TestCompressionWireSize(t *testing.T) {
+	config := newConfig(0, 0)
+	config.Compression = true
+	// Both ends write their choice before reading the other's, which needs a buffered connection
+	end1, end2 := tcpPair(t)
+	wire := &countingConn{Conn: end1}
+	codecs := make(chan Codec, 1)
+	go func() {
+		codec, err := negotiateCodec(end2, config)
+		if err != nil {
+			t.Error(err)
+		}
+		codecs <- codec
+	}()
+	sender, err := negotiateCodec(wire, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := <-codecs
+	if receiver == nil {
+		t.FailNow()
+	}
+	msg := UnicastMessage{Kind: KindData, SourceID: 1, Message: strings.Repeat("compressible ", 1<<20/13)}
+	sent := make(chan error, 1)
+	go func() { sent <- sender.Encode(msg) }()
+	var got UnicastMessage
+	if err := receiver.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if got.Message != msg.Message {
+		t.Fatalf("decoded a message of %d bytes, want the %d bytes sent", len(got.Message), len(msg.Message))
+	}
+	if written := wire.written.Load(); written > int64(len(msg.Message)/10) {
+		t.Fatalf("%d bytes crossed the wire for a message of %d bytes", written, len(msg.Message))
+	}
+}
+
+// writeSelfSignedCert function writes a self-signed certificate for 127.0.0.1 and its key to a temporary directory
+// of the test and returns their paths. The certificate is its own CA.
+func writeSelfSignedCert(t *testing.T) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mp1 test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+// TestTLSTransport exchanges a message over a TLS connection between two ends sharing a self-signed certificate,
+// then checks that a plaintext dialer is rejected.
+func TestTLSTransport(t *testing.T) {
+	config := newConfig(0, 0)
+	config.TLSCert, config.TLSKey = writeSelfSignedCert(t)
+	config.TLSCA = config.TLSCert
+	transport := newTCPTransport(t, config)
+	listener, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Accept two connections: the TLS one receives a message, the plaintext one must fail to negotiate
+	received := make(chan string, 1)
+	rejected := make(chan error, 1)
+	go func() {
+		for _, result := range []func(Codec, error){
+			func(codec Codec, err error) {
+				var msg UnicastMessage
+				if err == nil {
+					err = codec.Decode(&msg)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				received <- msg.Message
+			},
+			func(codec Codec, err error) { rejected <- err },
+		} {
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			result(negotiateCodec(conn, config))
+		}
+	}()
+	conn, err := transport.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	codec, err := negotiateCodec(conn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.Encode(UnicastMessage{Kind: KindData, SourceID: 1, Message: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-received; message != "secret" {
+		t.Fatalf("received %q over TLS, want secret", message)
+	}
+	plain, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	// Write what a plaintext process writes first: its negotiation byte and its handshake
+	plainCodec := NewGobCodec(plain, DefaultMaxMessageBytes)
+	go func() {
+		plain.Write([]byte{0})
+		plainCodec.Encode(newHandshake(2))
+	}()
+	if err := <-rejected; err == nil {
+		t.Fatal("the TLS listener accepted a plaintext dialer")
+	}
+	var msg UnicastMessage
+	if err := plainCodec.Decode(&msg); err == nil {
+		t.Fatalf("the plaintext dialer received %+v", msg)
+	}
+}
+
+// keepAliveEnabled function reads whether the SO_KEEPALIVE option is set on a TCP connection.
+func keepAliveEnabled(t *testing.T, conn *net.TCPConn) bool {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value != 0
+}
+
+// TestSetKeepAlive turns keepalive on and off on a TCP connection and checks the socket option,
+// and that an in-memory connection is accepted without anything to configure.
+func TestSetKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tcpConn := conn.(*net.TCPConn)
+	if err := setKeepAlive(conn, 0); err != nil || keepAliveEnabled(t, tcpConn) {
+		t.Fatalf("keepalive is still on after disabling it: %v", err)
+	}
+	if err := setKeepAlive(conn, 2*time.Second); err != nil || !keepAliveEnabled(t, tcpConn) {
+		t.Fatalf("keepalive is off after enabling it: %v", err)
+	}
+	end1, end2 := net.Pipe()
+	defer end1.Close()
+	defer end2.Close()
+	if err := setKeepAlive(end1, DefaultKeepAlive); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSendTimeout sends to a peer that never reads and checks that the send fails with a timeout
+// instead of blocking, and that the connection reports the failed write.
+func TestSendTimeout(t *testing.T) {
+	config := newConfig(0, 0)
+	config.WriteTimeout = 50 * time.Millisecond
+	end1, end2 := net.Pipe()
+	defer end2.Close()
+	peer := newPeerConn(end1, NewCodec(config.Codec, end1, config.MaxMessageBytes), config)
+	defer peer.close()
+	sent := make(chan error, 1)
+	go func() { sent <- peer.send(UnicastMessage{Kind: KindData, SourceID: 1, Message: "hello"}) }()
+	select {
+	case err := <-sent:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("the send returned %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the send to a peer that never reads is still blocked")
+	}
+	if last := peer.lastWrite(); !strings.HasPrefix(last, "failed: ") {
+		t.Fatalf("the last write is reported as %q after the timeout", last)
+	}
+}
+
+// TestConnectionClosedMidStream closes a connection while messages are being sent on it and checks that
+// the receiver logs the disconnection as normal and keeps running.
+func TestConnectionClosedMidStream(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	peer, _ := cluster.processes[1].connections.Get(2)
+	for i := 0; i < 20; i++ {
+		cluster.processes[1].Send(2, fmt.Sprintf("m%d", i))
+		if i == 10 {
+			peer.conn.Close()
+		}
+	}
+	waitFor(t, "process 2 to notice the disconnection", func() bool { return len(cluster.outputs[2].Lines("process 1 disconnected")) > 0 })
+	if lines := cluster.outputs[2].Lines("closing connection"); len(lines) != 0 {
+		t.Fatalf("the disconnection was logged as an error: %v", lines)
+	}
+	select {
+	case <-cluster.processes[2].done:
+		t.Fatal("process 2 shut down")
+	default:
+	}
+	if err := cluster.processes[2].Send(3, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "process 3 to receive from process 2", func() bool { return len(cluster.outputs[3].Lines("Received message: still here")) > 0 })
+}
+
+// TestCheckCausalOrder checks a trace delivered in causal order and the same trace with a message delivered
+// before its causal predecessor, which must be flagged.
+func TestCheckCausalOrder(t *testing.T) {
+	// Process 1 sends a, process 2 sends b after delivering a; process 3 delivers both
+	a := TraceEntry{SourceID: 1, Message: "a", Vector: VectorClock{1: 1, 2: 0, 3: 0}}
+	b := TraceEntry{SourceID: 2, Message: "b", Vector: VectorClock{1: 1, 2: 1, 3: 0}}
+	if violations := CheckCausalOrder(3, []TraceEntry{a, b}); len(violations) != 0 {
+		t.Fatalf("the causal trace was flagged: %v", violations)
+	}
+	violations := CheckCausalOrder(3, []TraceEntry{b, a})
+	if len(violations) != 1 {
+		t.Fatalf("the reordered trace has violations %v, want one", violations)
+	}
+	if v := violations[0]; v.Position != 0 || v.Entry.Message != "b" || v.DependsOnID != 1 || v.Needed != 1 || v.Delivered != 0 {
+		t.Fatalf("the violation is %+v, want b delivered before a", v)
+	}
+}
+
+// TestSendWildcardReachesEveryPeer runs "send *" on one process and checks that every other process receives the message.
+func TestSendWildcardReachesEveryPeer(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 4))
+	if parsed, stop := executeCommand(cluster.processes[1], strings.Fields("send * hello everyone")); !parsed || stop {
+		t.Fatalf("send * was parsed %v, stopping %v", parsed, stop)
+	}
+	for id := 2; id <= 4; id++ {
+		waitFor(t, fmt.Sprintf("process %d to receive the message", id), func() bool {
+			return len(cluster.outputs[id].Lines("Received message: hello everyone from process 1")) > 0
+		})
+	}
+	if lines := cluster.outputs[1].Lines("Received message: "); len(lines) != 0 {
+		t.Fatalf("the sender received its own message: %v", lines)
+	}
+}
+
+// gatedWriter struct is an output that holds up every write containing text until release is closed.
+type gatedWriter struct {
+	text    string        // Writes containing it wait for release
+	release chan struct{} // Closed to let the writes through
+}
+
+// Write function waits for release if p contains the text, then discards p.
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), w.text) {
+		<-w.release
+	}
+	return len(p), nil
+}
+
+// TestInboundQueueBackpressure holds up the delivery of the first message a process receives and checks that
+// it stops decoding once its inbound queue is full, then delivers every message in order once released.
+func TestInboundQueueBackpressure(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.InboundQueue = 4
+	// Send in order: a message arriving out of order makes the receive loop log a warning, which would wait for
+	// the blocked print below before the queue fills up
+	config.MaxDelay = 0
+	config.DelayMode = DelayModeQueued
+	// Printing a delivery blocks, which holds up the goroutine handling the queued messages
+	gate := &gatedWriter{text: "Received message: ", release: make(chan struct{})}
+	config.Processes[1].Output = gate
+	cluster := startCluster(t, config)
+	// Registered after the cluster, so a failing test releases the handler before shutting the processes down
+	var releaseOnce sync.Once
+	resume := func() { releaseOnce.Do(func() { close(gate.release) }) }
+	t.Cleanup(resume)
+	decoded := func() int { return cluster.processes[2].stats.Snapshot()[1].Received }
+	const sends = 50
+	go func() {
+		for i := 0; i < sends; i++ {
+			cluster.processes[1].Send(2, fmt.Sprintf("m%d", i))
+		}
+	}()
+	// The message being handled and a full queue are decoded, plus the one waiting to be queued
+	waitFor(t, "the queue to fill up", func() bool { return decoded() >= config.InboundQueue+2 })
+	time.Sleep(50 * time.Millisecond)
+	paused := decoded()
+	time.Sleep(100 * time.Millisecond)
+	if got := decoded(); got != paused || got >= sends {
+		t.Fatalf("%d then %d of %d messages were decoded while handling was held up, decoding did not pause", paused, got, sends)
+	}
+	resume()
+	waitFor(t, "every delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == sends })
+	for i, message := range cluster.outputs[2].Messages("Received message: ") {
+		if want := fmt.Sprintf("m%d", i); message != want {
+			t.Fatalf("delivery %d is %s, want %s", i, message, want)
+		}
+	}
+}
+
+// scrapeMetrics function fetches the metrics of an endpoint and returns the value of every sample by its name and labels.
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(response.Body); err != nil {
+		t.Fatal(err)
+	}
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(body.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		samples[fields[0]] = value
+	}
+	return samples
+}
+
+// TestMetricsEndpoint sends a known number of messages and checks that the scraped counters and delay histogram
+// grew by that number.
+func TestMetricsEndpoint(t *testing.T) {
+	config := newTestConfig(t, 2)
+	// No heartbeats, so only the messages of the test are counted
+	config.HeartbeatInterval = time.Hour
+	port := freePort(t)
+	config.ControlPort = port - 1
+	cluster := startCluster(t, config)
+	url := fmt.Sprintf("http://127.0.0.1:%d/metrics", port)
+	before := scrapeMetrics(t, url)
+	// Wait for each delivery before the next send, so no message overtakes another and gets resent after a NAK
+	const sends = 5
+	for i := 0; i < sends; i++ {
+		if err := cluster.processes[1].Send(2, fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == i+1 })
+	}
+	after := scrapeMetrics(t, url)
+	for _, name := range []string{`messages_sent_total{peer="2"}`, "send_delay_seconds_count"} {
+		if got := after[name] - before[name]; got != sends {
+			t.Errorf("%s grew by %g, want %d", name, got, sends)
+		}
+	}
+}
+
+// TestPriorityQueueOrder queues a low-priority then a high-priority message behind a write the peer has not read yet
+// and checks that the high-priority one is written first.
+func TestPriorityQueueOrder(t *testing.T) {
+	config := newConfig(0, 0)
+	end1, end2 := net.Pipe()
+	defer end2.Close()
+	peer := newPeerConn(end1, NewCodec(config.Codec, end1, config.MaxMessageBytes), config)
+	defer peer.close()
+	// queue sends a message without waiting for it to be written, and waits until the queue holds waiting
+	// messages after the queued-th one
+	queue := func(msg UnicastMessage, queued int, waiting int) {
+		go peer.send(msg)
+		waitFor(t, "the message to be queued", func() bool {
+			peer.mu.Lock()
+			defer peer.mu.Unlock()
+			return peer.queued == queued && peer.outbound.Len() == waiting
+		})
+	}
+	// Nothing reads the pipe yet, so the writer goroutine takes the first message and blocks writing it
+	queue(newHandshake(1), 1, 0)
+	queue(UnicastMessage{Kind: KindData, SourceID: 1, Message: "low", Priority: PriorityData}, 2, 1)
+	queue(UnicastMessage{Kind: KindData, SourceID: 1, Message: "high", Priority: PriorityControl}, 3, 2)
+	codec := NewCodec(config.Codec, end2, config.MaxMessageBytes)
+	var order []string
+	for i := 0; i < 3; i++ {
+		var msg UnicastMessage
+		if err := codec.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, msg.Message)
+	}
+	if got := strings.Join(order[1:], " "); got != "high low" {
+		t.Fatalf("the messages were written as %s, want high low", got)
+	}
+}
+
+// TestCrashRestartMembership crashes a process and checks that the others mark it FAILED, then restarts it
+// and checks that they mark it ALIVE again and can reach it.
+func TestCrashRestartMembership(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.HeartbeatInterval = 20 * time.Millisecond
+	cluster := startCluster(t, config)
+	waitStatus := func(want PeerStatus) {
+		t.Helper()
+		for _, id := range []int{1, 2} {
+			waitFor(t, fmt.Sprintf("process %d to see process 3 %s", id, want), func() bool {
+				return cluster.processes[id].detector.Members()[3] == want
+			})
+		}
+	}
+	if err := cluster.processes[3].Crash(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(StatusFailed)
+	if err := cluster.processes[3].Crash(); err == nil {
+		t.Fatal("a crashed process crashed again")
+	}
+	if err := cluster.processes[3].Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(StatusAlive)
+	for id := range cluster.processes {
+		cluster.waitConnected(t, id)
+	}
+	if err := cluster.processes[1].Send(3, "welcome back"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the restarted process to receive", func() bool { return len(cluster.outputs[3].Lines("Received message: welcome back")) > 0 })
+}
+
+// TestLocalhostConnects runs two processes whose configuration names them by the hostname localhost
+// and checks that they connect and exchange a message, and that an unresolvable host is reported clearly.
+func TestLocalhostConnects(t *testing.T) {
+	config := newTestConfig(t, 2)
+	for i := range config.Processes {
+		config.Processes[i].IP = "localhost"
+	}
+	transport := newTCPTransport(t, config)
+	cluster := startClusterOver(t, config, transport)
+	if err := cluster.processes[1].Send(2, "over localhost"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: over localhost")) == 1 })
+	if err := resolveHost(Process{ID: 3, IP: "no-such-host.invalid"}); err == nil || !strings.Contains(err.Error(), "cannot resolve host no-such-host.invalid for process 3") {
+		t.Fatalf("resolving an unknown host returned %v", err)
+	}
+}
+
+// TestDeliverySemantics makes the receiver drop the first copy of the last of three messages and checks that
+// at-least-once delivery resends it while at-most-once delivery leaves it lost.
+func TestDeliverySemantics(t *testing.T) {
+	tests := []struct {
+		semantics string
+		want      string
+	}{
+		{SemanticsAtLeastOnce, "m1 m2 m3"},
+		{SemanticsAtMostOnce, "m1 m2"},
+	}
+	for _, test := range tests {
+		t.Run(test.semantics, func(t *testing.T) {
+			config := newTestConfig(t, 2)
+			config.DeliverySemantics = test.semantics
+			config.Retransmit.Timeout = 50 * time.Millisecond
+			config.LogLevel = LogDebug
+			cluster := startCluster(t, config)
+			sender, receiver := cluster.processes[1], cluster.processes[2]
+			for i := 1; i <= 2; i++ {
+				if err := sender.Send(2, fmt.Sprintf("m%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitFor(t, "m1 and m2", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == 2 })
+			// The receiver drops what arrives while the sender is blocked
+			receiver.blocked.Block(1)
+			if err := sender.Send(2, "m3"); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "m3 to be dropped", func() bool {
+				return len(cluster.outputs[2].Lines("dropped message from blocked process 1")) > 0
+			})
+			receiver.blocked.Unblock(1)
+			// Leave time for several retransmissions
+			time.Sleep(10 * config.Retransmit.Timeout)
+			// At-most-once delivery does not restore the send order
+			delivered := cluster.outputs[2].Messages("Received message: ")
+			sort.Strings(delivered)
+			if got := strings.Join(delivered, " "); got != test.want {
+				t.Fatalf("delivered %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// TestAckTrackerWindow fills a window of two messages and checks that a third send blocks until an ack
+// makes room, and that a full window gives way when the process shuts down.
+func TestAckTrackerWindow(t *testing.T) {
+	tracker := NewAckTracker(time.Second, 2, systemClock{})
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		tracker.Track(2, UnicastMessage{Kind: KindData, Message: "m"}, done)
+	}
+	if !tracker.Full(2) || tracker.Full(3) {
+		t.Fatal("the window is not full to process 2 only")
+	}
+	tracked := make(chan UnicastMessage, 1)
+	go func() { tracked <- tracker.Track(2, UnicastMessage{Kind: KindData, Message: "m3"}, done) }()
+	select {
+	case msg := <-tracked:
+		t.Fatalf("message %d was sent with a full window", msg.Seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tracker.Ack(2, 1)
+	select {
+	case msg := <-tracked:
+		if msg.Seq != 3 {
+			t.Fatalf("the blocked message got sequence number %d, want 3", msg.Seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ack did not unblock the send")
+	}
+	go func() { tracked <- tracker.Track(2, UnicastMessage{Kind: KindData, Message: "m4"}, done) }()
+	close(done)
+	select {
+	case <-tracked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutting down did not unblock the send")
+	}
+}
+
+// TestPipeTransportDelivery runs three processes in memory over a PipeTransport, lets each multicast a message
+// and checks that every other process delivers it once, from the right sender.
+func TestPipeTransportDelivery(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	for id, p := range cluster.processes {
+		if sent := multicast_send(p, fmt.Sprintf("hello from %d", id)); sent != 2 {
+			t.Fatalf("process %d sent to %d processes, want 2", id, sent)
+		}
+	}
+	for id, output := range cluster.outputs {
+		for peerID := range cluster.processes {
+			if peerID == id {
+				continue
+			}
+			line := fmt.Sprintf("Received message: hello from %d from process %d,", peerID, peerID)
+			waitFor(t, fmt.Sprintf("process %d to receive from process %d", id, peerID), func() bool { return len(output.Lines(line)) == 1 })
+		}
+		if got := len(output.Lines("Received message: ")); got != 2 {
+			t.Fatalf("process %d delivered %d messages, want 2", id, got)
+		}
+	}
+	// Only a listening address can be dialed, and only one listener may use an address
+	if _, err := cluster.transport.Dial("127.0.0.1:1"); err == nil {
+		t.Fatal("dialed an address nothing listens on")
+	}
+	if _, err := cluster.transport.Listen(cluster.processes[1].listenAddress()); err == nil {
+		t.Fatal("listened twice on the same address")
+	}
+}
+
+// TestGossipTTLCoverage gossips among five processes with a fanout of two: a TTL of one hop reaches only the two
+// processes the origin picked, while a TTL of four reaches everyone.
+func TestGossipTTLCoverage(t *testing.T) {
+	tests := []struct {
+		ttl       int
+		receivers int
+	}{
+		{1, 2},
+		{4, 4},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("ttl %d", test.ttl), func(t *testing.T) {
+			config := newTestConfig(t, 5)
+			config.RandSeed = 1
+			config.Fanout = 2
+			config.GossipTTL = test.ttl
+			cluster := startCluster(t, config)
+			start_gossip(cluster.processes[1], "rumor")
+			received := func() int {
+				count := 0
+				for _, output := range cluster.outputs {
+					count += len(output.Lines("Received gossip 1-1: rumor"))
+				}
+				return count
+			}
+			waitFor(t, "the gossip to spread", func() bool { return received() >= test.receivers })
+			// Leave time for further hops, then check that nobody else received the gossip
+			time.Sleep(100 * time.Millisecond)
+			if got := received(); got != test.receivers {
+				t.Fatalf("%d processes received the gossip, want %d", got, test.receivers)
+			}
+		})
+	}
+}
+
+// TestAutoReconnect closes the connection between two processes and checks that it is dialed again,
+// after which a send succeeds and is delivered.
+func TestAutoReconnect(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.ReconnectInterval = 20 * time.Millisecond
+	cluster := startCluster(t, config)
+	broken, _ := cluster.processes[1].connections.Get(2)
+	broken.conn.Close()
+	waitFor(t, "process 2 to reconnect", func() bool { return len(cluster.outputs[2].Lines("Reconnected to process 1")) > 0 })
+	waitFor(t, "process 1 to use the new connection", func() bool {
+		peer, ok := cluster.processes[1].connections.Get(2)
+		return ok && peer != broken
+	})
+	if err := cluster.processes[1].Send(2, "after reconnect"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: after reconnect")) == 1 })
+}
+
+// TestDeliveryHandlerCollectsMessages registers a delivery handler collecting the delivered messages
+// and checks that it receives every message sent, in order.
+func TestDeliveryHandlerCollectsMessages(t *testing.T) {
+	var mu sync.Mutex
+	var collected []string
+	config := newTestConfig(t, 2)
+	config.Processes[1].DeliveryHandler = func(msg UnicastMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		collected = append(collected, msg.Message)
+	}
+	cluster := startCluster(t, config)
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("m%d", i))
+		if err := cluster.processes[1].Send(2, want[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "every delivery", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(collected) == len(want)
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(collected, want) {
+		t.Fatalf("the handler collected %v, want %v", collected, want)
+	}
+}
+
+// TestMaxMessageSize checks that a message over the size limit is refused on send without harming the connection,
+// and that an oversized frame written past the check makes the receiver close the connection.
+func TestMaxMessageSize(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.MaxMessageBytes = MinMessageLimit
+	cluster := startCluster(t, config)
+	p := cluster.processes[1]
+	large := strings.Repeat("x", 2*config.MaxMessageBytes)
+	if err := p.Send(2, large); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("sending an oversized message returned %v, want %v", err, errMessageTooLarge)
+	}
+	peer, _ := p.connections.Get(2)
+	if err := unicast_send(p, 2, UnicastMessage{Kind: KindData, SourceID: 1, Message: large}); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("unicast_send of an oversized message returned %v, want %v", err, errMessageTooLarge)
+	}
+	p.dropPeer(2, errMessageTooLarge)
+	if after, ok := p.connections.Get(2); !ok || after != peer {
+		t.Fatal("the connection was dropped after refusing an oversized message")
+	}
+	if err := p.Send(2, "small"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: small")) == 1 })
+	// Write an oversized frame directly, as a peer with a higher limit would. The receiver closes the connection
+	// before reading all of it, so the write itself fails.
+	peer.queue(UnicastMessage{Kind: KindData, SourceID: 1, Message: large})
+	waitFor(t, "the receiver to close the connection", func() bool {
+		return len(cluster.outputs[2].Lines("closing connection to process 1: message too large")) == 1
+	})
+}
+
+// TestPingPong pings a peer over the in-memory transport and checks that the pong comes back
+// with a non-negative round-trip time.
+func TestPingPong(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	if err := ping(cluster.processes[1], 2, false); err != nil {
+		t.Fatal(err)
+	}
+	const prefix = "Pong from process 2, round-trip time is: "
+	waitFor(t, "the pong", func() bool { return len(cluster.outputs[1].Lines(prefix)) == 1 })
+	line := cluster.outputs[1].Lines(prefix)[0]
+	rtt, err := time.ParseDuration(line[strings.Index(line, prefix)+len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 0 {
+		t.Fatalf("the round-trip time is %s", rtt)
+	}
+}
+
+// TestSendGroup parses a configuration defining a group of two processes, sends to the group from a third one
+// and checks that both members receive the message and the process outside the group does not.
+func TestSendGroup(t *testing.T) {
+	path := writeFile(t, "config.txt", `0 0
+group pair 2 3
+1 127.0.0.1 8001 127.0.0.1
+2 127.0.0.1 8002 127.0.0.1
+3 127.0.0.1 8003 127.0.0.1
+4 127.0.0.1 8004 127.0.0.1
+`)
+	config, err := ParseConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := startCluster(t, config)
+	if parsed, _ := executeCommand(cluster.processes[1], strings.Fields("sendgroup pair hello pair")); !parsed {
+		t.Fatal("sendgroup was not parsed")
+	}
+	for _, id := range []int{2, 3} {
+		waitFor(t, fmt.Sprintf("process %d to receive the group message", id), func() bool {
+			return len(cluster.outputs[id].Lines("Received message: hello pair from process 1")) == 1
+		})
+	}
+	if lines := cluster.outputs[4].Lines("Received message: "); len(lines) != 0 {
+		t.Fatalf("process 4 is not in the group but received %v", lines)
+	}
+	if _, err := group_send(cluster.processes[1], "nobody", "lost"); err == nil {
+		t.Fatal("sent to an unknown group")
+	}
+}
+
+// lockState function returns the Ricart-Agrawala state of a process.
+func lockState(p *Process) string {
+	p.mutex.mu.Lock()
+	defer p.mutex.mu.Unlock()
+	return p.mutex.state
+}
+
+// contendForLock function lets every process of the cluster take the lock a few times at once, while checking
+// that no two of them are ever in the critical section together according to inside, and that every request is granted.
+func contendForLock(t *testing.T, cluster *testCluster, inside func(*Process) bool) {
+	t.Helper()
+	stop := make(chan struct{})
+	violations := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var holders []int
+			for id, p := range cluster.processes {
+				if inside(p) {
+					holders = append(holders, id)
+				}
+			}
+			if len(holders) > 1 {
+				select {
+				case violations <- fmt.Sprintf("processes %v hold the lock at once", holders):
+				default:
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	const rounds = 3
+	var wg sync.WaitGroup
+	for id, p := range cluster.processes {
+		wg.Add(1)
+		go func(id int, p *Process) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := request_lock(p); err != nil {
+					t.Error(err)
+					return
+				}
+				// waitFor cannot fail the test from this goroutine
+				deadline := time.Now().Add(5 * time.Second)
+				for !inside(p) {
+					if time.Now().After(deadline) {
+						t.Errorf("process %d never entered the critical section", id)
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+				time.Sleep(10 * time.Millisecond)
+				if err := release_lock(p); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(id, p)
+	}
+	wg.Wait()
+	close(stop)
+	select {
+	case violation := <-violations:
+		t.Fatal(violation)
+	default:
+	}
+	for id, output := range cluster.outputs {
+		if got := len(output.Lines("Entered the critical section")); got != rounds {
+			t.Fatalf("process %d entered the critical section %d times, want %d", id, got, rounds)
+		}
+	}
+}
+
+// TestRicartAgrawalaMutualExclusion lets three processes contend for the lock several times and checks that
+// no two of them are ever in the critical section at once.
+func TestRicartAgrawalaMutualExclusion(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	contendForLock(t, cluster, func(p *Process) bool { return lockState(p) == LockHeld })
+}
+
+// ringState function returns the token-ring state of a process and whether it holds the token.
+func ringState(p *Process) (string, bool) {
+	p.ring.mu.Lock()
+	defer p.ring.mu.Unlock()
+	return p.ring.state, p.ring.hasToken
+}
+
+// TestTokenRingCirculates checks that the token visits every process of the ring, then lets the processes
+// contend for the lock and checks that only the holder of the token is ever in the critical section.
+func TestTokenRingCirculates(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.Mutex = MutexTokenRing
+	config.LogLevel = LogDebug
+	cluster := startCluster(t, config)
+	for id, output := range cluster.outputs {
+		waitFor(t, fmt.Sprintf("the token to reach process %d", id), func() bool { return len(output.Lines("Received the token")) > 0 })
+	}
+	contendForLock(t, cluster, func(p *Process) bool {
+		state, hasToken := ringState(p)
+		if state == LockHeld && !hasToken {
+			t.Errorf("process %d is in the critical section without the token", p.ID)
+		}
+		return state == LockHeld
+	})
+}
+
+// TestTokenRingDuplicateToken hands a process that holds the token a duplicate of it, an older and a newer
+// token, and checks that only one token goes on, with the newest generation.
+func TestTokenRingDuplicateToken(t *testing.T) {
+	ring := NewTokenRing()
+	if accepted, _ := ring.Receive(TokenMessage{Generation: 2}); !accepted {
+		t.Fatal("the first token was not accepted")
+	}
+	tests := []struct {
+		generation int
+		want       int // Generation of the token passed on afterwards
+	}{
+		{2, 2}, // Duplicate of the held token
+		{1, 2}, // Stale token
+		{3, 3}, // Newer token, the held one goes on with its generation
+		{2, 3}, // Now stale as well
+	}
+	for _, test := range tests {
+		if accepted, entered := ring.Receive(TokenMessage{Generation: test.generation}); accepted || entered {
+			t.Fatalf("a second token of generation %d was accepted", test.generation)
+		}
+		if ring.generation != test.want || !ring.hasToken || ring.state != LockReleased {
+			t.Fatalf("after a token of generation %d the ring is %+v, want generation %d with the token", test.generation, ring, test.want)
+		}
+	}
+	token, ok := ring.Pass(2)
+	if !ok || token.Generation != 3 {
+		t.Fatalf("passed %+v, %v, want generation 3", token, ok)
+	}
+	if _, ok := ring.Pass(3); ok {
+		t.Fatal("the token was passed on twice")
+	}
+}
+
+// TestMiddlewareChain installs a middleware that uppercases plain messages and another that drops the messages
+// of process 2, and checks that only the uppercased message of process 1 is delivered.
+func TestMiddlewareChain(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.Processes[2].Middleware = MiddlewareChain{
+		func(msg UnicastMessage) (UnicastMessage, bool) {
+			msg.Message = strings.ToUpper(msg.Message)
+			return msg, true
+		},
+		func(msg UnicastMessage) (UnicastMessage, bool) {
+			return msg, msg.SourceID != 2
+		},
+	}
+	cluster := startCluster(t, config)
+	for id := 1; id <= 2; id++ {
+		if err := cluster.processes[id].Send(3, fmt.Sprintf("hello from %d", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[3].Lines("Received message: ")) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if got := cluster.outputs[3].Messages("Received message: "); !reflect.DeepEqual(got, []string{"HELLO FROM 1"}) {
+		t.Fatalf("delivered %v, want only HELLO FROM 1", got)
+	}
+}
+
+// TestRateLimitSpacing sends a burst under a rate limit and checks that the deliveries are spaced
+// at least the interval of the rate apart.
+func TestRateLimitSpacing(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.RateLimit = 20
+	interval := time.Duration(float64(time.Second) / config.RateLimit)
+	var mu sync.Mutex
+	var delivered []time.Time
+	config.Processes[1].DeliveryHandler = func(UnicastMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, time.Now())
+	}
+	cluster := startCluster(t, config)
+	const burst = 5
+	for i := 0; i < burst; i++ {
+		if err := cluster.processes[1].Send(2, fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "every delivery", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == burst
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	// The messages leave exactly one interval apart, allow for some scheduling jitter on arrival
+	const jitter = 10 * time.Millisecond
+	for i := 1; i < burst; i++ {
+		if gap := delivered[i].Sub(delivered[i-1]); gap < interval-jitter {
+			t.Errorf("deliveries %d and %d are %s apart, want at least %s", i-1, i, gap, interval)
+		}
+	}
+	if span := delivered[burst-1].Sub(delivered[0]); span < (burst-1)*interval-jitter {
+		t.Fatalf("the burst was delivered within %s, want at least %s", span, (burst-1)*interval)
+	}
+}
+
+// TestClockCommand delivers a multicast and checks that the clock command prints the Lamport and vector time
+// of the receiver, and that printing them twice does not advance either clock.
+func TestClockCommand(t *testing.T) {
+	output := captureOutput(t)
+	cluster := startCluster(t, newTestConfig(t, 2))
+	if parsed, _ := executeCommand(cluster.processes[1], strings.Fields("msend hello")); !parsed {
+		t.Fatal("msend was not parsed")
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: hello from process 1")) == 1 })
+	p := cluster.processes[2]
+	want := fmt.Sprintf("Logical time is: %d, vector time is: [1:1 2:0]", p.clock.Time())
+	for i := 0; i < 2; i++ {
+		if parsed, _ := executeCommand(p, []string{"clock"}); !parsed {
+			t.Fatal("clock was not parsed")
+		}
+	}
+	waitFor(t, "both clock lines", func() bool { return len(output.Lines("Logical time is: ")) == 2 })
+	for _, line := range output.Lines("Logical time is: ") {
+		if line != want {
+			t.Fatalf("clock printed %q, want %q", line, want)
+		}
+	}
+}
+
+// TestLinkDelays parses a configuration overriding the delay of the link from process 1 to process 2 and checks that
+// the delays sampled for that link fall in its range, while the other links use the default range.
+func TestLinkDelays(t *testing.T) {
+	path := writeFile(t, "config.txt", `10 20
+link 1 2 100 200
+1 127.0.0.1 8001 127.0.0.1
+2 127.0.0.1 8002 127.0.0.1
+3 127.0.0.1 8003 127.0.0.1
+`)
+	config, err := ParseConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := startCluster(t, config)
+	tests := []struct {
+		from, to int
+		min, max time.Duration
+	}{
+		{1, 2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{1, 3, 10 * time.Millisecond, 20 * time.Millisecond},
+		{2, 1, 10 * time.Millisecond, 20 * time.Millisecond}, // Links are directed
+	}
+	for _, test := range tests {
+		for i := 0; i < 200; i++ {
+			if delay := messageDelay(cluster.processes[test.from], test.to); delay < test.min || delay > test.max {
+				t.Fatalf("sampled a delay of %s from process %d to process %d, want between %s and %s", delay, test.from, test.to, test.min, test.max)
+			}
+		}
+	}
+}
+
+// TestWhoamiAndCluster checks that whoami prints the address of the process itself and that cluster lists
+// every member in ID order, marking the process that ran the command.
+func TestWhoamiAndCluster(t *testing.T) {
+	output := captureOutput(t)
+	config := newTestConfig(t, 3)
+	cluster := startCluster(t, config)
+	p := cluster.processes[2]
+	for _, command := range []string{"whoami", "cluster"} {
+		if parsed, _ := executeCommand(p, []string{command}); !parsed {
+			t.Fatalf("%s was not parsed", command)
+		}
+	}
+	address := func(id int) string { return net.JoinHostPort("127.0.0.1", config.Processes[id-1].Port) }
+	want := []string{
+		fmt.Sprintf("Process 2 at %s, listening on %s", address(2), address(2)),
+		fmt.Sprintf("Process 1: %s", address(1)),
+		fmt.Sprintf("Process 2: %s (this process)", address(2)),
+		fmt.Sprintf("Process 3: %s", address(3)),
+	}
+	waitFor(t, "the replies", func() bool { return len(output.Lines("Process ")) == len(want) })
+	if got := output.Lines("Process "); !reflect.DeepEqual(got, want) {
+		t.Fatalf("printed %q, want %q", got, want)
+	}
+}
+
+// TestShutdownFlushesDelayedSends schedules delayed sends, shuts the sender down right away and checks that
+// the messages are still delivered, since shutting down waits for them within the drain timeout.
+func TestShutdownFlushesDelayedSends(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.MinDelay, config.MaxDelay = 100, 200
+	config.DrainTimeout = 2 * time.Second
+	cluster := startCluster(t, config)
+	const sends = 5
+	for i := 0; i < sends; i++ {
+		if err := cluster.processes[1].Send(2, fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	cluster.processes[1].Shutdown()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > config.DrainTimeout {
+		t.Fatalf("shutting down took %s, want between the smallest delay and the drain timeout", elapsed)
+	}
+	waitFor(t, "every delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: ")) == sends })
+}
+
+// TestOutOfOrderWarning sends two messages so that the later one arrives first and checks that the receiver
+// warns about the earlier timestamp arriving after the larger one, while an in-order arrival gives no warning.
+func TestOutOfOrderWarning(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[1]
+	first := newMessage(p.ID, "first", p.clock, p.causal)
+	second := newMessage(p.ID, "second", p.clock, p.causal)
+	unicast_send_with_delay(p, 2, first, 100*time.Millisecond)
+	unicast_send_with_delay(p, 2, second, 0)
+	want := fmt.Sprintf("WARNING: out-of-order message from P1, logical time %d arrived after %d", first.Timestamp, second.Timestamp)
+	waitFor(t, "the warning", func() bool { return len(cluster.outputs[2].Lines(want)) > 0 })
+	arrivals := NewArrivalOrder()
+	for _, timestamp := range []int{1, 2, 2, 5} {
+		if outOfOrder, last := arrivals.Observe(1, timestamp); outOfOrder {
+			t.Fatalf("timestamp %d after %d was reported out of order", timestamp, last)
+		}
+	}
+	if outOfOrder, last := arrivals.Observe(1, 4); !outOfOrder || last != 5 {
+		t.Fatalf("timestamp 4 after 5 gave %v, %d, want out of order after 5", outOfOrder, last)
+	}
+}
+
+// TestHeartbeatTimeoutFakeClock crashes a process of a cluster running on a fake clock and advances the clock
+// one heartbeat interval at a time, checking that the peer is marked FAILED once FailAfterMissed intervals
+// passed without a heartbeat, and not before.
+func TestHeartbeatTimeoutFakeClock(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.HeartbeatInterval = time.Second
+	config.HeartbeatJitter = 0
+	clock := newFakeClock()
+	for i := range config.Processes {
+		config.Processes[i].Time = clock
+	}
+	cluster := startCluster(t, config)
+	p := cluster.processes[1]
+	if err := cluster.processes[2].Crash(); err != nil {
+		t.Fatal(err)
+	}
+	start := clock.Now()
+	waitFor(t, "process 1 to see process 2 FAILED", func() bool {
+		if p.detector.Members()[2] == StatusFailed {
+			return true
+		}
+		clock.Advance(config.HeartbeatInterval)
+		return false
+	})
+	if elapsed := clock.Now().Sub(start); elapsed < FailAfterMissed*config.HeartbeatInterval {
+		t.Fatalf("process 2 was marked FAILED after %s, want at least %s", elapsed, FailAfterMissed*config.HeartbeatInterval)
+	}
+}
+
+// TestBatchedSends sends a burst of messages with batching off and on, checking that both deliver every
+// message in send order and that batching writes them to the connection in fewer writes.
+func TestBatchedSends(t *testing.T) {
+	const sends = 30
+	for _, batchSize := range []int{0, 10} {
+		t.Run(fmt.Sprintf("batch size %d", batchSize), func(t *testing.T) {
+			config := newTestConfig(t, 2)
+			config.BatchSize = batchSize
+			config.BatchWindow = 50 * time.Millisecond
+			cluster := startCluster(t, config)
+			peer, _ := cluster.processes[1].connections.Get(2)
+			messagesBefore, writesBefore := peer.writeCounts()
+			var want []string
+			for i := 0; i < sends; i++ {
+				want = append(want, fmt.Sprintf("m%d", i))
+				if err := cluster.processes[1].Send(2, want[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitFor(t, "every delivery", func() bool { return len(cluster.outputs[2].Messages("Received message: ")) == sends })
+			if got := cluster.outputs[2].Messages("Received message: "); !reflect.DeepEqual(got, want) {
+				t.Fatalf("delivered %v, want %v", got, want)
+			}
+			messagesAfter, writesAfter := peer.writeCounts()
+			messages, writes := messagesAfter-messagesBefore, writesAfter-writesBefore
+			if batchSize == 0 && writes != messages {
+				t.Fatalf("without batching %d messages took %d writes", messages, writes)
+			}
+			if batchSize > 0 && writes >= messages {
+				t.Fatalf("with batching %d messages took %d writes, want fewer", messages, writes)
+			}
+		})
+	}
+}
+
+// TestSetDelay changes the delay bounds with the setdelay command and checks that the following sends sample
+// their delays from the new range, and that invalid bounds are refused and leave the range unchanged.
+func TestSetDelay(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[1]
+	if parsed, _ := executeCommand(p, strings.Fields("setdelay 50 60")); !parsed {
+		t.Fatal("setdelay refused valid bounds")
+	}
+	for _, command := range []string{"setdelay 60 50", "setdelay -1 10", "setdelay a 10"} {
+		if parsed, _ := executeCommand(p, strings.Fields(command)); parsed {
+			t.Fatalf("%q was accepted", command)
+		}
+	}
+	if minDelay, maxDelay := p.delays.Get(); minDelay != 50 || maxDelay != 60 {
+		t.Fatalf("bounds are %d-%d after the invalid commands, want 50-60", minDelay, maxDelay)
+	}
+	for i := 0; i < 200; i++ {
+		if delay := messageDelay(p, 2); delay < 50*time.Millisecond || delay > 60*time.Millisecond {
+			t.Fatalf("sampled a delay of %s, want between 50ms and 60ms", delay)
+		}
+	}
+	start := time.Now()
+	if err := p.Send(2, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: slow")) > 0 })
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("the message was delivered after %s, before the new minimum delay", elapsed)
+	}
+}
+
+// TestSendSeveralMessages sends three messages with one send command, over links with random delays, and
+// checks that they are delivered as three distinct messages in the order of the command.
+func TestSendSeveralMessages(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	if err := cluster.processes[1].delays.Set(0, 50); err != nil {
+		t.Fatal(err)
+	}
+	if parsed, _ := executeCommand(cluster.processes[1], strings.Fields("send 2 msg1 | msg2 |  | msg3")); !parsed {
+		t.Fatal("the send command was refused")
+	}
+	want := []string{"msg1", "msg2", "msg3"}
+	waitFor(t, "every delivery", func() bool { return len(cluster.outputs[2].Messages("Received message: ")) == len(want) })
+	time.Sleep(100 * time.Millisecond)
+	if got := cluster.outputs[2].Messages("Received message: "); !reflect.DeepEqual(got, want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	if got := splitMessages("no separator here"); !reflect.DeepEqual(got, []string{"no separator here"}) {
+		t.Fatalf("a message without separator was split into %v", got)
+	}
+}
+
+// TestQuorumBroadcastCommit sends a quorum broadcast in a cluster of three processes where the copy to process 3
+// is held back, and checks that the broadcast commits on the ack of process 2 alone, the sender counting as
+// the other ack of the majority.
+func TestQuorumBroadcastCommit(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.LinkDelays[linkKey(1, 3)] = DelayRange{Min: 1000, Max: 1000}
+	cluster := startCluster(t, config)
+	p := cluster.processes[1]
+	committed, err := quorum_broadcast(p, "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-committed:
+	case <-time.After(800 * time.Millisecond):
+		t.Fatal("the broadcast did not commit on the ack of process 2")
+	}
+	if len(cluster.outputs[3].Lines("Received message: stable")) > 0 {
+		t.Fatal("process 3 received the broadcast before it committed")
+	}
+	if lines := cluster.outputs[1].Lines("Message committed: stable, acknowledged by 2 of 3 processes"); len(lines) != 1 {
+		t.Fatalf("logged %d commits of 2 of 3 acks, want 1", len(lines))
+	}
+}
+
+// TestIsolatedNode launches the only process of a configuration and checks that it logs that it is isolated,
+// still accepts connections on its port and refuses sends with errIsolated instead of crashing.
+func TestIsolatedNode(t *testing.T) {
+	t.Chdir(t.TempDir())
+	config := newConfig(0, 0)
+	config.Processes = []Process{{ID: 1, IP: "127.0.0.1", Port: strconv.Itoa(freePort(t)), BindAddr: "127.0.0.1"}}
+	transport := newTCPTransport(t, config)
+	output := &syncBuffer{}
+	process := config.Processes[0]
+	process.Output = output
+	p, err := launchProcess(process, config, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.Shutdown()
+		p.Wait()
+	})
+	if len(output.Lines("running as isolated node; no peers configured")) != 1 {
+		t.Fatal("the isolation notice was not logged")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", process.Port))
+	if err != nil {
+		t.Fatalf("the listener of the isolated process is not running: %v", err)
+	}
+	conn.Close()
+	if err := p.Send(2, "hello"); !errors.Is(err, errIsolated) {
+		t.Fatalf("sending from an isolated process returned %v, want errIsolated", err)
+	}
+	if sent := multicast_send(p, "hello"); sent != 0 {
+		t.Fatalf("an isolated process multicast to %d processes", sent)
+	}
+}
+
+// TestMaxConnections limits two processes to one connection each and checks that a third connection to a
+// process that is already connected is closed without being served, and logged as refused.
+func TestMaxConnections(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.MaxConnections = 1
+	cluster := startCluster(t, config)
+	conn, err := cluster.transport.Dial(cluster.processes[1].dialAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("a connection beyond the limit was served")
+	}
+	waitFor(t, "the refusal to be logged", func() bool {
+		return len(cluster.outputs[1].Lines("refusing connection from")) > 0 && len(cluster.outputs[1].Lines("1 connections open, the limit is 1")) > 0
+	})
+	pool := NewReceivePool(2)
+	for i := 0; i < 2; i++ {
+		if err := pool.Acquire(); err != nil {
+			t.Fatalf("slot %d: %v", i+1, err)
+		}
+	}
+	if err := pool.Acquire(); err == nil {
+		t.Fatal("a third receive loop was admitted in a pool of 2")
+	}
+	pool.Release()
+	if err := pool.Check(); err != nil {
+		t.Fatalf("a released slot is still taken: %v", err)
+	}
+}
+
+// TestReplayedFrameRejected connects to a process as process 3 and writes the same heartbeat frame twice,
+// nonce included, as an attacker replaying a captured frame would, and checks that the copy is dropped as a replay.
+func TestReplayedFrameRejected(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	conn, err := cluster.transport.Dial(cluster.processes[1].dialAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	codec, err := negotiateCodec(conn, cluster.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read what process 1 writes, or its writes would block on the unbuffered pipe
+	go io.Copy(io.Discard, conn)
+	if err := codec.Encode(newHandshake(3)); err != nil {
+		t.Fatal(err)
+	}
+	frame := UnicastMessage{Kind: KindHeartbeat, SourceID: 3, Heartbeat: &HeartbeatMessage{Count: 1}, Priority: PriorityControl, Nonce: newNonce()}
+	for i := 0; i < 2; i++ {
+		if err := codec.Encode(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := fmt.Sprintf("dropped replayed message from process 3, nonce %x was seen before", frame.Nonce)
+	waitFor(t, "the replay to be dropped", func() bool { return len(cluster.outputs[1].Lines(want)) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if lines := cluster.outputs[1].Lines("dropped replayed message"); len(lines) != 1 {
+		t.Fatalf("dropped %d replays, want only the copy", len(lines))
+	}
+}
+
+// TestSaveConfigAfterJoin joins a process to a running cluster, saves the membership of a founding member
+// with the saveconfig command and checks that the saved file parses back into all four processes.
+func TestSaveConfigAfterJoin(t *testing.T) {
+	config := newTestConfig(t, 4)
+	clusterConfig, joinConfig := *config, *config
+	clusterConfig.Processes, joinConfig.Processes = config.Processes[:3], config.Processes[3:]
+	cluster := startCluster(t, &clusterConfig)
+	// Multicasts sent before the join must not hold back the ones sent after it at the newcomer
+	multicast_send(cluster.processes[1], "before")
+	waitFor(t, "the members to deliver the first message", func() bool {
+		return len(cluster.outputs[2].Lines("Received message: before")) == 1 && len(cluster.outputs[3].Lines("Received message: before")) == 1
+	})
+	newcomer := cluster.launch(t, &joinConfig, joinConfig.Processes[0])
+	if err := join_cluster(newcomer, "127.0.0.1", config.Processes[0].Port); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "process 1 to learn the newcomer", func() bool { return len(cluster.processes[1].memberList()) == 4 })
+	if parsed, _ := executeCommand(cluster.processes[1], strings.Fields("saveconfig saved.txt")); !parsed {
+		t.Fatal("saveconfig was refused")
+	}
+	saved, err := ParseConfigFile("saved.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Processes) != 4 {
+		t.Fatalf("saved %d processes, want 4", len(saved.Processes))
+	}
+	newcomerSaved := saved.Processes[3]
+	if want := config.Processes[3]; newcomerSaved.ID != want.ID || newcomerSaved.IP != want.IP || newcomerSaved.Port != want.Port {
+		t.Fatalf("saved the newcomer as %d %s %s, want %d %s %s", newcomerSaved.ID, newcomerSaved.IP, newcomerSaved.Port, want.ID, want.IP, want.Port)
+	}
+}
+
+// TestHeartbeatJitter samples the delays between the heartbeats of a process and checks that they vary, but stay within the
+// configured fraction of the interval, and that without jitter every delay is the interval.
+func TestHeartbeatJitter(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.HeartbeatInterval = 100 * time.Millisecond
+	config.HeartbeatJitter = 0.2
+	p := &Process{ID: 1, config: config, rng: NewRandom(1)}
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 200; i++ {
+		delay := heartbeatDelay(p)
+		if delay < 80*time.Millisecond || delay > 120*time.Millisecond {
+			t.Fatalf("a heartbeat delay of %s is outside 100ms give or take 20%%", delay)
+		}
+		delays[delay] = true
+	}
+	if len(delays) < 2 {
+		t.Fatal("every heartbeat delay is the same")
+	}
+	config.HeartbeatJitter = 0
+	for i := 0; i < 10; i++ {
+		if delay := heartbeatDelay(p); delay != config.HeartbeatInterval {
+			t.Fatalf("a heartbeat delay without jitter is %s, want %s", delay, config.HeartbeatInterval)
+		}
+	}
+}
+
+// TestOrderingClassesInterleaved interleaves messages of different ordering classes on the same connections:
+// an unordered message overtakes a delayed FIFO message sent before it, a later FIFO message waits for it,
+// and total messages sent meanwhile by two processes are delivered in the same order everywhere.
+func TestOrderingClassesInterleaved(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	p := cluster.processes[1]
+	send := func(p *Process, class string, message string) {
+		t.Helper()
+		if _, err := multicast_ordered(p, class, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first FIFO message is delayed, so the later ones overtake it
+	if err := p.delays.Set(300, 300); err != nil {
+		t.Fatal(err)
+	}
+	send(p, OrderingFIFO, "f1")
+	if err := p.delays.Set(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	send(p, OrderingTotal, "t1")
+	send(cluster.processes[3], OrderingTotal, "t3")
+	send(p, OrderingNone, "n1")
+	send(p, OrderingFIFO, "f2")
+	output := cluster.outputs[2]
+	waitFor(t, "process 2 to deliver the plain messages", func() bool { return len(output.Messages("Received message: ")) == 3 })
+	if got, want := output.Messages("Received message: "), []string{"n1", "f1", "f2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("process 2 delivered %v, want %v", got, want)
+	}
+	for id, output := range cluster.outputs {
+		waitFor(t, fmt.Sprintf("process %d to deliver the total messages", id), func() bool {
+			return len(output.Messages("Delivered ordered message: ")) == 2
+		})
+	}
+	want := cluster.outputs[1].Messages("Delivered ordered message: ")
+	for id, output := range cluster.outputs {
+		if got := output.Messages("Delivered ordered message: "); !reflect.DeepEqual(got, want) {
+			t.Fatalf("process %d delivered the total messages as %v, process 1 as %v", id, got, want)
+		}
+	}
+	if _, err := multicast_ordered(p, "sorted", "x"); err == nil {
+		t.Fatal("an unknown ordering class was accepted")
+	}
+}
+
+// TestClockSkewReported runs two processes with opposite clock skews on a fake clock and checks that the
+// system times they report are the time of that clock shifted by their own skew.
+func TestClockSkewReported(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.ClockSkews[1] = 5 * time.Second
+	config.ClockSkews[2] = -3 * time.Second
+	clock := newFakeClock()
+	for i := range config.Processes {
+		config.Processes[i].Time = clock
+	}
+	cluster := startCluster(t, config)
+	for id, skew := range config.ClockSkews {
+		if got, want := cluster.processes[id].wallTime(), clock.Now().Add(skew); !got.Equal(want) {
+			t.Fatalf("process %d reports %s, want %s", id, got, want)
+		}
+	}
+	if err := cluster.processes[1].Send(2, "skewed"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(cluster.outputs[2].Lines("Received message: skewed")) > 0 })
+	sent := "system time is: " + clock.Now().Add(5*time.Second).Format(time.RFC3339)
+	if len(cluster.outputs[1].Lines(sent)) == 0 {
+		t.Fatalf("the sender did not report %q", sent)
+	}
+	received := "system time is: " + clock.Now().Add(-3*time.Second).Format(time.RFC3339)
+	if lines := cluster.outputs[2].Lines("Received message: skewed"); !strings.Contains(lines[0], received) {
+		t.Fatalf("the receiver logged %q, want it to report %q", lines[0], received)
+	}
+}
+
+// TestSendFile sends a three-line file, with an empty line in between, over links with random delays and
+// checks that the three lines are delivered in file order, and that a missing file is reported as an error.
+func TestSendFile(t *testing.T) {
+	path := writeFile(t, "lines.txt", "first\n\nsecond\nthird\n")
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[1]
+	if err := p.delays.Set(0, 50); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := p.SendFile(2, path)
+	if err != nil || sent != 3 {
+		t.Fatalf("SendFile returned %d, %v, want 3 lines sent", sent, err)
+	}
+	want := []string{"first", "second", "third"}
+	waitFor(t, "every line", func() bool { return len(cluster.outputs[2].Messages("Received message: ")) == len(want) })
+	if got := cluster.outputs[2].Messages("Received message: "); !reflect.DeepEqual(got, want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	if sent, err := p.SendFile(2, filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, os.ErrNotExist) || sent != 0 {
+		t.Fatalf("sending a missing file returned %d, %v", sent, err)
+	}
+}
+
+// TestLatePeer launches a process before the only peer it dials, which fails more dials than the retry policy
+// allows, sends it a message meanwhile and checks that the message waits in the outbox and is delivered once the
+// peer comes up and the connection succeeds.
+func TestLatePeer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	config := newTestConfig(t, 2)
+	config.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond, Backoff: BackoffExponential}
+	cluster := &testCluster{config: config, transport: NewPipeTransport(), processes: make(map[int]*Process), outputs: make(map[int]*syncBuffer)}
+	// The process with the higher ID dials
+	p := cluster.launch(t, config, config.Processes[1])
+	if err := p.Send(1, "early"); err != nil {
+		t.Fatalf("sending to a peer that is not up returned %v", err)
+	}
+	waitFor(t, "the dials to give up", func() bool {
+		return len(cluster.outputs[2].Lines("could not connect to process 1, retrying in the background")) > 0
+	})
+	cluster.launch(t, config, config.Processes[0])
+	cluster.waitConnected(t, 2)
+	waitFor(t, "the early message", func() bool { return len(cluster.outputs[1].Lines("Received message: early")) == 1 })
+}
+
+// TestVersionMismatch connects to a process with a handshake of a newer protocol version and checks that the
+// connection is closed before any message is handled, with the incompatible version logged.
+func TestVersionMismatch(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	conn, err := cluster.transport.Dial(cluster.processes[1].dialAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	codec, err := negotiateCodec(conn, cluster.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read what process 1 writes until it closes the connection
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	handshake := newHandshake(3)
+	handshake.Handshake.Version = ProtocolVersion + 1
+	if err := codec.Encode(handshake); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection of a newer version was not closed")
+	}
+	want := fmt.Sprintf("incompatible protocol version %d", ProtocolVersion+1)
+	waitFor(t, "the refusal to be logged", func() bool { return len(cluster.outputs[1].Lines(want)) > 0 })
+	if _, ok := cluster.processes[1].connections.Get(3); ok {
+		t.Fatal("the process of a newer version was registered")
+	}
+	for _, version := range []int{MinProtocolVersion, ProtocolVersion} {
+		if err := checkVersion(version); err != nil {
+			t.Fatalf("version %d was refused: %v", version, err)
+		}
+	}
+	if err := checkVersion(MinProtocolVersion - 1); !errors.Is(err, errIncompatibleVersion) {
+		t.Fatalf("version %d returned %v", MinProtocolVersion-1, err)
+	}
+}
+
+// TestTraceEvents sends one message with the trace option on and checks the events each side traces, in order,
+// and that nothing is traced with the option off.
+func TestTraceEvents(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.Trace = true
+	cluster := startCluster(t, config)
+	if err := cluster.processes[1].Send(2, "traced"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int][]string{
+		1: {"TRACE event=send msg=1.1 seq=1 peer=2 clock=1", "TRACE event=acked msg=- seq=1 peer=2 clock=1"},
+		2: {"TRACE event=receive msg=1.1 seq=1 peer=1 clock=0", "TRACE event=ack msg=1.1 seq=1 peer=1 clock=0",
+			"TRACE event=clock msg=1.1 seq=1 peer=1 clock=2", "TRACE event=deliver msg=1.1 seq=1 peer=1 clock=2"},
+	}
+	for id, events := range want {
+		output := cluster.outputs[id]
+		waitFor(t, fmt.Sprintf("process %d to trace every event", id), func() bool { return len(output.Lines("TRACE ")) == len(events) })
+		var got []string
+		for _, line := range output.Lines("TRACE ") {
+			got = append(got, line[strings.Index(line, "TRACE "):])
+		}
+		if !reflect.DeepEqual(got, events) {
+			t.Fatalf("process %d traced %q, want %q", id, got, events)
+		}
+	}
+	output := &syncBuffer{}
+	untraced := &Process{ID: 1, config: newTestConfig(t, 2), logger: NewLogger(1, LogDebug, output)}
+	traceEvent(untraced, TraceSend, UnicastMessage{SourceID: 1, Timestamp: 1, Seq: 1}, 2)
+	if lines := output.Lines("TRACE "); len(lines) != 0 {
+		t.Fatalf("traced %q with the option off", lines)
+	}
+}
+
+// failingTransport struct is a PipeTransport whose dialed connections can be made to fail their writes.
+type failingTransport struct {
+	*PipeTransport
+	mu    sync.Mutex     // Protects conns
+	conns []*failingConn // Dialed connections, oldest first
+}
+
+// Dial function dials addr and keeps the connection, so the test can make it fail.
+func (f *failingTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := f.PipeTransport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	failing := &failingConn{Conn: conn}
+	f.mu.Lock()
+	f.conns = append(f.conns, failing)
+	f.mu.Unlock()
+	return failing, nil
+}
+
+// failingConn struct is a connection that, once failing, writes half of what it is given and then fails.
+type failingConn struct {
+	net.Conn
+	failing atomic.Bool // Whether writes fail
+}
+
+// Write function writes p, or only its first half and an error if the connection is failing.
+func (c *failingConn) Write(p []byte) (int, error) {
+	if c.failing.Load() {
+		n, _ := c.Conn.Write(p[:len(p)/2])
+		return n, errors.New("injected write error")
+	}
+	return c.Conn.Write(p)
+}
+
+// TestPartialWriteRecyclesConnection makes a write fail halfway through a message and checks that the writer
+// tears the connection down instead of writing more to the corrupted stream: the peer only sees the
+// connection end, the connection is dialed again and the message is resent over the new one.
+func TestPartialWriteRecyclesConnection(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.ReconnectInterval = 20 * time.Millisecond
+	config.Retransmit.Timeout = 100 * time.Millisecond
+	transport := &failingTransport{PipeTransport: NewPipeTransport()}
+	cluster := startClusterOver(t, config, transport)
+	processes, outputs := cluster.processes, cluster.outputs
+	// Process 2 dials, so its writes go through the failing connection
+	transport.mu.Lock()
+	transport.conns[0].failing.Store(true)
+	transport.mu.Unlock()
+	if err := processes[2].Send(1, "across the failure"); err != nil {
+		t.Fatal(err)
+	}
+	// Either the send that failed or the receive loop that ended reports it
+	waitFor(t, "the connection to be torn down", func() bool { return len(outputs[2].Lines("injected write error")) > 0 })
+	waitFor(t, "process 2 to reconnect", func() bool { return len(outputs[2].Lines("Reconnected to process 1")) > 0 })
+	waitFor(t, "the resent message", func() bool { return len(outputs[1].Lines("Received message: across the failure")) == 1 })
+	if lines := outputs[1].Lines("closing connection to process 2: "); len(lines) > 0 {
+		t.Fatalf("process 1 misread the corrupted stream: %q", lines)
+	}
+}
+
+// TestDeadLetterAfterRetries sends a message to a process that drops everything from the sender, so every
+// retransmission goes unacknowledged, and checks that the message lands in the dead letter queue and file
+// once the retries are exhausted.
+func TestDeadLetterAfterRetries(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.Retransmit = RetransmitConfig{Timeout: 30 * time.Millisecond, MaxRetries: 2}
+	config.DeadLetterFile = "deadletters.jsonl"
+	cluster := startCluster(t, config)
+	cluster.processes[2].blocked.Block(1)
+	if err := cluster.processes[1].Send(2, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	p := cluster.processes[1]
+	waitFor(t, "the dead letter", func() bool { return len(p.deadLetters.Letters()) == 1 })
+	letter := p.deadLetters.Letters()[0]
+	if letter.DestinationID != 2 || letter.SourceID != 1 || letter.Message != "lost" || letter.Reason != "not acknowledged after 2 retries" {
+		t.Fatalf("recorded %+v", letter)
+	}
+	data, err := os.ReadFile(config.DeadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved DeadLetter
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("the dead letter file holds %q: %v", data, err)
+	}
+	if saved.Message != "lost" || saved.DestinationID != 2 {
+		t.Fatalf("saved %+v", saved)
+	}
+}
+
+// TestPauseResume pauses delivery at a process, sends it messages and checks that none is delivered while
+// it can still send, then resumes and checks that the held messages are delivered in arrival order.
+func TestPauseResume(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 2))
+	p := cluster.processes[2]
+	if parsed, _ := executeCommand(p, []string{"pause"}); !parsed {
+		t.Fatal("pause was refused")
+	}
+	if parsed, _ := executeCommand(p, []string{"pause"}); parsed {
+		t.Fatal("pausing twice was accepted")
+	}
+	want := []string{"one", "two", "three"}
+	for _, message := range want {
+		if err := cluster.processes[1].Send(2, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Send(1, "outbound"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the paused process to send", func() bool { return len(cluster.outputs[1].Lines("Received message: outbound")) == 1 })
+	time.Sleep(100 * time.Millisecond)
+	if lines := cluster.outputs[2].Lines("Received message: "); len(lines) > 0 {
+		t.Fatalf("delivered %q while paused", lines)
+	}
+	if parsed, _ := executeCommand(p, []string{"resume"}); !parsed {
+		t.Fatal("resume was refused")
+	}
+	waitFor(t, "the held messages", func() bool { return len(cluster.outputs[2].Messages("Received message: ")) == len(want) })
+	if got := cluster.outputs[2].Messages("Received message: "); !reflect.DeepEqual(got, want) {
+		t.Fatalf("delivered %v after resuming, want %v", got, want)
+	}
+	if parsed, _ := executeCommand(p, []string{"resume"}); parsed {
+		t.Fatal("resuming delivery that is not paused was accepted")
+	}
+}
+
+// TestResumeKeepsArrivalOrder resumes delivery and lets a new message arrive while the last held one is
+// still being delivered, and checks that the new message waits for it.
+func TestResumeKeepsArrivalOrder(t *testing.T) {
+	config := newTestConfig(t, 1)
+	releasing, proceed := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var delivered []string
+	config.Processes[0].DeliveryHandler = func(msg UnicastMessage) {
+		if msg.Message == "held" {
+			close(releasing)
+			<-proceed
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, msg.Message)
+	}
+	cluster := startCluster(t, config)
+	p := cluster.processes[1]
+	p.gate.Pause()
+	deliverMessage(p, UnicastMessage{SourceID: 2, Message: "held"})
+	p.gate.Resume()
+	<-releasing
+	deliverMessage(p, UnicastMessage{SourceID: 2, Message: "new"})
+	close(proceed)
+	waitFor(t, "both deliveries", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 2
+	})
+	if want := []string{"held", "new"}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("delivered %v, want %v", delivered, want)
+	}
+}
+
+// TestDeadlineIgnoresSkew runs a sender whose clock is skewed behind the receiver's on a fake clock and checks
+// that a message with a short TTL is delivered when it arrives at once, but dropped as expired when its
+// delivery is held back past the TTL.
+func TestDeadlineIgnoresSkew(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.ClockSkews[1] = -10 * time.Second
+	config.ClockSkews[2] = 10 * time.Second
+	clock := newFakeClock()
+	for i := range config.Processes {
+		config.Processes[i].Time = clock
+	}
+	cluster := startCluster(t, config)
+	p := cluster.processes[1]
+	if err := p.SendWithTTL(2, "fresh", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the fresh message", func() bool { return len(cluster.outputs[2].Lines("Received message: fresh")) == 1 })
+	if err := p.delays.Set(500, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendWithTTL(2, "late", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the late message to expire", func() bool {
+		if len(cluster.outputs[2].Lines("Expired message: late")) > 0 {
+			return true
+		}
+		clock.Advance(100 * time.Millisecond)
+		return false
+	})
+	if lines := cluster.outputs[2].Lines("Received message: late"); len(lines) > 0 {
+		t.Fatalf("delivered an expired message: %q", lines)
+	}
+}
+
+// freePortPair function returns two consecutive ports free for both TCP and UDP on the loopback address.
+func freePortPair(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		port := freePort(t)
+		free := true
+		for _, p := range []int{port, port + 1} {
+			address := net.JoinHostPort("127.0.0.1", strconv.Itoa(p))
+			ln, err := net.Listen("tcp", address)
+			if err != nil {
+				free = false
+				break
+			}
+			ln.Close()
+			udp, err := net.ListenPacket("udp4", net.JoinHostPort("", strconv.Itoa(p)))
+			if err != nil {
+				free = false
+				break
+			}
+			udp.Close()
+		}
+		if free {
+			return port
+		}
+	}
+	t.Fatal("found no two consecutive free ports")
+	return 0
+}
+
+// TestDiscovery launches two processes over TCP whose configurations only list themselves, with discovery on
+// loopback, and checks that they find each other, connect and exchange a message.
+func TestDiscovery(t *testing.T) {
+	t.Chdir(t.TempDir())
+	port := freePortPair(t)
+	processes := make(map[int]*Process)
+	outputs := make(map[int]*syncBuffer)
+	for id := 1; id <= 2; id++ {
+		config := newConfig(0, 0)
+		config.Discovery = DiscoveryConfig{FirstPort: port, LastPort: port + 1, BroadcastAddr: "127.0.0.1"}
+		process := Process{ID: id, IP: "127.0.0.1", Port: strconv.Itoa(port + id - 1), BindAddr: "127.0.0.1"}
+		config.Processes = []Process{process}
+		transport := newTCPTransport(t, config)
+		outputs[id] = &syncBuffer{}
+		process.Output = outputs[id]
+		p, err := launchProcess(process, config, transport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			p.Shutdown()
+			p.Wait()
+		})
+		processes[id] = p
+	}
+	for id, other := range map[int]int{1: 2, 2: 1} {
+		waitFor(t, fmt.Sprintf("process %d to discover process %d", id, other), func() bool {
+			return len(outputs[id].Lines(fmt.Sprintf("Discovered process %d at 127.0.0.1:%d", other, port+other-1))) == 1
+		})
+		waitFor(t, fmt.Sprintf("process %d to connect to process %d", id, other), func() bool {
+			_, ok := processes[id].connections.Get(other)
+			return ok
+		})
+	}
+	if err := processes[2].Send(1, "found you"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return len(outputs[1].Lines("Received message: found you")) == 1 })
+}
+
+// TestCircuitBreaker drives the sends to a process that drops every message into repeated failures and checks
+// that its breaker opens and fails new messages right away, half-opens after the cooldown, and closes again once
+// the trial message gets through.
+func TestCircuitBreaker(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.Retransmit = RetransmitConfig{Timeout: 20 * time.Millisecond, MaxRetries: 1}
+	config.Breaker = BreakerConfig{Failures: 2, Cooldown: 300 * time.Millisecond}
+	cluster := startCluster(t, config)
+	p := cluster.processes[1]
+	cluster.processes[2].blocked.Block(1)
+	for _, message := range []string{"a", "b"} {
+		if err := p.Send(2, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the breaker to open", func() bool { return len(cluster.outputs[1].Lines("circuit breaker to process 2 is open")) > 0 })
+	if state := p.breaker.State(2, p.Time.Now()); state != BreakerOpen {
+		t.Fatalf("the breaker is %s, want %s", state, BreakerOpen)
+	}
+	if err := p.Send(2, "refused"); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("sending through an open breaker returned %v", err)
+	}
+	letters := p.deadLetters.Letters()
+	if last := letters[len(letters)-1]; last.Message != "refused" {
+		t.Fatalf("the last dead letter is %+v, want the refused message", last)
+	}
+	waitFor(t, "the breaker to half-open", func() bool { return p.breaker.State(2, p.Time.Now()) == BreakerHalfOpen })
+	cluster.processes[2].blocked.Unblock(1)
+	if err := p.Send(2, "trial"); err != nil {
+		t.Fatalf("the trial message was refused: %v", err)
+	}
+	waitFor(t, "the breaker to close", func() bool { return len(cluster.outputs[1].Lines("circuit breaker to process 2 is closed again")) > 0 })
+	if state := p.breaker.State(2, p.Time.Now()); state != BreakerClosed {
+		t.Fatalf("the breaker is %s after the trial succeeded, want %s", state, BreakerClosed)
+	}
+}
+
+// TestDriftEstimate injects a known offset between the clocks of two processes sharing a fake clock, as a skew,
+// and checks that the drift command estimates it exactly in both directions, since no time passes in transit.
+func TestDriftEstimate(t *testing.T) {
+	config := newTestConfig(t, 2)
+	config.ClockSkews[2] = 1500 * time.Millisecond
+	clock := newFakeClock()
+	for i := range config.Processes {
+		config.Processes[i].Time = clock
+	}
+	cluster := startCluster(t, config)
+	if err := ping(cluster.processes[1], 2, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "process 1 to estimate the offset", func() bool {
+		return len(cluster.outputs[1].Lines("Clock of process 2 is 1.5s ahead of this process, round-trip time is: 0s")) == 1
+	})
+	if err := ping(cluster.processes[2], 1, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "process 2 to estimate the offset", func() bool {
+		return len(cluster.outputs[2].Lines("Clock of process 1 is 1.5s behind this process, round-trip time is: 0s")) == 1
+	})
+	// With the clock advanced in transit, the round trip is measured and the offset still estimated
+	offset, rtt := clockOffset(clock.Now(), clock.Now().Add(1500*time.Millisecond+20*time.Millisecond), clock.Now().Add(1500*time.Millisecond+30*time.Millisecond), clock.Now().Add(50*time.Millisecond))
+	if offset != 1500*time.Millisecond || rtt != 40*time.Millisecond {
+		t.Fatalf("estimated an offset of %s and a round trip of %s, want 1.5s and 40ms", offset, rtt)
+	}
+}
+
+// TestDelayModes sends five messages with the same delays in both delay modes, on a fake clock that fires the
+// equal delays together. With at-most-once delivery messages are delivered as they arrive, so both modes deliver
+// the messages with the shorter delay first, and the queued mode also delivers equal delays in send order.
+func TestDelayModes(t *testing.T) {
+	delays := []time.Duration{100 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond}
+	for _, mode := range []string{DelayModeIndependent, DelayModeQueued} {
+		t.Run(mode, func(t *testing.T) {
+			config := newTestConfig(t, 2)
+			config.DelayMode = mode
+			config.DeliverySemantics = SemanticsAtMostOnce
+			clock := newFakeClock()
+			for i := range config.Processes {
+				config.Processes[i].Time = clock
+			}
+			cluster := startCluster(t, config)
+			// Fire whatever is still delayed if the test fails, shutting down waits for it on the fake clock
+			t.Cleanup(func() { clock.Advance(time.Minute) })
+			p := cluster.processes[1]
+			for i, delay := range delays {
+				unicast_send_with_delay(p, 2, newMessage(p.ID, fmt.Sprintf("m%d", i+1), p.clock, p.causal), delay)
+			}
+			// Let the goroutines of the independent mode start waiting before the clock moves
+			time.Sleep(50 * time.Millisecond)
+			output := cluster.outputs[2]
+			for _, delivered := range []int{2, 5} {
+				clock.Advance(50 * time.Millisecond)
+				waitFor(t, fmt.Sprintf("%d deliveries", delivered), func() bool { return len(output.Messages("Received message: ")) == delivered })
+			}
+			got := output.Messages("Received message: ")
+			if mode == DelayModeQueued {
+				if want := []string{"m2", "m4", "m1", "m3", "m5"}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("delivered %v, want %v", got, want)
+				}
+				return
+			}
+			// Equal fire times race in the independent mode
+			sort.Strings(got[:2])
+			sort.Strings(got[2:])
+			if want := []string{"m2", "m4", "m1", "m3", "m5"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("delivered %v, want m2 and m4 before m1, m3 and m5", got)
+			}
+		})
+	}
+}
+
+// TestMessageTrackerConcurrent hammers a tracker from many goroutines, each marking every sequence number,
+// nonce and gossip ID of several sources, and checks that each was reported new exactly once. Run with -race.
+func TestMessageTrackerConcurrent(t *testing.T) {
+	const goroutines, sources, seqs = 16, 4, 500
+	tracker := NewMessageTracker(seqs, seqs)
+	var seen, nonces, gossip [sources][seqs]atomic.Int32
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 1; seq <= seqs; seq++ {
+				for source := 1; source <= sources; source++ {
+					if tracker.MarkSeen(source, seq) {
+						seen[source-1][seq-1].Add(1)
+					}
+					if tracker.MarkNonce(source, uint64(seq)) {
+						nonces[source-1][seq-1].Add(1)
+					}
+					if tracker.MarkGossip(fmt.Sprintf("%d-%d", source, seq)) {
+						gossip[source-1][seq-1].Add(1)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for source := 0; source < sources; source++ {
+		for seq := 0; seq < seqs; seq++ {
+			if n := seen[source][seq].Load(); n != 1 {
+				t.Fatalf("sequence number %d of source %d was new %d times", seq+1, source+1, n)
+			}
+			if n := nonces[source][seq].Load(); n != 1 {
+				t.Fatalf("nonce %d of source %d was new %d times", seq+1, source+1, n)
+			}
+			if n := gossip[source][seq].Load(); n != 1 {
+				t.Fatalf("gossip ID %d-%d was new %d times", source+1, seq+1, n)
+			}
+		}
+	}
+}
+
+// TestLatencyCommand adds latency to the link to one peer with the latency command and checks that a multicast
+// reaches that peer at least the latency later than the other one, and that latency 0 clears it.
+func TestLatencyCommand(t *testing.T) {
+	cluster := startCluster(t, newTestConfig(t, 3))
+	p := cluster.processes[1]
+	if parsed, _ := executeCommand(p, strings.Fields("latency 2 200")); !parsed {
+		t.Fatal("the latency command was refused")
+	}
+	for _, command := range []string{"latency 9 100", "latency 2 -1"} {
+		if parsed, _ := executeCommand(p, strings.Fields(command)); parsed {
+			t.Fatalf("%q was accepted", command)
+		}
+	}
+	start := time.Now()
+	if sent := multicast_send(p, "slow link"); sent != 2 {
+		t.Fatalf("sent to %d processes, want 2", sent)
+	}
+	waitFor(t, "process 3 to receive", func() bool { return len(cluster.outputs[3].Lines("Received message: slow link")) == 1 })
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("process 3 received after %s, the latency of process 2 slowed it down", elapsed)
+	}
+	waitFor(t, "process 2 to receive", func() bool { return len(cluster.outputs[2].Lines("Received message: slow link")) == 1 })
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("process 2 received after %s, before the latency of 200ms", elapsed)
+	}
+	if parsed, _ := executeCommand(p, strings.Fields("latency 2 0")); !parsed {
+		t.Fatal("clearing the latency was refused")
+	}
+	if delay := messageDelay(p, 2); delay != 0 {
+		t.Fatalf("the delay to process 2 is %s after clearing the latency", delay)
+	}
+}
+
+// TestPeerFailedEvent subscribes to the PeerFailed events of a process in a cluster running on a fake clock,
+// crashes another process and advances the clock until the event fires, checking that it names the crashed peer.
+func TestPeerFailedEvent(t *testing.T) {
+	config := newTestConfig(t, 3)
+	config.HeartbeatInterval = time.Second
+	config.HeartbeatJitter = 0
+	clock := newFakeClock()
+	for i := range config.Processes {
+		config.Processes[i].Time = clock
+	}
+	cluster := startCluster(t, config)
+	var mu sync.Mutex
+	var failed []Event
+	cluster.processes[1].Events.Subscribe(EventPeerFailed, func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, event)
+	})
+	if err := cluster.processes[3].Crash(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the PeerFailed event", func() bool {
+		mu.Lock()
+		fired := len(failed) > 0
+		mu.Unlock()
+		if !fired {
+			clock.Advance(config.HeartbeatInterval)
+		}
+		return fired
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 1 || failed[0].Type != EventPeerFailed || failed[0].ProcessID != 1 || failed[0].PeerID != 3 {
+		t.Fatalf("got the events %+v, want one PeerFailed event of process 1 about process 3", failed)
+	}
+}